@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// something that just happened, for the dashboard (or anyone
+// else tailing /dashboard/events)
+type activityEvent struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Hash      string    `json:"hash,omitempty"`
+	Extension string    `json:"extension,omitempty"`
+	Size      string    `json:"size,omitempty"`
+	Node      string    `json:"node,omitempty"`
+}
+
+func imageActivity(typ string, ir imageRecord) activityEvent {
+	return activityEvent{Type: typ, Hash: ir.Hash.String(), Extension: ir.Extension}
+}
+
+func nodeActivity(typ string, n nodeData) activityEvent {
+	return activityEvent{Type: typ, Node: n.Nickname}
+}
+
+// how many events a subscriber can fall behind by before it
+// starts missing them
+const activityBuffer = 64
+
+// activityFeed hands out events to whoever is listening. It never
+// waits on a subscriber: one that isn't keeping up just misses
+// events, so a stuck browser tab can't slow down an upload.
+//
+// All the methods are safe to call on a nil *activityFeed, which
+// never has anything to say.
+type activityFeed struct {
+	metrics *metrics
+
+	mu   sync.Mutex
+	subs map[chan activityEvent]struct{}
+}
+
+func newActivityFeed() *activityFeed {
+	return &activityFeed{subs: make(map[chan activityEvent]struct{})}
+}
+
+// Subscribe returns a channel of events, and a function to call
+// when done with it
+func (a *activityFeed) Subscribe() (<-chan activityEvent, func()) {
+	ch := make(chan activityEvent, activityBuffer)
+	if a == nil {
+		return ch, func() {}
+	}
+	a.mu.Lock()
+	a.subs[ch] = struct{}{}
+	a.mu.Unlock()
+	return ch, func() {
+		a.mu.Lock()
+		delete(a.subs, ch)
+		a.mu.Unlock()
+	}
+}
+
+func (a *activityFeed) Publish(e activityEvent) {
+	if a == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for ch := range a.subs {
+		select {
+		case ch <- e:
+		default:
+			a.metrics.ActivityDropped()
+		}
+	}
+}
+
+// how often to send something down an otherwise quiet stream, so
+// that proxies don't time it out
+var activityKeepalive = 15 * time.Second
+
+// streams the activity feed as server-sent events, until the
+// client goes away
+func activityHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	events, done := ctx.Cfg.Activity.Subscribe()
+	defer done()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(activityKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			_, _ = fmt.Fprint(w, ": keepalive\n\n")
+		case e := <-events:
+			b, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_activityFeed(t *testing.T) {
+	a := newActivityFeed()
+	a.metrics = newMetrics(prometheus.NewRegistry())
+	events, done := a.Subscribe()
+	a.Publish(activityEvent{Type: "uploaded", Hash: "fb682e05b9be61797601e60165825c0b089f755e"})
+	e := <-events
+	if e.Type != "uploaded" || e.Time.IsZero() {
+		t.Errorf("wrong event: %v", e)
+	}
+
+	// a subscriber that isn't reading just misses out
+	for i := 0; i < activityBuffer+5; i++ {
+		a.Publish(activityEvent{Type: "resized"})
+	}
+	if dropped := testutil.ToFloat64(a.metrics.activityDropped); len(events) != activityBuffer || dropped != 5 {
+		t.Errorf("expected a full buffer and 5 dropped, got %d and %v", len(events), dropped)
+	}
+
+	done()
+	if len(a.subs) != 0 {
+		t.Error("should have unsubscribed")
+	}
+
+	var nilFeed *activityFeed
+	nilFeed.Publish(activityEvent{Type: "uploaded"})
+	_, nilDone := nilFeed.Subscribe()
+	nilDone()
+}
+
+func Test_clusterActivity(t *testing.T) {
+	_, c := makeNewClusterData([]nodeData{})
+	c.activity = newActivityFeed()
+	events, done := c.activity.Subscribe()
+	defer done()
+
+	ri := jbodSpec(t, "fb682e05b9be61797601e60165825c0b089f755e")
+	c.Uploaded(imageRecord{*ri.Hash, ri.Extension})
+	c.AddNeighbor(nodeData{UUID: "new-node", Nickname: "new"})
+	c.Sync()
+
+	e := <-events
+	if e.Type != "uploaded" || e.Hash != ri.Hash.String() || e.Extension != ".jpg" {
+		t.Errorf("wrong upload event: %v", e)
+	}
+	e = <-events
+	if e.Type != "neighbor.joined" || e.Node != "new" {
+		t.Errorf("wrong neighbor event: %v", e)
+	}
+}
+
+func Test_activityHandler(t *testing.T) {
+	ctx := makeTestContextWithUploadDir(t.TempDir())
+	ctx.Cfg.Activity = newActivityFeed()
+	ts := httptest.NewServer(makeHandler(activityHandler, ctx))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("wrong content type: %s", resp.Header.Get("Content-Type"))
+	}
+
+	// the handler has subscribed by the time the headers are sent
+	ctx.Cfg.Activity.Publish(activityEvent{Type: "stashed", Hash: "fb682e05b9be61797601e60165825c0b089f755e"})
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	var got []string
+	timeout := time.After(5 * time.Second)
+	for len(got) < 2 {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("stream ended early: %v", got)
+			}
+			got = append(got, line)
+		case <-timeout:
+			t.Fatalf("timed out waiting for the event: %v", got)
+		}
+	}
+	if got[0] != "event: stashed" {
+		t.Errorf("expected the event type, got %q", got[0])
+	}
+	var e activityEvent
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(got[1], "data: ")), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Hash != "fb682e05b9be61797601e60165825c0b089f755e" {
+		t.Errorf("wrong event: %v", e)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/thraxil/resize"
+)
+
+// The JSON admin API. Everything here has its own response type,
+// rather than marshalling the internal structs directly, so that
+// the field names stay put when the internals change. Anything
+// added to /api/v1/ must only ever add fields.
+
+type apiNode struct {
+	Nickname    string     `json:"nickname"`
+	UUID        string     `json:"uuid"`
+	BaseURL     string     `json:"base_url"`
+	Location    string     `json:"location"`
+	Writeable   bool       `json:"writeable"`
+	Draining    bool       `json:"draining"`
+	Full        bool       `json:"full"`
+	BytesUsed   uint64     `json:"bytes_used"`
+	BytesFree   uint64     `json:"bytes_free"`
+	UsedPercent float64    `json:"used_percent"`
+	Healthy     bool       `json:"healthy"`
+	LastSeen    *time.Time `json:"last_seen"`
+	LastFailed  *time.Time `json:"last_failed"`
+}
+
+// nil for "never"
+func apiTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func newAPINode(n nodeData) apiNode {
+	return apiNode{
+		Nickname:    n.Nickname,
+		UUID:        n.UUID,
+		BaseURL:     n.BaseURL,
+		Location:    n.Location,
+		Writeable:   n.Writeable,
+		Draining:    n.Draining,
+		Full:        n.Full,
+		BytesUsed:   n.BytesUsed,
+		BytesFree:   n.BytesFree,
+		UsedPercent: n.UsedPercent(),
+		Healthy:     n.IsCurrent(),
+		LastSeen:    apiTime(n.LastSeen),
+		LastFailed:  apiTime(n.LastFailed),
+	}
+}
+
+func newAPINodes(nodes []nodeData) []apiNode {
+	out := make([]apiNode, 0, len(nodes))
+	for _, n := range nodes {
+		out = append(out, newAPINode(n))
+	}
+	return out
+}
+
+// the same things the status page shows, and never any secrets
+// (upload keys, webhook secrets)
+type apiConfig struct {
+	Port             int64    `json:"port"`
+	Replication      int      `json:"replication"`
+	MinReplication   int      `json:"min_replication"`
+	MaxReplication   int      `json:"max_replication"`
+	NumResizeWorkers int      `json:"num_resize_workers"`
+	GossiperSleep    int      `json:"gossiper_sleep"`
+	VerifierSleep    int      `json:"verifier_sleep"`
+	Writeable        bool     `json:"writeable"`
+	HighWaterMark    int      `json:"high_water_mark"`
+	LowWaterMark     int      `json:"low_water_mark"`
+	Disks            []string `json:"disks"`
+}
+
+func newAPIConfig(s *siteConfig) apiConfig {
+	disks := s.Disks
+	if disks == nil {
+		disks = []string{}
+	}
+	return apiConfig{
+		Port:             s.Port,
+		Replication:      s.Replication,
+		MinReplication:   s.MinReplication,
+		MaxReplication:   s.MaxReplication,
+		NumResizeWorkers: s.NumResizeWorkers,
+		GossiperSleep:    s.GossiperSleep,
+		VerifierSleep:    s.VerifierSleep,
+		Writeable:        s.Writeable,
+		HighWaterMark:    s.HighWaterMark,
+		LowWaterMark:     s.LowWaterMark,
+		Disks:            disks,
+	}
+}
+
+type apiDisk struct {
+	Root        string  `json:"root"`
+	Failed      bool    `json:"failed"`
+	Error       string  `json:"error,omitempty"`
+	Total       uint64  `json:"total"`
+	Used        uint64  `json:"used"`
+	Free        uint64  `json:"free"`
+	UsedPercent float64 `json:"used_percent"`
+}
+
+func newAPIDisks(disks []diskStatus) []apiDisk {
+	out := make([]apiDisk, 0, len(disks))
+	for _, d := range disks {
+		out = append(out, apiDisk{
+			Root:        d.Root,
+			Failed:      d.Failed,
+			Error:       d.Error,
+			Total:       d.Total,
+			Used:        d.Used,
+			Free:        d.Free,
+			UsedPercent: d.UsedPercent(),
+		})
+	}
+	return out
+}
+
+type apiStatus struct {
+	Config    apiConfig `json:"config"`
+	Myself    apiNode   `json:"myself"`
+	Neighbors []apiNode `json:"neighbors"`
+	Disks     []apiDisk `json:"disks"`
+}
+
+type apiImage struct {
+	Hash      string `json:"hash"`
+	Extension string `json:"extension"`
+}
+
+func newAPIImages(records []imageRecord) []apiImage {
+	// newest first, like the dashboard
+	out := make([]apiImage, 0, len(records))
+	for _, ir := range reverseImages(records) {
+		out = append(out, apiImage{Hash: ir.Hash.String(), Extension: ir.Extension})
+	}
+	return out
+}
+
+type apiActivity struct {
+	Verified []apiImage `json:"verified"`
+	Uploaded []apiImage `json:"uploaded"`
+	Stashed  []apiImage `json:"stashed"`
+}
+
+type apiPlacementNode struct {
+	Nickname   string `json:"nickname"`
+	UUID       string `json:"uuid"`
+	BaseURL    string `json:"base_url"`
+	ShouldHave bool   `json:"should_have"`
+	HasIt      bool   `json:"has_it"`
+	Status     string `json:"status"`
+	Myself     bool   `json:"myself"`
+}
+
+type apiPlacement struct {
+	Hash           string             `json:"hash"`
+	Extension      string             `json:"extension"`
+	Replication    int                `json:"replication"`
+	MinReplication int                `json:"min_replication"`
+	Replicas       int                `json:"replicas"`
+	Satisfied      bool               `json:"satisfied"`
+	Misplaced      int                `json:"misplaced"`
+	Nodes          []apiPlacementNode `json:"nodes"`
+}
+
+type apiLogEntry struct {
+	Timestamp string `json:"timestamp"`
+	Level     string `json:"level"`
+	Message   string `json:"msg"`
+	Component string `json:"component"`
+	Node      string `json:"node"`
+	Image     string `json:"image"`
+	Error     string `json:"error"`
+	Raw       string `json:"raw"`
+}
+
+func newAPILogEntries(entries []LogEntry) []apiLogEntry {
+	out := make([]apiLogEntry, 0, len(entries))
+	for _, e := range entries {
+		le := apiLogEntry{
+			Timestamp: e.Timestamp,
+			Level:     e.Level,
+			Component: e.Component,
+			Node:      e.Node,
+			Image:     e.Image,
+			Raw:       e.Raw,
+		}
+		if e.Message != nil {
+			le.Message = fmt.Sprint(e.Message)
+		}
+		if e.Error != nil {
+			le.Error = fmt.Sprint(e.Error)
+		}
+		out = append(out, le)
+	}
+	return out
+}
+
+// the cluster keeps them in a map, so they'd come out in a
+// different order every time
+func sortedNeighbors(nodes []nodeData) []nodeData {
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Nickname < nodes[j].Nickname })
+	return nodes
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func apiConfigHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+	writeJSON(w, newAPIConfig(ctx.Cfg))
+}
+
+func apiMyselfHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+	writeJSON(w, newAPINode(ctx.cluster.GetMyself()))
+}
+
+func apiNeighborsHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+	writeJSON(w, newAPINodes(sortedNeighbors(ctx.cluster.GetNeighbors())))
+}
+
+func apiDisksHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+	writeJSON(w, newAPIDisks(ctx.Cfg.diskStatuses()))
+}
+
+func apiStatusHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+	writeJSON(w, apiStatus{
+		Config:    newAPIConfig(ctx.Cfg),
+		Myself:    newAPINode(ctx.cluster.GetMyself()),
+		Neighbors: newAPINodes(sortedNeighbors(ctx.cluster.GetNeighbors())),
+		Disks:     newAPIDisks(ctx.Cfg.diskStatuses()),
+	})
+}
+
+func apiActivityHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+	writeJSON(w, apiActivity{
+		Verified: newAPIImages(ctx.cluster.GetRecentlyVerified()),
+		Uploaded: newAPIImages(ctx.cluster.GetRecentlyUploaded()),
+		Stashed:  newAPIImages(ctx.cluster.GetRecentlyStashed()),
+	})
+}
+
+func apiLogsHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+	writeJSON(w, newAPILogEntries(GlobalLogCache.StructuredEntries()))
+}
+
+// where an image should be, and where it actually is
+func apiImageHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+	ahash, err := hashFromString(r.PathValue("hash"), "")
+	if err != nil {
+		http.Error(w, "invalid hash", http.StatusNotFound)
+		return
+	}
+	ext := "." + strings.TrimPrefix(r.PathValue("ext"), ".")
+	ri := &imageSpecifier{ahash, resize.MakeSizeSpec("full"), ext}
+	infos := imagePlacement(r.Context(), ctx, ri)
+
+	p := apiPlacement{
+		Hash:           ahash.String(),
+		Extension:      ext,
+		Replication:    ctx.Cfg.Replication,
+		MinReplication: ctx.Cfg.MinReplication,
+		Nodes:          make([]apiPlacementNode, 0, len(infos)),
+	}
+	for _, info := range infos {
+		if info.HasIt {
+			p.Replicas++
+			if !info.ShouldHave {
+				p.Misplaced++
+			}
+		}
+		p.Nodes = append(p.Nodes, apiPlacementNode{
+			Nickname:   info.Node.Nickname,
+			UUID:       info.Node.UUID,
+			BaseURL:    info.Node.BaseURL,
+			ShouldHave: info.ShouldHave,
+			HasIt:      info.HasIt,
+			Status:     info.Status,
+			Myself:     info.IsMyself,
+		})
+	}
+	p.Satisfied = p.Replicas >= p.MinReplication
+	writeJSON(w, p)
+}
+
+type apiPlacementReportNode struct {
+	Nickname  string `json:"nickname"`
+	UUID      string `json:"uuid"`
+	Reachable bool   `json:"reachable"`
+	Images    int    `json:"images"`
+}
+
+type apiPlacementProblem struct {
+	Hash            string   `json:"hash"`
+	Extension       string   `json:"extension"`
+	Replicas        int      `json:"replicas"`
+	Holders         []string `json:"holders"`
+	Owners          []string `json:"owners"`
+	UnderReplicated bool     `json:"under_replicated"`
+	OverReplicated  bool     `json:"over_replicated"`
+	Misplaced       bool     `json:"misplaced"`
+}
+
+type apiPlacementReport struct {
+	Updated         *time.Time               `json:"updated"`
+	Replication     int                      `json:"replication"`
+	Images          int                      `json:"images"`
+	UnderReplicated int                      `json:"under_replicated"`
+	OverReplicated  int                      `json:"over_replicated"`
+	Misplaced       int                      `json:"misplaced"`
+	Nodes           []apiPlacementReportNode `json:"nodes"`
+	Problems        []apiPlacementProblem    `json:"problems"`
+}
+
+// the cluster-wide placement report, as of its last refresh.
+// problems only lists a sample; the counts are exact.
+func apiPlacementReportHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+	if ctx.Placement == nil {
+		http.Error(w, "placement report is not running", http.StatusServiceUnavailable)
+		return
+	}
+	sum := ctx.Placement.Summary()
+	rep := apiPlacementReport{
+		Updated:         apiTime(sum.Updated),
+		Replication:     sum.Replication,
+		Images:          sum.Images,
+		UnderReplicated: sum.UnderReplicated,
+		OverReplicated:  sum.OverReplicated,
+		Misplaced:       sum.Misplaced,
+		Nodes:           make([]apiPlacementReportNode, 0, len(sum.Nodes)),
+		Problems:        make([]apiPlacementProblem, 0, len(sum.Problems)),
+	}
+	for uuid, n := range sum.Nodes {
+		rep.Nodes = append(rep.Nodes, apiPlacementReportNode{
+			Nickname: n.Nickname, UUID: uuid, Reachable: n.Reachable, Images: n.Images,
+		})
+	}
+	sort.Slice(rep.Nodes, func(i, j int) bool { return rep.Nodes[i].Nickname < rep.Nodes[j].Nickname })
+	for _, img := range sum.Problems {
+		rep.Problems = append(rep.Problems, apiPlacementProblem{
+			Hash:            img.Hash,
+			Extension:       img.Extension,
+			Replicas:        img.Replicas,
+			Holders:         img.Holders,
+			Owners:          img.Owners,
+			UnderReplicated: img.UnderReplicated,
+			OverReplicated:  img.OverReplicated,
+			Misplaced:       img.Misplaced,
+		})
+	}
+	writeJSON(w, rep)
+}
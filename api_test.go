@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+func apiTestContext(c Cluster) sitecontext {
+	return sitecontext{
+		cluster: c,
+		Cfg: &siteConfig{
+			Port:           8080,
+			Replication:    1,
+			MinReplication: 1,
+			UploadKeys:     []string{"sekrit"},
+			Webhooks:       []webhookConfig{{URL: "http://localhost:0/", Secret: "sekrit"}},
+			HighWaterMark:  95,
+			LowWaterMark:   90,
+		},
+		SL: log.NewNopLogger(),
+	}
+}
+
+// runs the handler and returns the response body decoded as
+// generically as possible, so the tests check the actual field
+// names that clients depend on
+func apiGet(t *testing.T, fn func(http.ResponseWriter, *http.Request, sitecontext), ctx sitecontext, req *http.Request) interface{} {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	fn(rec, req, ctx)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("wrong content type: %s", ct)
+	}
+	if strings.Contains(rec.Body.String(), "sekrit") {
+		t.Error("secrets should never be in the API")
+	}
+	var v interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("not JSON: %v", err)
+	}
+	return v
+}
+
+func hasKeys(t *testing.T, what string, v interface{}, keys ...string) map[string]interface{} {
+	t.Helper()
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		t.Fatalf("%s should be an object, got %v", what, v)
+	}
+	for _, k := range keys {
+		if _, ok := m[k]; !ok {
+			t.Errorf("%s is missing %q", what, k)
+		}
+	}
+	return m
+}
+
+var apiNodeKeys = []string{
+	"nickname", "uuid", "base_url", "location", "writeable", "draining", "full",
+	"bytes_used", "bytes_free", "used_percent", "healthy", "last_seen", "last_failed",
+}
+
+func Test_apiStatusHandler(t *testing.T) {
+	now := time.Now()
+	c := &mockCluster{
+		GetMyselfFunc: func() nodeData {
+			return nodeData{Nickname: "myself", UUID: "myself", Writeable: true}
+		},
+		GetNeighborsFunc: func() []nodeData {
+			return []nodeData{
+				{Nickname: "zed", UUID: "uuid2", LastFailed: now},
+				{Nickname: "alpha", UUID: "uuid1", LastSeen: now, BytesUsed: 25, BytesFree: 75},
+			}
+		},
+	}
+	ctx := apiTestContext(c)
+	v := apiGet(t, apiStatusHandler, ctx, httptest.NewRequest("GET", "/api/v1/status", nil))
+	status := hasKeys(t, "status", v, "config", "myself", "neighbors", "disks")
+	hasKeys(t, "config", status["config"], "port", "replication", "min_replication", "max_replication",
+		"num_resize_workers", "gossiper_sleep", "verifier_sleep", "writeable", "high_water_mark",
+		"low_water_mark", "disks")
+	myself := hasKeys(t, "myself", status["myself"], apiNodeKeys...)
+	if myself["nickname"] != "myself" || myself["last_seen"] != nil {
+		t.Errorf("wrong myself: %v", myself)
+	}
+
+	neighbors, ok := status["neighbors"].([]interface{})
+	if !ok || len(neighbors) != 2 {
+		t.Fatalf("expected two neighbors, got %v", status["neighbors"])
+	}
+	alpha := hasKeys(t, "neighbor", neighbors[0], apiNodeKeys...)
+	if alpha["nickname"] != "alpha" || alpha["healthy"] != true || alpha["used_percent"] != 25.0 {
+		t.Errorf("neighbors should be sorted, with their health: %v", alpha)
+	}
+	zed := hasKeys(t, "neighbor", neighbors[1], apiNodeKeys...)
+	if zed["healthy"] != false {
+		t.Errorf("a node that has only failed isn't healthy: %v", zed)
+	}
+}
+
+func Test_apiActivityHandler(t *testing.T) {
+	first := jbodSpec(t, "fb682e05b9be61797601e60165825c0b089f755e")
+	second := jbodSpec(t, "c1986af3c26609b8b7d8933f99c51c1a89e9ea6b")
+	c := &mockCluster{
+		GetRecentlyUploadedFunc: func() []imageRecord {
+			return []imageRecord{{*first.Hash, ".jpg"}, {*second.Hash, ".png"}}
+		},
+	}
+	v := apiGet(t, apiActivityHandler, apiTestContext(c), httptest.NewRequest("GET", "/api/v1/activity", nil))
+	activity := hasKeys(t, "activity", v, "verified", "uploaded", "stashed")
+	if verified, ok := activity["verified"].([]interface{}); !ok || len(verified) != 0 {
+		t.Errorf("nothing verified should be an empty list, got %v", activity["verified"])
+	}
+	uploaded := activity["uploaded"].([]interface{})
+	if len(uploaded) != 2 {
+		t.Fatalf("expected two uploads, got %v", uploaded)
+	}
+	newest := hasKeys(t, "upload", uploaded[0], "hash", "extension")
+	if newest["hash"] != second.Hash.String() || newest["extension"] != ".png" {
+		t.Errorf("newest should be first, got %v", newest)
+	}
+}
+
+// a node that holds whichever images it's given
+func imageInfoNode(t *testing.T, held map[string]bool) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqs []imageInfoRequest
+		_ = json.NewDecoder(r.Body).Decode(&reqs)
+		var resps []imageInfoResponse
+		for _, req := range reqs {
+			resps = append(resps, imageInfoResponse{Hash: req.Hash, Extension: req.Extension, Local: held[req.Hash]})
+		}
+		_ = json.NewEncoder(w).Encode(resps)
+	}))
+}
+
+func Test_apiImageHandler(t *testing.T) {
+	hash := "fb682e05b9be61797601e60165825c0b089f755e"
+	owner := imageInfoNode(t, map[string]bool{})
+	defer owner.Close()
+	other := imageInfoNode(t, map[string]bool{hash: true})
+	defer other.Close()
+
+	nodes := []nodeData{
+		{Nickname: "owner", UUID: "uuid1", BaseURL: strings.TrimPrefix(owner.URL, "http://")},
+		{Nickname: "other", UUID: "uuid2", BaseURL: strings.TrimPrefix(other.URL, "http://")},
+	}
+	c := &mockCluster{
+		NeighborsInclusiveFunc: func() []nodeData { return nodes },
+		WriteOrderFunc:         func(string) []nodeData { return nodes },
+		GetMyselfFunc:          func() nodeData { return nodes[0] },
+	}
+	req := httptest.NewRequest("GET", "/api/v1/images/"+hash+"/jpg", nil)
+	req.SetPathValue("hash", hash)
+	req.SetPathValue("ext", "jpg")
+	v := apiGet(t, apiImageHandler, apiTestContext(c), req)
+	p := hasKeys(t, "placement", v, "hash", "extension", "replication", "min_replication",
+		"replicas", "satisfied", "misplaced", "nodes")
+	if p["extension"] != ".jpg" || p["replicas"] != 1.0 || p["satisfied"] != true || p["misplaced"] != 1.0 {
+		t.Errorf("wrong placement: %v", p)
+	}
+	placed := p["nodes"].([]interface{})
+	if len(placed) != 2 {
+		t.Fatalf("expected both nodes, got %v", placed)
+	}
+	var got []string
+	for _, n := range placed {
+		m := hasKeys(t, "node", n, "nickname", "uuid", "base_url", "should_have", "has_it", "status", "myself")
+		got = append(got, m["nickname"].(string)+" "+m["status"].(string))
+		if m["nickname"] == "owner" && (m["should_have"] != true || m["myself"] != true) {
+			t.Errorf("owner should have it: %v", m)
+		}
+	}
+	sort.Strings(got)
+	if strings.Join(got, ",") != "other ok,owner missing" {
+		t.Errorf("wrong statuses: %v", got)
+	}
+
+	bad := httptest.NewRequest("GET", "/api/v1/images/nope/jpg", nil)
+	bad.SetPathValue("hash", "nope")
+	rec := httptest.NewRecorder()
+	apiImageHandler(rec, bad, apiTestContext(c))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a bad hash, got %d", rec.Code)
+	}
+}
+
+func Test_apiLogsHandler(t *testing.T) {
+	_, _ = GlobalLogCache.Write([]byte(`{"timestamp":"2024-01-02T03:04:05Z","level":"ERR","msg":"oops","error":"broken"}` + "\n"))
+	v := apiGet(t, apiLogsHandler, apiTestContext(&mockCluster{}), httptest.NewRequest("GET", "/api/v1/logs", nil))
+	entries, ok := v.([]interface{})
+	if !ok || len(entries) == 0 {
+		t.Fatalf("expected some log entries, got %v", v)
+	}
+	last := hasKeys(t, "log entry", entries[len(entries)-1],
+		"timestamp", "level", "msg", "component", "node", "image", "error", "raw")
+	if last["msg"] != "oops" || last["error"] != "broken" || last["level"] != "ERR" {
+		t.Errorf("wrong log entry: %v", last)
+	}
+}
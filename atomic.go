@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// writeAtomic streams r to a temp file in the same directory as
+// path and renames it into place, so readers only ever see a
+// complete file and a crash never leaves a partial one behind.
+// It returns the number of bytes written.
+func writeAtomic(path string, r io.Reader, perm os.FileMode) (int64, error) {
+	dir := filepath.Dir(path)
+	tmpFile, err := os.CreateTemp(dir, filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	tmpName := tmpFile.Name()
+	n, err := io.Copy(tmpFile, r)
+	if err != nil {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpName)
+		return n, err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpName)
+		return n, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		_ = os.Remove(tmpName)
+		return n, err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		_ = os.Remove(tmpName)
+		return n, err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		_ = os.Remove(tmpName)
+		return n, err
+	}
+	return n, syncDir(dir)
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	_, err := writeAtomic(path, bytes.NewReader(data), perm)
+	return err
+}
+
+// the rename isn't durable until the directory is synced
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.Close() }()
+	return d.Sync()
+}
+
+// cleanStaleTemps removes any temp files under root that are
+// older than before. Those can only be left over from writes
+// that were interrupted by a crash. Anything newer might belong
+// to a write that is still going on.
+func cleanStaleTemps(root string, before time.Time, sl log.Logger) int {
+	var removed = 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// keep going. whatever it is, it's not our problem here
+			return nil
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".tmp") {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil || !fi.ModTime().Before(before) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			_ = sl.Log("level", "WARN", "msg", "could not remove stale temp file", "path", path, "error", err.Error())
+			return nil
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		_ = sl.Log("level", "WARN", "msg", "error looking for stale temp files", "error", err.Error())
+	}
+	return removed
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/thraxil/resize"
+)
+
+type failingReader struct {
+	r io.Reader
+}
+
+func (f failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func Test_writeAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "full.jpg")
+	if err := os.WriteFile(path, []byte("a much longer original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := writeAtomic(path, strings.NewReader("short"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("expected 5 bytes written, got %d", n)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "short" {
+		t.Errorf("expected the file to be replaced outright, got %q", string(b))
+	}
+
+	// a write that fails partway through leaves the old file alone
+	if _, err := writeAtomic(path, failingReader{strings.NewReader("partial")}, 0644); err == nil {
+		t.Error("expected an error")
+	}
+	if b, _ := os.ReadFile(path); string(b) != "short" {
+		t.Errorf("a failed write shouldn't touch the file, got %q", string(b))
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmps) > 0 {
+		t.Errorf("temp files left behind: %v", tmps)
+	}
+}
+
+func Test_diskBackendWriteFullOverwrite(t *testing.T) {
+	root := t.TempDir() + "/"
+	b := newDiskBackend(root)
+	h, _ := hashFromString("fb682e05b9be61797601e60165825c0b089f755e", "")
+	ri := imageSpecifier{h, resize.MakeSizeSpec("full"), ".jpg"}
+
+	if err := b.WriteFull(ri, io.NopCloser(strings.NewReader("a much longer original"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.WriteFull(ri, io.NopCloser(strings.NewReader("short"))); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(ri.fullSizePath(root)); string(data) != "short" {
+		t.Errorf("expected no trailing garbage, got %q", string(data))
+	}
+}
+
+func Test_cleanStaleTemps(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "fb", "68")
+	_ = os.MkdirAll(sub, 0755)
+	stale := filepath.Join(sub, "full.jpg-123.tmp")
+	fresh := filepath.Join(sub, "full.jpg-456.tmp")
+	image := filepath.Join(sub, "full.jpg")
+	for _, p := range []string{stale, fresh, image} {
+		if err := os.WriteFile(p, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	started := time.Now()
+	old := started.Add(-time.Hour)
+	_ = os.Chtimes(stale, old, old)
+	_ = os.Chtimes(image, old, old)
+	later := started.Add(time.Minute)
+	_ = os.Chtimes(fresh, later, later)
+
+	if n := cleanStaleTemps(root, started, log.NewNopLogger()); n != 1 {
+		t.Errorf("expected one stale temp file to be removed, got %d", n)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("stale temp file should be gone")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Error("a temp file from a write in progress should be left alone")
+	}
+	if _, err := os.Stat(image); err != nil {
+		t.Error("images should be left alone")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// how often to look at how much space is left
+const capacityCheckInterval = 30 * time.Second
+
+// capacityMonitor keeps an eye on free space. Once the disks
+// pass the high-water mark, the node marks itself full, which
+// takes it out of the WriteRing, and it only takes new images
+// again after it has dropped below the low-water mark. The gap
+// between the two keeps it from flapping in and out of the ring.
+type capacityMonitor struct {
+	c  *cluster
+	s  siteConfig
+	sl log.Logger
+
+	// for testing
+	usage func() []diskStatus
+}
+
+func newCapacityMonitor(c *cluster, s siteConfig, sl log.Logger) *capacityMonitor {
+	return &capacityMonitor{c: c, s: s, sl: sl, usage: s.diskStatuses}
+}
+
+// run this as a goroutine
+func (m *capacityMonitor) Run() {
+	for {
+		time.Sleep(capacityCheckInterval)
+		m.check()
+	}
+}
+
+func (m *capacityMonitor) check() {
+	used, free, ok := totalUsage(m.usage())
+	if !ok {
+		return
+	}
+	wasFull := m.c.GetMyself().Full
+	pct := 100 * float64(used) / float64(used+free)
+	full := nextFull(wasFull, pct, m.s.HighWaterMark, m.s.LowWaterMark)
+	if full && !wasFull {
+		_ = m.sl.Log("level", "WARN", "msg", "disks are full, no longer accepting images",
+			"used_percent", pct, "high_water_mark", m.s.HighWaterMark)
+	}
+	if !full && wasFull {
+		_ = m.sl.Log("level", "INFO", "msg", "space freed up, accepting images again",
+			"used_percent", pct, "low_water_mark", m.s.LowWaterMark)
+	}
+	m.c.SetCapacity(used, free, full)
+}
+
+// add up the disks that we can actually write to
+func totalUsage(disks []diskStatus) (uint64, uint64, bool) {
+	var used, free uint64
+	for _, d := range disks {
+		if d.Failed || d.Error != "" {
+			continue
+		}
+		used += d.Used
+		free += d.Free
+	}
+	return used, free, used+free > 0
+}
+
+func nextFull(full bool, usedPercent float64, high, low int) bool {
+	if full {
+		return usedPercent >= float64(low)
+	}
+	return usedPercent >= float64(high)
+}
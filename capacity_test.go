@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func Test_nextFull(t *testing.T) {
+	cases := []struct {
+		full     bool
+		pct      float64
+		expected bool
+	}{
+		{false, 50, false},
+		{false, 92, false},
+		{false, 95, true},
+		{true, 92, true},
+		{true, 90, true},
+		{true, 89.9, false},
+	}
+	for _, c := range cases {
+		if got := nextFull(c.full, c.pct, 95, 90); got != c.expected {
+			t.Errorf("nextFull(%v, %v) = %v, expected %v", c.full, c.pct, got, c.expected)
+		}
+	}
+}
+
+func Test_totalUsage(t *testing.T) {
+	used, free, ok := totalUsage([]diskStatus{
+		{Root: "a", Used: 10, Free: 90},
+		{Root: "b", Used: 30, Free: 70},
+		{Root: "c", Used: 100, Free: 0, Failed: true},
+		{Root: "d", Error: "no such file or directory"},
+	})
+	if !ok || used != 40 || free != 160 {
+		t.Errorf("expected 40 used and 160 free, got %d, %d", used, free)
+	}
+	if _, _, ok := totalUsage(nil); ok {
+		t.Error("no disks means we don't know")
+	}
+}
+
+func Test_capacityMonitor(t *testing.T) {
+	_, c := makeNewClusterData([]nodeData{})
+	s := configData{}.MyConfig()
+	m := newCapacityMonitor(c, s, log.NewNopLogger())
+	var used uint64
+	m.usage = func() []diskStatus {
+		return []diskStatus{{Root: "a", Used: used, Free: 100 - used}}
+	}
+
+	used = 50
+	m.check()
+	myself := c.GetMyself()
+	if myself.Full || myself.BytesUsed != 50 || myself.BytesFree != 50 {
+		t.Errorf("unexpected capacity: %+v", myself)
+	}
+
+	epoch := c.RingEpoch()
+	used = 96
+	m.check()
+	if !c.GetMyself().Full {
+		t.Error("should be full above the high-water mark")
+	}
+	if c.RingEpoch() == epoch {
+		t.Error("filling up should change the ring")
+	}
+	if len(c.WriteableNeighbors()) != 0 {
+		t.Error("a full node shouldn't be writeable")
+	}
+
+	used = 92
+	m.check()
+	if !c.GetMyself().Full {
+		t.Error("should stay full until it drops below the low-water mark")
+	}
+
+	used = 80
+	m.check()
+	if c.GetMyself().Full {
+		t.Error("should take images again below the low-water mark")
+	}
+	if len(c.WriteableNeighbors()) != 1 {
+		t.Error("should be back in the write ring")
+	}
+}
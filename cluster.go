@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"io"
 	"math/rand"
 	"sort"
 	"time"
@@ -20,16 +21,50 @@ type cluster struct {
 	neighbors map[string]nodeData
 	chF       chan func()
 
+	// bumped every time the WriteRing might have changed
+	// (nodes joining, leaving, or changing writeability)
+	epoch int
+
+	// hints we hold for nodes that missed a stash, and where
+	// we hear about nodes that have responded to gossip so
+	// those hints can be replayed
+	hints *hintStore
+	alive chan nodeData
+
 	recentlyVerified []imageRecord
 	recentlyUploaded []imageRecord
 	recentlyStashed  []imageRecord
+
+	// images that nobody had when we last asked, by hash and
+	// then by spec, with when to stop believing it. 0 missTTL
+	// means we always ask.
+	missTTL time.Duration
+	misses  map[string]map[string]time.Time
+
+	// who to tell when images we've served change, and about
+	// corruption and repairs. may be nil
+	purge  *purgeNotifier
+	events *eventNotifier
+
+	// where to tell the dashboard what's going on. may be nil
+	activity *activityFeed
+	// may be nil
+	metrics *metrics
+	// resized images we're keeping track of. may be nil
+	derivatives *derivativeCache
 }
 
+// most misses to remember, so that someone asking for lots of
+// random hashes can't use up all our memory
+const maxMisses = 10000
+
 func newCluster(myself nodeData) *cluster {
 	c := &cluster{
 		Myself:    myself,
 		neighbors: make(map[string]nodeData),
+		misses:    make(map[string]map[string]time.Time),
 		chF:       make(chan func()),
+		alive:     make(chan nodeData, 16),
 	}
 	go c.backend()
 	return c
@@ -50,26 +85,31 @@ func (c *cluster) verified(ir imageRecord) {
 			rv = rv[1:]
 		}
 		c.recentlyVerified = rv
+		c.activity.Publish(imageActivity("verified", ir))
 	}
 }
 
 func (c *cluster) Uploaded(ir imageRecord) {
 	c.chF <- func() {
+		delete(c.misses, ir.Hash.String())
 		rv := append(c.recentlyUploaded, ir)
 		if len(rv) > 20 {
 			rv = rv[1:]
 		}
 		c.recentlyUploaded = rv
+		c.activity.Publish(imageActivity("uploaded", ir))
 	}
 }
 
 func (c *cluster) Stashed(ir imageRecord) {
 	c.chF <- func() {
+		delete(c.misses, ir.Hash.String())
 		rv := append(c.recentlyStashed, ir)
 		if len(rv) > 20 {
 			rv = rv[1:]
 		}
 		c.recentlyStashed = rv
+		c.activity.Publish(imageActivity("stashed", ir))
 	}
 }
 
@@ -84,8 +124,12 @@ func (c *cluster) Sync() {
 func (c *cluster) AddNeighbor(nd nodeData) {
 	c.chF <- func() {
 		c.neighbors[nd.UUID] = nd
+		c.epoch++
+		// it might have anything
+		c.misses = make(map[string]map[string]time.Time)
+		c.activity.Publish(nodeActivity("neighbor.joined", nd))
+		c.metrics.Neighbors(len(c.neighbors))
 	}
-	numNeighbors.Add(1)
 }
 
 type gnresp struct {
@@ -112,8 +156,10 @@ func (c *cluster) GetNeighbors() []nodeData {
 func (c *cluster) RemoveNeighbor(nd nodeData) {
 	c.chF <- func() {
 		delete(c.neighbors, nd.UUID)
+		c.epoch++
+		c.activity.Publish(nodeActivity("neighbor.left", nd))
+		c.metrics.Neighbors(len(c.neighbors))
 	}
-	numNeighbors.Add(-1)
 }
 
 type fResp struct {
@@ -121,7 +167,7 @@ type fResp struct {
 	Err bool
 }
 
-func (c cluster) FindNeighborByUUID(uuid string) (*nodeData, bool) {
+func (c *cluster) FindNeighborByUUID(uuid string) (*nodeData, bool) {
 	r := make(chan fResp)
 	go func() {
 		c.chF <- func() {
@@ -136,10 +182,23 @@ func (c cluster) FindNeighborByUUID(uuid string) (*nodeData, bool) {
 func (c *cluster) UpdateNeighbor(neighbor nodeData) {
 	c.chF <- func() {
 		if n, ok := c.neighbors[neighbor.UUID]; ok {
+			if n.Writeable != neighbor.Writeable || n.Draining != neighbor.Draining || n.Full != neighbor.Full {
+				c.epoch++
+				c.activity.Publish(nodeActivity("neighbor.changed", neighbor))
+			}
+			if neighbor.Writeable && !n.Writeable {
+				// back after being down, maybe with images that
+				// we gave up looking for
+				c.misses = make(map[string]map[string]time.Time)
+			}
 			n.Nickname = neighbor.Nickname
 			n.Location = neighbor.Location
 			n.BaseURL = neighbor.BaseURL
 			n.Writeable = neighbor.Writeable
+			n.Draining = neighbor.Draining
+			n.Full = neighbor.Full
+			n.BytesUsed = neighbor.BytesUsed
+			n.BytesFree = neighbor.BytesFree
 			if neighbor.LastSeen.Sub(n.LastSeen) > 0 {
 				n.LastSeen = neighbor.LastSeen
 			}
@@ -151,10 +210,14 @@ func (c *cluster) UpdateNeighbor(neighbor nodeData) {
 func (c *cluster) FailedNeighbor(neighbor nodeData) {
 	c.chF <- func() {
 		if n, ok := c.neighbors[neighbor.UUID]; ok {
+			if n.Writeable {
+				c.epoch++
+				c.activity.Publish(nodeActivity("neighbor.failed", n))
+			}
 			n.Writeable = false
 			n.LastFailed = time.Now()
 			c.neighbors[neighbor.UUID] = n
-			neighborFailures.Add(1)
+			c.metrics.NeighborFailed()
 		}
 	}
 }
@@ -163,7 +226,7 @@ type listResp struct {
 	Ns []nodeData
 }
 
-func (c cluster) NeighborsInclusive() []nodeData {
+func (c *cluster) NeighborsInclusive() []nodeData {
 	r := make(chan listResp)
 	go func() {
 		c.chF <- func() {
@@ -185,11 +248,13 @@ func (c cluster) NeighborsInclusive() []nodeData {
 	return resp.Ns
 }
 
-func (c cluster) WriteableNeighbors() []nodeData {
+func (c *cluster) WriteableNeighbors() []nodeData {
 	var all = c.NeighborsInclusive()
 	var p []nodeData // == nil
 	for _, i := range all {
-		if i.Writeable {
+		// draining nodes are on their way out and full ones
+		// have no room, so neither should be given anything new
+		if i.Writeable && !i.Draining && !i.Full {
 			p = append(p, i)
 		}
 	}
@@ -207,30 +272,43 @@ func (p ringEntryList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 func (p ringEntryList) Len() int           { return len(p) }
 func (p ringEntryList) Less(i, j int) bool { return p[i].Hash < p[j].Hash }
 
-func (c cluster) Ring() ringEntryList {
+func (c *cluster) Ring() ringEntryList {
 	// TODO: cache the ring so we don't have to regenerate
 	// every time. it only changes when a node joins or leaves
 	return neighborsToRing(c.NeighborsInclusive())
 }
 
-func (c cluster) WriteRing() ringEntryList {
+func (c *cluster) WriteRing() ringEntryList {
 	return neighborsToRing(c.WriteableNeighbors())
 }
 
 func (c *cluster) Stash(ctx context.Context, ri imageSpecifier, sizeHints string, replication int, minReplication int, backend Backend) []string {
 	// we don't have the full-size, so check the cluster
+	myself := c.GetMyself()
 	nodesToCheck := c.WriteOrder(ri.Hash.String())
 	savedTo := make([]string, replication)
 	var saveCount = 0
+	// owners (the first replication nodes) that couldn't take
+	// their copy. whoever ends up with it instead holds a hint
+	// so it can be handed off when they come back.
+	var missedOwners []string
 	// TODO: parallelize this
-	for _, n := range nodesToCheck {
+	for i, n := range nodesToCheck {
+		var hintFor string
+		if i >= replication && len(missedOwners) > 0 {
+			hintFor = missedOwners[0]
+		}
 		// detect when the node to stash to is the current one
 		// and just save directly instead of doing a POST to ourself
-		if n.UUID == c.Myself.UUID {
+		if n.UUID == myself.UUID {
 			savedTo[saveCount] = n.Nickname
 			saveCount++
 			n.LastSeen = time.Now()
 			c.UpdateNeighbor(n)
+			if hintFor != "" {
+				_ = c.hints.Add(hintFor, ri)
+				missedOwners = missedOwners[1:]
+			}
 			if saveCount >= replication {
 				break
 			}
@@ -241,13 +319,25 @@ func (c *cluster) Stash(ctx context.Context, ri imageSpecifier, sizeHints string
 			// only have the first node on the list eagerly resize images
 			sizeHints = ""
 		}
-		if n.Stash(ctx, ri, sizeHints, backend) {
+		t0 := time.Now()
+		err := n.stash(ctx, ri, sizeHints, hintFor, backend)
+		c.metrics.Peer("stash", n, err == nil, time.Since(t0))
+		if err == nil {
 			savedTo[saveCount] = n.Nickname
 			saveCount++
 			n.LastSeen = time.Now()
 			c.UpdateNeighbor(n)
+			if hintFor != "" {
+				missedOwners = missedOwners[1:]
+			}
 		} else {
-			c.FailedNeighbor(n)
+			if !errors.Is(err, errStashCorrupted) {
+				// a bad transfer doesn't mean the node is bad
+				c.FailedNeighbor(n)
+			}
+			if i < replication && n.UUID != "" {
+				missedOwners = append(missedOwners, n.UUID)
+			}
 		}
 		// TODO: if we've hit minReplication, we can return
 		// immediately and leave any additional stash attempts
@@ -276,13 +366,13 @@ func neighborsToRing(neighbors []nodeData) ringEntryList {
 
 // returns the list of all nodes in the order
 // that the given hash will choose to write to them
-func (c cluster) WriteOrder(hash string) []nodeData {
+func (c *cluster) WriteOrder(hash string) []nodeData {
 	return hashOrder(hash, len(c.GetNeighbors())+1, c.WriteRing())
 }
 
 // returns the list of all nodes in the order
 // that the given hash will choose to try to read from them
-func (c cluster) ReadOrder(hash string) []nodeData {
+func (c *cluster) ReadOrder(hash string) []nodeData {
 	return hashOrder(hash, len(c.GetNeighbors())+1, c.Ring())
 }
 
@@ -330,8 +420,9 @@ func (c *cluster) Gossip(i, baseTime int, sl log.Logger) {
 
 	for {
 		// run forever
+		myself := c.GetMyself()
 		for _, n := range c.GetNeighbors() {
-			if n.UUID == c.Myself.UUID {
+			if n.UUID == myself.UUID {
 				// don't ping ourself
 				continue
 			}
@@ -345,13 +436,15 @@ func (c *cluster) Gossip(i, baseTime int, sl log.Logger) {
 			firstRun = false
 			_ = sl.Log("level", "INFO",
 				"action", "ping",
-				"source", c.Myself.Nickname,
+				"source", myself.Nickname,
 				"destination", n.Nickname)
-			resp, err := n.Ping(c.Myself, sl)
+			t0 := time.Now()
+			resp, err := n.Ping(c.GetMyself(), sl)
+			c.metrics.Gossip(n, err == nil, time.Since(t0))
 			if err != nil {
 				_ = sl.Log("level", "INFO",
 					"msg", "ping error",
-					"source", c.Myself.Nickname,
+					"source", myself.Nickname,
 					"destination", n.Nickname,
 					"error", err.Error())
 				c.FailedNeighbor(n)
@@ -359,10 +452,15 @@ func (c *cluster) Gossip(i, baseTime int, sl log.Logger) {
 			}
 			// UUID and BaseURL must be the same
 			n.Writeable = resp.Writeable
+			n.Draining = resp.Draining
+			n.Full = resp.Full
+			n.BytesUsed = resp.BytesUsed
+			n.BytesFree = resp.BytesFree
 			n.Nickname = resp.Nickname
 			n.Location = resp.Location
 			n.LastSeen = time.Now()
 			c.UpdateNeighbor(n)
+			c.markAlive(n)
 			for _, neighbor := range resp.Neighbors {
 				c.updateNeighbor(neighbor, sl)
 			}
@@ -370,8 +468,17 @@ func (c *cluster) Gossip(i, baseTime int, sl log.Logger) {
 	}
 }
 
+// let anyone waiting on it know that we just heard from n.
+// if nobody is keeping up, we'll catch them next time around.
+func (c *cluster) markAlive(n nodeData) {
+	select {
+	case c.alive <- n:
+	default:
+	}
+}
+
 func (c *cluster) updateNeighbor(neighbor nodeData, sl log.Logger) {
-	if neighbor.UUID == c.Myself.UUID {
+	if neighbor.UUID == c.GetMyself().UUID {
 		// as usual, skip ourself
 		return
 	}
@@ -386,32 +493,177 @@ func (c *cluster) updateNeighbor(neighbor nodeData, sl log.Logger) {
 	}
 }
 
-func (c *cluster) RetrieveImage(ctx context.Context, ri *imageSpecifier) ([]byte, error) {
+// RetrieveImage finds a node that has the image and returns its
+// response body. The caller must close it.
+func (c *cluster) RetrieveImage(ctx context.Context, ri *imageSpecifier) (io.ReadCloser, error) {
+	if c.recentMiss(ri) {
+		c.metrics.MissCacheHit()
+		return nil, errNotInCluster
+	}
 	// we don't have the full-size, so check the cluster
+	myself := c.GetMyself()
 	nodesToCheck := c.ReadOrder(ri.Hash.String())
+	// only if every node told us it didn't have it do we
+	// remember that. a node being down doesn't count.
+	var allMissed = true
 	// this is where we go down the list and ask the other
 	// nodes for the image
 	// TODO: parallelize this
 	for _, n := range nodesToCheck {
-		if n.UUID == c.Myself.UUID {
+		if n.UUID == myself.UUID {
 			// checking ourself would be silly
 			continue
 		}
 		if n.UUID == "" || n.Nickname == "" {
 			continue
 		}
+		t0 := time.Now()
 		img, err := n.RetrieveImage(ctx, ri)
+		c.metrics.Peer("retrieve", n, err == nil, time.Since(t0))
 		if err == nil {
 			// got it, return it
 			return img, nil
 		}
+		if !errors.Is(err, errNotOnNode) {
+			allMissed = false
+		}
 		// that node didn't have it so we keep going
 	}
-	return nil, errors.New("not found in the cluster")
+	if allMissed && ctx.Err() == nil {
+		c.rememberMiss(ri)
+	}
+	return nil, errNotInCluster
+}
+
+var errNotInCluster = errors.New("not found in the cluster")
+
+// HeadImage asks around for what the nodes that have the image
+// know about it
+func (c *cluster) HeadImage(ctx context.Context, ri *imageSpecifier) (imageHead, error) {
+	if c.recentMiss(ri) {
+		c.metrics.MissCacheHit()
+		return imageHead{}, errNotInCluster
+	}
+	myself := c.GetMyself()
+	for _, n := range c.ReadOrder(ri.Hash.String()) {
+		if n.UUID == myself.UUID || n.UUID == "" || n.Nickname == "" {
+			continue
+		}
+		if head, err := n.HeadImage(ctx, ri); err == nil {
+			return head, nil
+		}
+	}
+	return imageHead{}, errNotInCluster
+}
+
+func (c *cluster) recentMiss(ri *imageSpecifier) bool {
+	r := make(chan bool)
+	go func() {
+		c.chF <- func() {
+			expires, ok := c.misses[ri.Hash.String()][ri.String()]
+			r <- ok && time.Now().Before(expires)
+		}
+	}()
+	return <-r
+}
+
+func (c *cluster) rememberMiss(ri *imageSpecifier) {
+	r := make(chan struct{})
+	c.chF <- func() {
+		defer func() { r <- struct{}{} }()
+		if c.missTTL <= 0 {
+			return
+		}
+		now := time.Now()
+		if len(c.misses) >= maxMisses {
+			for h, specs := range c.misses {
+				for spec, expires := range specs {
+					if now.After(expires) {
+						delete(specs, spec)
+					}
+				}
+				if len(specs) == 0 {
+					delete(c.misses, h)
+				}
+			}
+			if len(c.misses) >= maxMisses {
+				return
+			}
+		}
+		h := ri.Hash.String()
+		if c.misses[h] == nil {
+			c.misses[h] = make(map[string]time.Time)
+		}
+		c.misses[h][ri.String()] = now.Add(c.missTTL)
+	}
+	<-r
+}
+
+// Found forgets any misses for images that we've just heard another
+// node has
+func (c *cluster) Found(hashes ...string) {
+	if len(hashes) == 0 {
+		return
+	}
+	c.chF <- func() {
+		for _, h := range hashes {
+			delete(c.misses, h)
+		}
+	}
 }
 
 func (c *cluster) GetMyself() nodeData {
-	return c.Myself
+	r := make(chan nodeData)
+	go func() {
+		c.chF <- func() {
+			r <- c.Myself
+		}
+	}()
+	return <-r
+}
+
+// SetDraining marks this node as draining (or not). It gets
+// picked up by other nodes on their next gossip round.
+func (c *cluster) SetDraining(draining bool) {
+	r := make(chan struct{})
+	c.chF <- func() {
+		if c.Myself.Draining != draining {
+			c.epoch++
+		}
+		c.Myself.Draining = draining
+		r <- struct{}{}
+	}
+	<-r
+}
+
+// SetCapacity records how much space this node has left and
+// whether that is too little to take any more images. Like
+// draining, it gets picked up on the next gossip round.
+func (c *cluster) SetCapacity(used, free uint64, full bool) {
+	r := make(chan struct{})
+	c.chF <- func() {
+		if c.Myself.Full != full {
+			c.epoch++
+		}
+		c.Myself.Full = full
+		c.Myself.BytesUsed = used
+		c.Myself.BytesFree = free
+		r <- struct{}{}
+	}
+	<-r
+}
+
+// RingEpoch returns a counter that changes whenever the
+// membership or writeability of the cluster does. If it
+// hasn't changed, the WriteRing hasn't either.
+func (c *cluster) RingEpoch() int {
+	r := make(chan int)
+	go func() {
+		c.chF <- func() {
+			r <- c.epoch
+		}
+	}()
+	return <-r
 }
 
 func (c *cluster) GetRecentlyVerified() []imageRecord {
@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"io"
 
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/thraxil/resize"
@@ -417,8 +421,13 @@ func TestClusterRetrieveImage(t *testing.T) {
 				if err != nil {
 					t.Fatal(err)
 				}
-				if string(img) != "image data" {
-					t.Errorf("Expected image data to be 'image data', but got '%s'", string(img))
+				defer func() { _ = img.Close() }()
+				data, err := io.ReadAll(img)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != "image data" {
+					t.Errorf("Expected image data to be 'image data', but got '%s'", string(data))
 				}
 			} else {
 				if err == nil {
@@ -467,3 +476,98 @@ func TestClusterUpdateNeighbor(t *testing.T) {
 		t.Fatal("Expected 1 neighbor, got", len(neighbors))
 	}
 }
+
+func TestClusterRetrieveImageNegativeCache(t *testing.T) {
+	var status = http.StatusNotFound
+	var requests = 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	h, _ := hashFromString("fb682e05b9be61797601e60165825c0b089f755e", "")
+	ri := &imageSpecifier{h, resize.MakeSizeSpec("full"), ".jpg"}
+	_, c := makeNewClusterData([]nodeData{})
+	c.AddNeighbor(nodeData{Nickname: "neighbor1", UUID: "neighbor1-uuid", BaseURL: server.URL, Writeable: true})
+	c.missTTL = time.Minute
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.RetrieveImage(context.Background(), ri); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	if requests != 1 {
+		t.Errorf("a miss should be remembered, but asked %d times", requests)
+	}
+
+	// hearing about the image means it might be out there now
+	c.Stashed(imageRecord{*h, ".jpg"})
+	if _, err := c.RetrieveImage(context.Background(), ri); err == nil {
+		t.Fatal("expected an error")
+	}
+	if requests != 2 {
+		t.Errorf("a stash should clear the miss, but asked %d times", requests)
+	}
+
+	// nor does anti-entropy hearing that another node has it
+	_, _ = c.RetrieveImage(context.Background(), ri)
+	c.Found(h.String())
+	_, _ = c.RetrieveImage(context.Background(), ri)
+	if requests != 3 {
+		t.Errorf("finding a replica should clear the miss, but asked %d times", requests)
+	}
+
+	// nor does a node coming back
+	c.FailedNeighbor(nodeData{UUID: "neighbor1-uuid"})
+	c.UpdateNeighbor(nodeData{Nickname: "neighbor1", UUID: "neighbor1-uuid", BaseURL: server.URL, Writeable: true})
+	_, _ = c.RetrieveImage(context.Background(), ri)
+	if requests != 4 {
+		t.Errorf("a node coming back should clear the misses, but asked %d times", requests)
+	}
+
+	// a node that's having trouble might have it, so that
+	// isn't a miss
+	c.Uploaded(imageRecord{*h, ".jpg"})
+	status = http.StatusInternalServerError
+	for i := 0; i < 2; i++ {
+		_, _ = c.RetrieveImage(context.Background(), ri)
+	}
+	if requests != 6 {
+		t.Errorf("errors shouldn't be remembered, but asked %d times", requests)
+	}
+}
+
+func TestClusterStashCorruptedTransfer(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		http.Error(w, "digest mismatch", http.StatusUnprocessableEntity)
+	}))
+	defer server.Close()
+
+	tmpfile := filepath.Join(t.TempDir(), "full.jpg")
+	if err := os.WriteFile(tmpfile, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := mockBackend{fullPathFunc: func(ri imageSpecifier) string { return tmpfile }}
+	h, _ := hashFromString("fb682e05b9be61797601e60165825c0b089f755e", "")
+	ri := imageSpecifier{h, resize.MakeSizeSpec("full"), ".jpg"}
+
+	_, c := makeNewClusterData([]nodeData{})
+	c.Myself.Writeable = false
+	c.AddNeighbor(nodeData{Nickname: "neighbor1", UUID: "neighbor1-uuid", BaseURL: server.URL, Writeable: true})
+	epoch := c.RingEpoch()
+
+	savedTo := c.Stash(context.Background(), ri, "", 1, 1, b)
+	if savedTo[0] != "" {
+		t.Errorf("nothing should have been saved: %v", savedTo)
+	}
+	if got := atomic.LoadInt32(&attempts); got != stashTransferRetries+1 {
+		t.Errorf("expected the transfer to be retried, got %d attempts", got)
+	}
+	n, _ := c.FindNeighborByUUID("neighbor1-uuid")
+	if !n.Writeable || !n.LastFailed.IsZero() || c.RingEpoch() != epoch {
+		t.Errorf("a corrupted transfer shouldn't count against the node: %+v", n)
+	}
+}
@@ -1,5 +1,9 @@
 package main
 
+import (
+	"path/filepath"
+)
+
 // the structure of the config.json file
 // where config info is stored
 type configData struct {
@@ -19,6 +23,77 @@ type configData struct {
 	GossiperSleep    int
 	VerifierSleep    int
 	GoMaxProcs       int
+
+	// how often (in seconds) to check whether the ring has changed
+	RebalanceInterval int
+	// bytes per second to spend moving images around after a
+	// ring change. 0 means no limit.
+	RebalanceBandwidth int64
+
+	// where to remember cluster membership between restarts.
+	// defaults to a file in the UploadDirectory
+	StateFile string
+	// the index of locally stored images.
+	// defaults to a file in the UploadDirectory
+	IndexFile string
+	// how often (in seconds) to compare notes with the
+	// other owners of our images
+	AntiEntropySleep int
+	// how often (in seconds) to update the cluster-wide image
+	// placement report
+	PlacementInterval int
+	// where to keep hints for nodes that missed a stash.
+	// defaults to a file in the UploadDirectory
+	HintsFile string
+	// separate disks to spread images across. If set, images
+	// go here instead of the UploadDirectory, which is then
+	// only used for the node's own files (state, index, hints)
+	Disks []string
+	// percent of disk used at which we stop accepting stashes,
+	// and the percent we have to get back under before we
+	// start again
+	HighWaterMark int
+	LowWaterMark  int
+	// how many bytes of resized images to keep. once over, the
+	// least recently used ones are removed. 0 means no limit
+	DerivativeCacheBytes int64
+	// bytes of memory to use for keeping popular images around.
+	// 0 turns it off. If shared, each node only keeps the images
+	// it owns, and the others get them from there.
+	GroupCacheSize   int64
+	GroupCacheShared bool
+	// bytes of disk to use for keeping copies of what a read-only
+	// node fetches from the rest of the cluster. 0 turns it off.
+	// defaults to a directory in the UploadDirectory
+	EdgeCacheBytes     int64
+	EdgeCacheDirectory string
+	// how long (in seconds) to remember that nobody in the
+	// cluster has an image before asking around again. defaults
+	// to 30, and 0 turns it off
+	MissCacheTTL *int
+	// Cache-Control for images, and for errors and redirects
+	// when serving them. SurrogateKeys tags each image with its
+	// hash so that a CDN can purge every size and filename of it
+	// at once. It's on unless set to false.
+	CacheControl      string
+	ShortCacheControl string
+	SurrogateKeys     *bool
+	// where to POST the URLs of images that have been repaired
+	// or removed, so that a CDN can purge them. PurgeBaseURL is
+	// the URL that images are served at through the CDN, and
+	// defaults to BaseUrl. PurgeQueueSize is how many purges to
+	// hold while the webhook is slow or down.
+	PurgeWebhookURL string
+	PurgeBaseURL    string
+	PurgeQueueSize  int
+	// webhooks to tell about uploads, replication, corruption
+	// and repairs. events that haven't been delivered yet are
+	// kept in the outbox, which defaults to a file in the
+	// UploadDirectory. WebhookOutboxSize is how many deliveries
+	// it can hold before new events get dropped.
+	Webhooks          []webhookConfig
+	WebhookOutboxFile string
+	WebhookOutboxSize int
 }
 
 func (c configData) MyNode() nodeData {
@@ -63,11 +138,90 @@ func (c configData) MyConfig() siteConfig {
 		verifierSleep = 300
 	}
 
+	rebalanceInterval := c.RebalanceInterval
+	if rebalanceInterval < 1 {
+		rebalanceInterval = 60
+	}
+
+	antiEntropySleep := c.AntiEntropySleep
+	if antiEntropySleep < 1 {
+		antiEntropySleep = 600
+	}
+
+	placementInterval := c.PlacementInterval
+	if placementInterval < 1 {
+		placementInterval = 300
+	}
+
 	goMaxProcs := c.GoMaxProcs
 	if goMaxProcs < 1 {
 		goMaxProcs = 1
 	}
 
+	stateFile := c.StateFile
+	if stateFile == "" && c.UploadDirectory != "" {
+		stateFile = filepath.Join(c.UploadDirectory, "cluster-state.json")
+	}
+
+	indexFile := c.IndexFile
+	if indexFile == "" && c.UploadDirectory != "" {
+		indexFile = filepath.Join(c.UploadDirectory, "index.journal")
+	}
+
+	hintsFile := c.HintsFile
+	if hintsFile == "" && c.UploadDirectory != "" {
+		hintsFile = filepath.Join(c.UploadDirectory, "hints.json")
+	}
+
+	highWaterMark := c.HighWaterMark
+	if highWaterMark < 1 || highWaterMark > 100 {
+		highWaterMark = 95
+	}
+	lowWaterMark := c.LowWaterMark
+	if lowWaterMark < 1 || lowWaterMark >= highWaterMark {
+		lowWaterMark = highWaterMark - 5
+	}
+
+	missCacheTTL := 30
+	if c.MissCacheTTL != nil {
+		missCacheTTL = max(*c.MissCacheTTL, 0)
+	}
+
+	surrogateKeys := c.SurrogateKeys == nil || *c.SurrogateKeys
+
+	cacheControl := c.CacheControl
+	if cacheControl == "" {
+		cacheControl = "public, max-age=31536000, immutable"
+	}
+	shortCacheControl := c.ShortCacheControl
+	if shortCacheControl == "" {
+		shortCacheControl = "public, max-age=60"
+	}
+
+	edgeCacheDirectory := c.EdgeCacheDirectory
+	if edgeCacheDirectory == "" && c.UploadDirectory != "" {
+		edgeCacheDirectory = filepath.Join(c.UploadDirectory, "edge-cache")
+	}
+
+	webhookOutboxFile := c.WebhookOutboxFile
+	if webhookOutboxFile == "" && c.UploadDirectory != "" {
+		webhookOutboxFile = filepath.Join(c.UploadDirectory, "webhook-outbox.json")
+	}
+
+	purgeBaseURL := c.PurgeBaseURL
+	if purgeBaseURL == "" {
+		purgeBaseURL = c.BaseURL
+	}
+	webhookOutboxSize := c.WebhookOutboxSize
+	if webhookOutboxSize < 1 {
+		webhookOutboxSize = defaultWebhookOutboxSize
+	}
+
+	purgeQueueSize := c.PurgeQueueSize
+	if purgeQueueSize < 1 {
+		purgeQueueSize = defaultPurgeQueueSize
+	}
+
 	b := newDiskBackend(c.UploadDirectory)
 
 	return siteConfig{
@@ -83,6 +237,33 @@ func (c configData) MyConfig() siteConfig {
 		GoMaxProcs:       goMaxProcs,
 		Writeable:        c.Writeable,
 		Backend:          b,
+
+		RebalanceInterval:  rebalanceInterval,
+		RebalanceBandwidth: c.RebalanceBandwidth,
+		StateFile:          stateFile,
+		IndexFile:          indexFile,
+		AntiEntropySleep:   antiEntropySleep,
+		PlacementInterval:  placementInterval,
+		HintsFile:          hintsFile,
+		Disks:              c.Disks,
+		HighWaterMark:      highWaterMark,
+		LowWaterMark:       lowWaterMark,
+
+		DerivativeCacheBytes: c.DerivativeCacheBytes,
+		GroupCacheSize:       c.GroupCacheSize,
+		GroupCacheShared:     c.GroupCacheShared,
+		EdgeCacheBytes:       c.EdgeCacheBytes,
+		EdgeCacheDirectory:   edgeCacheDirectory,
+		MissCacheTTL:         missCacheTTL,
+		CacheControl:         cacheControl,
+		ShortCacheControl:    shortCacheControl,
+		SurrogateKeys:        surrogateKeys,
+		PurgeWebhookURL:      c.PurgeWebhookURL,
+		PurgeBaseURL:         purgeBaseURL,
+		PurgeQueueSize:       purgeQueueSize,
+		Webhooks:             c.Webhooks,
+		WebhookOutboxFile:    webhookOutboxFile,
+		WebhookOutboxSize:    webhookOutboxSize,
 	}
 }
 
@@ -101,6 +282,72 @@ type siteConfig struct {
 	GoMaxProcs       int
 	Writeable        bool
 	Backend          Backend
+
+	RebalanceInterval  int
+	RebalanceBandwidth int64
+	StateFile          string
+	IndexFile          string
+	Index              *imageIndex
+	AntiEntropySleep   int
+	PlacementInterval  int
+	HintsFile          string
+	Hints              *hintStore
+	Disks              []string
+	HighWaterMark      int
+	LowWaterMark       int
+
+	DerivativeCacheBytes int64
+	Derivatives          *derivativeCache
+	GroupCacheSize       int64
+	GroupCacheShared     bool
+	ImageCache           *imageCache
+	EdgeCacheBytes       int64
+	EdgeCacheDirectory   string
+	EdgeCache            *edgeCache
+	MissCacheTTL         int
+	CacheControl         string
+	ShortCacheControl    string
+	SurrogateKeys        bool
+	PurgeWebhookURL      string
+	PurgeBaseURL         string
+	PurgeQueueSize       int
+	Purge                *purgeNotifier
+	Webhooks             []webhookConfig
+	WebhookOutboxFile    string
+	WebhookOutboxSize    int
+	Events               *eventNotifier
+	Activity             *activityFeed
+	Metrics              *metrics
+}
+
+// the directories that images are stored under
+func (s siteConfig) imageRoots() []string {
+	if j, ok := s.Backend.(*jbodBackend); ok {
+		return j.Roots()
+	}
+	return []string{s.UploadDirectory}
+}
+
+// walkFullSize over every image root
+func (s siteConfig) walkFullSize(fn func(ri imageSpecifier, path string) error) error {
+	var firstErr error
+	for _, root := range s.imageRoots() {
+		if err := walkFullSize(root, fn); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// how full each of our disks is
+func (s siteConfig) diskStatuses() []diskStatus {
+	if j, ok := s.Backend.(*jbodBackend); ok {
+		return j.Usage()
+	}
+	if s.UploadDirectory == "" {
+		return nil
+	}
+	return []diskStatus{newDiskStatus(s.UploadDirectory, false)}
 }
 
 func (s siteConfig) KeyRequired() bool {
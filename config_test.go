@@ -42,3 +42,35 @@ func Test_ValidKey(t *testing.T) {
 		t.Error("key does exist now")
 	}
 }
+
+func Test_MyConfigCacheControl(t *testing.T) {
+	s := configData{}.MyConfig()
+	if s.CacheControl != "public, max-age=31536000, immutable" {
+		t.Errorf("unexpected default Cache-Control: %s", s.CacheControl)
+	}
+	if s.ShortCacheControl == "" || !s.SurrogateKeys {
+		t.Error("errors should get a short TTL, and surrogate keys are on by default")
+	}
+	off := false
+	if s := (configData{SurrogateKeys: &off}).MyConfig(); s.SurrogateKeys {
+		t.Error("surrogate keys should be able to be turned off")
+	}
+	s = configData{CacheControl: "public, max-age=3600"}.MyConfig()
+	if s.CacheControl != "public, max-age=3600" {
+		t.Errorf("Cache-Control wasn't configurable: %s", s.CacheControl)
+	}
+}
+
+func Test_MyConfigMissCacheTTL(t *testing.T) {
+	if s := (configData{}).MyConfig(); s.MissCacheTTL != 30 {
+		t.Errorf("expected the default of 30, got %d", s.MissCacheTTL)
+	}
+	off := 0
+	if s := (configData{MissCacheTTL: &off}).MyConfig(); s.MissCacheTTL != 0 {
+		t.Errorf("0 should turn it off, got %d", s.MissCacheTTL)
+	}
+	ttl := 5
+	if s := (configData{MissCacheTTL: &ttl}).MyConfig(); s.MissCacheTTL != 5 {
+		t.Errorf("expected 5, got %d", s.MissCacheTTL)
+	}
+}
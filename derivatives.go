@@ -0,0 +1,215 @@
+package main
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// how often to check whether resized images are over budget
+const derivativeSweepInterval = time.Minute
+
+type derivative struct {
+	path  string
+	bytes int64
+}
+
+// derivativeCache keeps the resized versions of images within
+// a budget. Full-size images are never in here, so they are
+// never evicted; a sized image can always be made again from
+// the full-size one.
+//
+// Files are kept in least recently used order, with the most
+// recently served or written at the front. We don't try to
+// remember that order across restarts; when we start up, we
+// fall back to modification times.
+//
+// All the methods are safe to call on a nil *derivativeCache,
+// which keeps everything forever.
+type derivativeCache struct {
+	budget  int64
+	index   *imageIndex
+	sl      log.Logger
+	metrics *metrics
+
+	mu    sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+	bytes int64
+}
+
+func newDerivativeCache(budget int64, index *imageIndex, sl log.Logger) *derivativeCache {
+	return &derivativeCache{
+		budget: budget,
+		index:  index,
+		sl:     sl,
+		lru:    list.New(),
+		items:  make(map[string]*list.Element),
+	}
+}
+
+// Touch marks the resized image at path as just used
+func (d *derivativeCache) Touch(path string, bytes int64) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.items[path]; ok {
+		item := e.Value.(*derivative)
+		d.bytes += bytes - item.bytes
+		item.bytes = bytes
+		d.lru.MoveToFront(e)
+	} else {
+		d.items[path] = d.lru.PushFront(&derivative{path, bytes})
+		d.bytes += bytes
+	}
+	d.metrics.CacheBytes(derivativeCacheName, d.bytes)
+}
+
+// Forget stops tracking a resized image that has been deleted some
+// other way (a repair, say, or a rebalance taking the whole image
+// away), so that it stops counting against the budget
+func (d *derivativeCache) Forget(path string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.items[path]
+	if !ok {
+		return
+	}
+	d.lru.Remove(e)
+	delete(d.items, path)
+	d.bytes -= e.Value.(*derivative).bytes
+	d.metrics.CacheBytes(derivativeCacheName, d.bytes)
+}
+
+// Bytes is how much space the resized images are taking up
+func (d *derivativeCache) Bytes() int64 {
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.bytes
+}
+
+// Sweep evicts the least recently used resized images until
+// we're back under budget and returns how many it removed.
+func (d *derivativeCache) Sweep() int {
+	if d == nil || d.budget <= 0 {
+		return 0
+	}
+	var evicted = 0
+	for {
+		d.mu.Lock()
+		e := d.lru.Back()
+		if d.bytes <= d.budget || e == nil {
+			d.mu.Unlock()
+			return evicted
+		}
+		item := e.Value.(*derivative)
+		d.lru.Remove(e)
+		delete(d.items, item.path)
+		d.bytes -= item.bytes
+		d.metrics.CacheBytes(derivativeCacheName, d.bytes)
+		d.mu.Unlock()
+
+		err := os.Remove(item.path)
+		if err != nil && !os.IsNotExist(err) {
+			_ = d.sl.Log("level", "WARN", "msg", "could not evict resized image", "path", item.path, "error", err.Error())
+			continue
+		}
+		if h, err := hashFromPath(item.path); err == nil {
+			_ = d.index.RemoveSize(h, derivativeSize(item.path))
+		}
+		if err != nil {
+			// something else deleted it without telling us.
+			// that isn't an eviction
+			continue
+		}
+		d.metrics.CacheEviction(derivativeCacheName)
+		evicted++
+	}
+}
+
+// the size part of a resized image's filename, eg "100s" for
+// .../100s.jpg
+func derivativeSize(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+func isDerivative(path string) bool {
+	base := filepath.Base(path)
+	ext := filepath.Ext(base)
+	if len(ext) < 2 || ext == ".tmp" || basename(path) == "full" {
+		return false
+	}
+	_, err := hashFromPath(path)
+	return err == nil
+}
+
+// Load finds every resized image under the roots and adds
+// any we aren't already tracking, oldest last
+func (d *derivativeCache) Load(roots []string) error {
+	if d == nil {
+		return nil
+	}
+	var found []derivative
+	var mtimes = make(map[string]time.Time)
+	for _, root := range roots {
+		err := filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if f.IsDir() || !isDerivative(path) {
+				return nil
+			}
+			found = append(found, derivative{path, f.Size()})
+			mtimes[path] = f.ModTime()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return mtimes[found[i].path].After(mtimes[found[j].path])
+	})
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := range found {
+		if _, ok := d.items[found[i].path]; ok {
+			// served since we started looking
+			continue
+		}
+		d.items[found[i].path] = d.lru.PushBack(&found[i])
+		d.bytes += found[i].bytes
+	}
+	d.metrics.CacheBytes(derivativeCacheName, d.bytes)
+	return nil
+}
+
+// run this as a goroutine
+func (d *derivativeCache) Run(roots []string) {
+	if err := d.Load(roots); err != nil {
+		_ = d.sl.Log("level", "WARN", "msg", "could not find all resized images", "error", err.Error())
+	}
+	_ = d.sl.Log("level", "INFO", "msg", "tracking resized images", "bytes", d.Bytes(), "budget", d.budget)
+	for {
+		if n := d.Sweep(); n > 0 {
+			_ = d.sl.Log("level", "INFO", "msg", "evicted resized images", "evicted", n, "bytes", d.Bytes())
+		}
+		time.Sleep(derivativeSweepInterval)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thraxil/resize"
+)
+
+// writes a file of n bytes for the image at the given size and
+// returns its path
+func writeDerivative(t *testing.T, root string, ri imageSpecifier, size string, n int) string {
+	t.Helper()
+	ri.Size = resize.MakeSizeSpec(size)
+	path := ri.sizedPath(root)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, make([]byte, n), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_derivativeCacheSweep(t *testing.T) {
+	root := t.TempDir() + "/"
+	idx, err := openImageIndex(filepath.Join(t.TempDir(), "index.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = idx.Close() }()
+	ri := jbodSpec(t, "fb682e05b9be61797601e60165825c0b089f755e")
+	_ = idx.AddFull(ri, 100)
+	full := writeDerivative(t, root, ri, "full", 100)
+
+	d := newDerivativeCache(250, idx, log.NewNopLogger())
+	d.metrics = newMetrics(prometheus.NewRegistry())
+	var paths []string
+	for _, size := range []string{"100s", "200s", "300s"} {
+		p := writeDerivative(t, root, ri, size, 100)
+		_ = idx.AddSize(ri.Hash, size)
+		d.Touch(p, 100)
+		paths = append(paths, p)
+	}
+	// 100s is the oldest, but was just used
+	d.Touch(paths[0], 100)
+
+	if d.Bytes() != 300 {
+		t.Errorf("expected 300 bytes, got %d", d.Bytes())
+	}
+	if n := d.Sweep(); n != 1 {
+		t.Errorf("expected one eviction, got %d", n)
+	}
+	if testutil.ToFloat64(d.metrics.cacheEvictions.WithLabelValues(derivativeCacheName)) != 1 {
+		t.Error("eviction wasn't counted")
+	}
+	if _, err := os.Stat(paths[1]); !os.IsNotExist(err) {
+		t.Error("the least recently used one should be gone")
+	}
+	for _, p := range []string{paths[0], paths[2], full} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("%s should still be there", p)
+		}
+	}
+	e, _ := idx.Get(ri.Hash.String())
+	if e.hasSize("200s") || !e.hasSize("100s") {
+		t.Errorf("index sizes not updated: %v", e.Sizes)
+	}
+	if n := d.Sweep(); n != 0 {
+		t.Errorf("already under budget, but evicted %d", n)
+	}
+}
+
+func Test_derivativeCacheLoad(t *testing.T) {
+	root := t.TempDir() + "/"
+	ri := jbodSpec(t, "fb682e05b9be61797601e60165825c0b089f755e")
+	writeDerivative(t, root, ri, "full", 500)
+	older := writeDerivative(t, root, ri, "100s", 10)
+	newer := writeDerivative(t, root, ri, "200s", 20)
+	old := time.Now().Add(-time.Hour)
+	_ = os.Chtimes(older, old, old)
+	_ = os.WriteFile(filepath.Join(filepath.Dir(older), "300s.jpg-123.tmp"), []byte("x"), 0644)
+
+	d := newDerivativeCache(20, nil, log.NewNopLogger())
+	if err := d.Load([]string{root}); err != nil {
+		t.Fatal(err)
+	}
+	if d.Bytes() != 30 {
+		t.Errorf("should only count resized images, got %d bytes", d.Bytes())
+	}
+	d.Sweep()
+	if _, err := os.Stat(older); !os.IsNotExist(err) {
+		t.Error("the older one should have been evicted")
+	}
+	if _, err := os.Stat(newer); err != nil {
+		t.Error("the newer one should still be there")
+	}
+}
+
+func Test_derivativeCacheNil(t *testing.T) {
+	var d *derivativeCache
+	d.Touch("/tmp/foo.jpg", 10)
+	d.Forget("/tmp/foo.jpg")
+	if d.Sweep() != 0 || d.Bytes() != 0 {
+		t.Error("a nil cache should keep everything")
+	}
+}
+
+func Test_derivativeCacheForget(t *testing.T) {
+	root := t.TempDir() + "/"
+	ri := jbodSpec(t, "fb682e05b9be61797601e60165825c0b089f755e")
+	d := newDerivativeCache(150, nil, log.NewNopLogger())
+	d.metrics = newMetrics(prometheus.NewRegistry())
+	gone := writeDerivative(t, root, ri, "100s", 100)
+	kept := writeDerivative(t, root, ri, "200s", 100)
+	d.Touch(gone, 100)
+	d.Touch(kept, 100)
+
+	// deleted some other way, and we're told about it
+	_ = os.Remove(gone)
+	d.Forget(gone)
+	d.Forget(gone)
+	if d.Bytes() != 100 {
+		t.Errorf("expected 100 bytes, got %d", d.Bytes())
+	}
+	if n := d.Sweep(); n != 0 {
+		t.Errorf("under budget now, but evicted %d", n)
+	}
+
+	// deleted without us being told, which isn't an eviction
+	other := writeDerivative(t, root, ri, "300s", 100)
+	d.Touch(other, 100)
+	_ = os.Remove(kept)
+	if n := d.Sweep(); n != 0 {
+		t.Errorf("a file that was already gone isn't an eviction, got %d", n)
+	}
+	if testutil.ToFloat64(d.metrics.cacheEvictions.WithLabelValues(derivativeCacheName)) != 0 {
+		t.Error("a file that was already gone was counted as an eviction")
+	}
+	if d.Bytes() != 100 {
+		t.Errorf("should have stopped counting the missing one, got %d bytes", d.Bytes())
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Error("the newer one should still be there")
+	}
+}
@@ -4,10 +4,16 @@ import (
 	"io"
 
 	"os"
+	"path/filepath"
+
+	"github.com/thraxil/resize"
 )
 
 type diskBackend struct {
-	Root string
+	Root        string
+	Index       *imageIndex
+	Purge       *purgeNotifier
+	Derivatives *derivativeCache
 }
 
 func newDiskBackend(root string) diskBackend {
@@ -18,60 +24,54 @@ func (d diskBackend) String() string {
 	return "Disk"
 }
 
-func (d diskBackend) WriteSized(img imageSpecifier, r io.ReadCloser) (err error) {
+func (d diskBackend) WriteSized(img imageSpecifier, r io.ReadCloser) error {
 	path := img.baseDir(d.Root)
 
-	err = os.MkdirAll(path, 0755)
-	if err != nil {
-		return err
-	}
-	fullpath := img.sizedPath(d.Root)
-	f, err := os.OpenFile(fullpath, os.O_CREATE|os.O_RDWR, 0644)
+	err := os.MkdirAll(path, 0755)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if closeErr := f.Close(); closeErr != nil && err == nil {
-			err = closeErr
-		}
-	}()
-	_, err = io.Copy(f, r)
-	if err != nil {
+	if _, err := writeAtomic(img.sizedPath(d.Root), r, 0644); err != nil {
 		return err
 	}
-	return f.Sync()
+	return d.Index.AddSize(img.Hash, img.Size.String())
 }
 
-func (d diskBackend) WriteFull(img imageSpecifier, r io.ReadCloser) (err error) {
+func (d diskBackend) WriteFull(img imageSpecifier, r io.ReadCloser) error {
 	path := img.baseDir(d.Root)
 
-	err = os.MkdirAll(path, 0755)
+	err := os.MkdirAll(path, 0755)
 	if err != nil {
 		return err
 	}
-	fullpath := img.fullSizePath(d.Root)
-	f, err := os.OpenFile(fullpath, os.O_CREATE|os.O_RDWR, 0644)
+	n, err := writeAtomic(img.fullSizePath(d.Root), r, 0644)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if closeErr := f.Close(); closeErr != nil && err == nil {
-			err = closeErr
-		}
-	}()
-	_, err = io.Copy(f, r)
-	if err != nil {
-		return err
-	}
-	return f.Sync()
+	return d.Index.AddFull(img, n)
 }
 
-func (d diskBackend) Read(img imageSpecifier) ([]byte, error) {
+// Read opens the image for reading. The caller must close it.
+func (d diskBackend) Read(img imageSpecifier) (io.ReadCloser, error) {
 	path := img.sizedPath(d.Root)
-	return os.ReadFile(path)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// whatever the index said, it isn't here
+		_ = d.Index.Forget(img)
+	}
+	return f, err
 }
 
+// Exists believes the index if it has the image. If it doesn't,
+// that's only the final word once the index is complete; before
+// then, we have to look.
 func (d diskBackend) Exists(img imageSpecifier) bool {
+	if d.Index.Has(img) {
+		return true
+	}
+	if d.Index.Complete() {
+		return false
+	}
 	path := img.sizedPath(d.Root)
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return false
@@ -81,9 +81,45 @@ func (d diskBackend) Exists(img imageSpecifier) bool {
 
 func (d diskBackend) Delete(img imageSpecifier) error {
 	path := img.sizedPath(d.Root)
-	return os.RemoveAll(path)
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	if img.Size.IsFull() {
+		// anything made from it goes too, as far as a CDN
+		// is concerned
+		e, _ := d.Index.Get(img.Hash.String())
+		d.Purge.Image(img.Hash, img.Extension, append([]string{"full"}, e.Sizes...), "deleted")
+		return d.Index.Remove(img.Hash)
+	}
+	d.Derivatives.Forget(path)
+	d.Purge.Image(img.Hash, img.Extension, []string{img.Size.String()}, "deleted")
+	return d.Index.RemoveSize(img.Hash, img.Size.String())
 }
 
 func (d diskBackend) fullPath(ri imageSpecifier) string {
 	return ri.fullSizePath(d.Root)
 }
+
+// calls fn with the spec and path of every full-size image
+// stored under root. Anything that doesn't look like one of
+// ours is skipped.
+func walkFullSize(root string, fn func(ri imageSpecifier, path string) error) error {
+	return filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() || basename(path) != "full" {
+			return nil
+		}
+		extension := filepath.Ext(path)
+		if len(extension) < 2 {
+			return nil
+		}
+		hash, err := hashFromPath(path)
+		if err != nil {
+			return nil
+		}
+		ri := imageSpecifier{hash, resize.MakeSizeSpec("full"), extension}
+		return fn(ri, path)
+	})
+}
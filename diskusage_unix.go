@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "syscall"
+
+// total and available bytes on the filesystem holding path
+func diskUsage(path string) (uint64, uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	bsize := uint64(st.Bsize)
+	return uint64(st.Blocks) * bsize, uint64(st.Bavail) * bsize, nil
+}
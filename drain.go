@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// drainProgress is what we report back while a node is draining
+type drainProgress struct {
+	Draining       bool      `json:"draining"`
+	Started        time.Time `json:"started"`
+	Finished       time.Time `json:"finished"`
+	Done           bool      `json:"done"`
+	Images         int       `json:"images"`
+	Pushed         int       `json:"pushed"`
+	Failed         int       `json:"failed"`
+	SafeToShutdown bool      `json:"safe_to_shutdown"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// drainer handles decommissioning a node. Once started, the node
+// is gossiped as draining (which takes it out of everyone's
+// WriteRing) and every image it holds is pushed out to the nodes
+// that now own it.
+type drainer struct {
+	c  *cluster
+	s  siteConfig
+	sl log.Logger
+
+	mu       sync.Mutex
+	progress drainProgress
+}
+
+func newDrainer(c *cluster, s siteConfig, sl log.Logger) *drainer {
+	return &drainer{c: c, s: s, sl: sl}
+}
+
+// Start marks the node as draining and kicks off pushing its
+// images out in the background.
+func (d *drainer) Start() error {
+	d.mu.Lock()
+	if d.progress.Draining {
+		d.mu.Unlock()
+		return errors.New("already draining")
+	}
+	d.progress = drainProgress{Draining: true, Started: time.Now()}
+	d.mu.Unlock()
+
+	d.c.SetDraining(true)
+	_ = d.sl.Log("level", "INFO", "msg", "node is draining")
+	go d.run(context.Background())
+	return nil
+}
+
+func (d *drainer) Progress() drainProgress {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.progress
+}
+
+func (d *drainer) run(ctx context.Context) {
+	err := d.s.walkFullSize(func(ri imageSpecifier, path string) error {
+		pushed := d.push(ctx, ri)
+		d.mu.Lock()
+		d.progress.Images++
+		if pushed {
+			d.progress.Pushed++
+		} else {
+			d.progress.Failed++
+		}
+		p := d.progress
+		d.mu.Unlock()
+
+		if !pushed {
+			_ = d.sl.Log("level", "WARN", "msg", "could not drain image", "image", path)
+		}
+		if p.Images%100 == 0 {
+			_ = d.sl.Log("level", "INFO", "msg", "drain progress",
+				"images", p.Images, "pushed", p.Pushed, "failed", p.Failed)
+		}
+		return nil
+	})
+
+	d.mu.Lock()
+	d.progress.Done = true
+	d.progress.Finished = time.Now()
+	if err != nil {
+		d.progress.Error = err.Error()
+	}
+	d.progress.SafeToShutdown = err == nil && d.progress.Failed == 0
+	p := d.progress
+	d.mu.Unlock()
+
+	if p.SafeToShutdown {
+		_ = d.sl.Log("level", "INFO", "msg", "drain complete. safe to shut down",
+			"images", p.Images)
+	} else {
+		_ = d.sl.Log("level", "ERR", "msg", "drain finished but NOT safe to shut down",
+			"images", p.Images, "failed", p.Failed)
+	}
+}
+
+// stash the image on its new owners. since we are no longer
+// in the WriteRing, WriteOrder won't include us.
+func (d *drainer) push(ctx context.Context, ri imageSpecifier) bool {
+	savedTo := d.c.Stash(ctx, ri, "", d.s.Replication, d.s.MinReplication, d.s.Backend)
+	var saved = 0
+	for _, nickname := range savedTo {
+		if nickname != "" {
+			saved++
+		}
+	}
+	return saved >= d.s.MinReplication
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/thraxil/resize"
+)
+
+func Test_DrainingNodeLeavesWriteRing(t *testing.T) {
+	_, c := makeNewClusterData([]nodeData{})
+	c.AddNeighbor(nodeData{
+		Nickname:  "draining",
+		UUID:      "draining-uuid",
+		BaseURL:   "localhost:8081",
+		Writeable: true,
+		Draining:  true,
+	})
+	if len(c.WriteableNeighbors()) != 1 {
+		t.Error("draining neighbor should not be writeable")
+	}
+	if len(c.Ring()) != 2*REPLICAS {
+		t.Error("draining neighbor should still be readable")
+	}
+
+	c.SetDraining(true)
+	if !c.GetMyself().Draining {
+		t.Error("SetDraining didn't take")
+	}
+	for _, n := range c.WriteOrder("fb682e05b9be61797601e60165825c0b089f755e") {
+		if n.UUID != "" {
+			t.Errorf("nothing should be writeable, got %s", n.Nickname)
+		}
+	}
+}
+
+func Test_UpdateNeighborDraining(t *testing.T) {
+	_, c := makeNewClusterData([]nodeData{})
+	nd := nodeData{Nickname: "neighbor", UUID: "neighbor-uuid", Writeable: true}
+	c.AddNeighbor(nd)
+	nd.Draining = true
+	c.UpdateNeighbor(nd)
+	n, _ := c.FindNeighborByUUID("neighbor-uuid")
+	if !n.Draining {
+		t.Error("draining status wasn't updated")
+	}
+}
+
+func Test_drainer(t *testing.T) {
+	uploadDir := t.TempDir() + "/"
+	h, _ := hashFromString("fb682e05b9be61797601e60165825c0b089f755e", "")
+	ri := imageSpecifier{h, resize.MakeSizeSpec("full"), ".jpg"}
+	_ = os.MkdirAll(ri.baseDir(uploadDir), 0755)
+	if err := os.WriteFile(ri.fullSizePath(uploadDir), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stashes := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stashes <- r.URL.Path
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	_, c := makeNewClusterData([]nodeData{})
+	c.AddNeighbor(nodeData{
+		Nickname:  "neighbor",
+		UUID:      "neighbor-uuid",
+		BaseURL:   server.URL,
+		Writeable: true,
+	})
+	s := siteConfig{
+		UploadDirectory: uploadDir,
+		Replication:     1,
+		MinReplication:  1,
+		Backend:         newDiskBackend(uploadDir),
+	}
+	d := newDrainer(c, s, log.NewNopLogger())
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err == nil {
+		t.Error("should not be able to start draining twice")
+	}
+
+	var p drainProgress
+	for i := 0; i < 100; i++ {
+		p = d.Progress()
+		if p.Done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !p.Done {
+		t.Fatal("drain never finished")
+	}
+	if p.Images != 1 || p.Pushed != 1 || !p.SafeToShutdown {
+		t.Errorf("unexpected progress: %+v", p)
+	}
+	if path := <-stashes; !strings.HasPrefix(path, "/stash/") {
+		t.Errorf("expected a stash, got %s", path)
+	}
+}
+
+func Test_postDrainHandler(t *testing.T) {
+	ctx := makeTestContextWithUploadDir(t.TempDir() + "/")
+	ctx.Cfg.UploadKeys = []string{"secret"}
+
+	form := url.Values{}
+	form.Add("key", "wrong")
+	req, _ := http.NewRequest("POST", "localhost:8080/drain/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	postDrainHandler(rec, req, ctx)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected forbidden; got %v", rec.Code)
+	}
+
+	form.Set("key", "secret")
+	req, _ = http.NewRequest("POST", "localhost:8080/drain/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	postDrainHandler(rec, req, ctx)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected OK; got %v", rec.Code)
+	}
+	if !ctx.cluster.GetMyself().Draining {
+		t.Error("node should be draining")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+type edgeEntry struct {
+	path  string
+	bytes int64
+}
+
+// edgeCache lets a read-only node keep what it fetches from the
+// rest of the cluster, so that a node far away from the others
+// only has to go and get each image once (or at least until it
+// gets pushed out by newer ones).
+//
+// These are copies, not replicas. They live in their own
+// directory, flat, named after the whole image specifier, eg:
+//
+//	<root>/fb/fb682e05b9be61797601e60165825c0b089f755e-100s.jpg
+//
+// That doesn't look anything like where images are stored, so
+// nothing that walks the image roots (the verifier, rebalancer,
+// anti-entropy, index rebuilds) will ever mistake one for a
+// replica, even if the cache is inside the UploadDirectory.
+//
+// All the methods are safe to call on a nil *edgeCache, which
+// never has anything.
+type edgeCache struct {
+	root    string
+	budget  int64
+	sl      log.Logger
+	metrics *metrics
+
+	mu    sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+	bytes int64
+}
+
+func newEdgeCache(root string, budget int64, sl log.Logger) *edgeCache {
+	return &edgeCache{
+		root:   root,
+		budget: budget,
+		sl:     sl,
+		lru:    list.New(),
+		items:  make(map[string]*list.Element),
+	}
+}
+
+func (e *edgeCache) path(ri imageSpecifier) string {
+	h := ri.Hash.String()
+	return filepath.Join(e.root, h[:2], h+"-"+ri.Size.String()+ri.Extension)
+}
+
+// Get opens the cached copy of the image, if we have one. The
+// caller must close it.
+func (e *edgeCache) Get(ri imageSpecifier) (io.ReadCloser, bool) {
+	if e == nil {
+		return nil, false
+	}
+	path := e.path(ri)
+	e.mu.Lock()
+	el, ok := e.items[path]
+	if ok {
+		e.lru.MoveToFront(el)
+	}
+	e.mu.Unlock()
+	if !ok {
+		e.metrics.CacheRequest(edgeCacheName, false)
+		return nil, false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		// someone removed it from under us
+		e.forget(path)
+		e.metrics.CacheRequest(edgeCacheName, false)
+		return nil, false
+	}
+	e.metrics.CacheRequest(edgeCacheName, true)
+	return f, true
+}
+
+// Put stores a copy of the image, and then makes room for it
+func (e *edgeCache) Put(ri imageSpecifier, r io.Reader) error {
+	if e == nil {
+		return nil
+	}
+	path := e.path(ri)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	n, err := writeAtomic(path, r, 0644)
+	if err != nil {
+		return err
+	}
+	e.add(path, n, true)
+	e.evict()
+	return nil
+}
+
+func (e *edgeCache) add(path string, bytes int64, front bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if el, ok := e.items[path]; ok {
+		if !front {
+			// we've already seen it since starting up
+			return
+		}
+		item := el.Value.(*edgeEntry)
+		e.bytes += bytes - item.bytes
+		item.bytes = bytes
+		e.lru.MoveToFront(el)
+	} else if front {
+		e.items[path] = e.lru.PushFront(&edgeEntry{path, bytes})
+		e.bytes += bytes
+	} else {
+		e.items[path] = e.lru.PushBack(&edgeEntry{path, bytes})
+		e.bytes += bytes
+	}
+	e.metrics.CacheBytes(edgeCacheName, e.bytes)
+}
+
+func (e *edgeCache) forget(path string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if el, ok := e.items[path]; ok {
+		e.bytes -= el.Value.(*edgeEntry).bytes
+		e.lru.Remove(el)
+		delete(e.items, path)
+		e.metrics.CacheBytes(edgeCacheName, e.bytes)
+	}
+}
+
+// drop the least recently used copies until we're under budget
+func (e *edgeCache) evict() {
+	for {
+		e.mu.Lock()
+		el := e.lru.Back()
+		if e.bytes <= e.budget || el == nil {
+			e.mu.Unlock()
+			return
+		}
+		item := el.Value.(*edgeEntry)
+		e.lru.Remove(el)
+		delete(e.items, item.path)
+		e.bytes -= item.bytes
+		e.metrics.CacheBytes(edgeCacheName, e.bytes)
+		e.mu.Unlock()
+
+		if err := os.Remove(item.path); err != nil && !os.IsNotExist(err) {
+			_ = e.sl.Log("level", "WARN", "msg", "could not evict cached image", "path", item.path, "error", err.Error())
+			continue
+		}
+		e.metrics.CacheEviction(edgeCacheName)
+	}
+}
+
+// Load picks up whatever was cached before a restart, most
+// recently modified first
+func (e *edgeCache) Load() error {
+	if e == nil {
+		return nil
+	}
+	if err := os.MkdirAll(e.root, 0755); err != nil {
+		return err
+	}
+	var found []edgeEntry
+	var mtimes = make(map[string]time.Time)
+	err := filepath.Walk(e.root, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		found = append(found, edgeEntry{path, f.Size()})
+		mtimes[path] = f.ModTime()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return mtimes[found[i].path].After(mtimes[found[j].path])
+	})
+	for _, f := range found {
+		e.add(f.path, f.bytes, false)
+	}
+	e.evict()
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/thraxil/resize"
+)
+
+func Test_edgeCache(t *testing.T) {
+	root := t.TempDir()
+	e := newEdgeCache(filepath.Join(root, "edge-cache"), 25, log.NewNopLogger())
+	if err := e.Load(); err != nil {
+		t.Fatal(err)
+	}
+	a := jbodSpec(t, "fb682e05b9be61797601e60165825c0b089f755e")
+	a.Size = resize.MakeSizeSpec("100s")
+	b := jbodSpec(t, "0051ec03fb813e8731224ee06feee7c828ceae24")
+	c := jbodSpec(t, "1234567890123456789012345678901234567890")
+
+	if _, ok := e.Get(a); ok {
+		t.Error("shouldn't have anything yet")
+	}
+	for _, ri := range []imageSpecifier{a, b} {
+		if err := e.Put(ri, strings.NewReader("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, ok := e.Get(a)
+	if !ok {
+		t.Fatal("a should be cached")
+	}
+	if data := readAndClose(t, r); string(data) != "0123456789" {
+		t.Errorf("got %q", string(data))
+	}
+	// pushes out b, since a was used more recently
+	if err := e.Put(c, strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := e.Get(b); ok {
+		t.Error("b should have been evicted")
+	}
+	if _, err := os.Stat(e.path(b)); !os.IsNotExist(err) {
+		t.Error("b's file should be gone")
+	}
+
+	// the cache is in the upload directory, but none of it
+	// should look like an image that we hold
+	_ = walkFullSize(root+"/", func(ri imageSpecifier, path string) error {
+		t.Errorf("cached copy mistaken for a replica: %s", path)
+		return nil
+	})
+
+	// after a restart, it picks up where it left off
+	e2 := newEdgeCache(e.root, 25, log.NewNopLogger())
+	if err := e2.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if e2.bytes != 20 {
+		t.Errorf("expected 20 bytes cached, got %d", e2.bytes)
+	}
+	if r, ok := e2.Get(c); !ok {
+		t.Error("c should still be cached")
+	} else {
+		readAndClose(t, r)
+	}
+}
+
+func TestImageView_GetImage_edgeCache(t *testing.T) {
+	backend := &mockBackend{
+		ReadFunc: func(spec imageSpecifier) ([]byte, error) {
+			return nil, errors.New("not found")
+		},
+		ExistsFunc: func(ri imageSpecifier) bool { return false },
+	}
+	content := "cluster image data"
+	fetches := 0
+	cluster := &mockCluster{
+		GetMyselfFunc: func() nodeData { return nodeData{UUID: "me"} },
+		RetrieveImageFunc: func(ctx context.Context, ri *imageSpecifier) ([]byte, error) {
+			fetches++
+			return []byte(content), nil
+		},
+	}
+	s := &siteConfig{EdgeCache: newEdgeCache(t.TempDir(), 1000, log.NewNopLogger())}
+	imageView := NewImageView(cluster, backend, s, sharedChannels{}, log.NewNopLogger())
+
+	hash, _ := hashFromString("c1986af3c26609b8b7d8933f99c51c1a89e9ea6b", "")
+	ri := &imageSpecifier{Hash: hash, Size: resize.MakeSizeSpec("100s"), Extension: ".png"}
+	for i := 0; i < 2; i++ {
+		img, _, err := imageView.GetImage(context.Background(), ri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data := readAndClose(t, img); string(data) != content {
+			t.Errorf("got %q", string(data))
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("second request should come from the edge cache, fetched %d times", fetches)
+	}
+
+	// a full-size image that doesn't match its hash is passed
+	// along (the cluster gave it to us), but not kept
+	full := ri.fullVersion()
+	img, _, err := imageView.GetImage(context.Background(), &full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAndClose(t, img)
+	if _, ok := s.EdgeCache.Get(full); ok {
+		t.Error("a corrupt copy shouldn't be cached")
+	}
+	if fetches != 3 {
+		t.Errorf("expected a second fetch after the corrupt copy, got %d", fetches)
+	}
+}
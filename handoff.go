@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/thraxil/resize"
+)
+
+// a hint records that we are holding a copy of an image on
+// behalf of a node that should have had it but couldn't take
+// it at the time.
+type hint struct {
+	Target    string    `json:"target"`
+	Hash      string    `json:"hash"`
+	Extension string    `json:"extension"`
+	Created   time.Time `json:"created"`
+}
+
+func (h hint) key() string {
+	return h.Target + "/" + h.Hash + h.Extension
+}
+
+func (h hint) spec() (imageSpecifier, error) {
+	ahash, err := hashFromString(h.Hash, "")
+	if err != nil {
+		return imageSpecifier{}, err
+	}
+	return imageSpecifier{ahash, resize.MakeSizeSpec("full"), h.Extension}, nil
+}
+
+// hintStore keeps our outstanding hints, saved to a file so
+// they survive a restart. Like imageIndex, a nil *hintStore is
+// safe to use and just never remembers anything.
+type hintStore struct {
+	path string
+
+	mu    sync.Mutex
+	hints map[string]hint
+}
+
+func openHintStore(path string) (*hintStore, error) {
+	hs := &hintStore{path: path, hints: make(map[string]hint)}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return hs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var hints []hint
+	if err := json.Unmarshal(b, &hints); err != nil {
+		return nil, err
+	}
+	for _, h := range hints {
+		hs.hints[h.key()] = h
+	}
+	return hs, nil
+}
+
+// must be called with the lock held
+func (hs *hintStore) save() error {
+	b, err := json.Marshal(hs.sorted(func(hint) bool { return true }))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(hs.path, b, 0644)
+}
+
+func (hs *hintStore) sorted(keep func(hint) bool) []hint {
+	hints := make([]hint, 0, len(hs.hints))
+	for _, h := range hs.hints {
+		if keep(h) {
+			hints = append(hints, h)
+		}
+	}
+	sort.Slice(hints, func(i, j int) bool { return hints[i].key() < hints[j].key() })
+	return hints
+}
+
+// Add records that we are holding ri for target
+func (hs *hintStore) Add(target string, ri imageSpecifier) error {
+	if hs == nil {
+		return nil
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	h := hint{Target: target, Hash: ri.Hash.String(), Extension: ri.Extension, Created: time.Now()}
+	if _, ok := hs.hints[h.key()]; ok {
+		return nil
+	}
+	hs.hints[h.key()] = h
+	return hs.save()
+}
+
+func (hs *hintStore) Remove(h hint) error {
+	if hs == nil {
+		return nil
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	delete(hs.hints, h.key())
+	return hs.save()
+}
+
+// For returns the hints we are holding for the target node
+func (hs *hintStore) For(target string) []hint {
+	if hs == nil {
+		return nil
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return hs.sorted(func(h hint) bool { return h.Target == target })
+}
+
+// ForHash returns the hints we are holding for the image
+func (hs *hintStore) ForHash(hash string) []hint {
+	if hs == nil {
+		return nil
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return hs.sorted(func(h hint) bool { return h.Hash == hash })
+}
+
+func (hs *hintStore) Len() int {
+	if hs == nil {
+		return 0
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return len(hs.hints)
+}
+
+// hintedHandoff replays hints when their target comes back
+type hintedHandoff struct {
+	c  *cluster
+	s  siteConfig
+	sl log.Logger
+}
+
+func newHintedHandoff(c *cluster, s siteConfig, sl log.Logger) *hintedHandoff {
+	return &hintedHandoff{c: c, s: s, sl: sl}
+}
+
+// run this as a goroutine
+func (h *hintedHandoff) Run() {
+	for n := range h.c.alive {
+		h.replay(context.Background(), n)
+	}
+}
+
+// send the target everything we've been holding for it. Once
+// it confirms that it has a copy, we drop the hint, and our own
+// copy too if we were only ever holding it for them.
+func (h *hintedHandoff) replay(ctx context.Context, n nodeData) {
+	for _, ht := range h.s.Hints.For(n.UUID) {
+		ri, err := ht.spec()
+		if err != nil {
+			_ = h.s.Hints.Remove(ht)
+			continue
+		}
+		if !n.Stash(ctx, ri, "", h.s.Backend) {
+			// not ready for it yet. try again next time
+			// we hear from it
+			_ = h.sl.Log("level", "INFO", "msg", "hinted node still not accepting stashes",
+				"node", n.Nickname)
+			return
+		}
+		info, err := n.RetrieveImageInfo(ctx, &ri)
+		if err != nil || info == nil || !info.Local {
+			continue
+		}
+		_ = h.s.Hints.Remove(ht)
+		h.s.Metrics.HandoffReplay()
+		_ = h.sl.Log("level", "INFO", "msg", "handed off image", "node", n.Nickname, "image", ht.Hash)
+		h.s.Events.Fire(eventRepairCompleted, eventData(ri, n.Nickname))
+		replicaAdded(ctx, h.c, h.s, ri)
+
+		if h.owns(ri) || len(h.s.Hints.ForHash(ht.Hash)) > 0 {
+			continue
+		}
+		cleanUpExcessReplica(h.s.Backend.fullPath(ri), h.s.Derivatives, h.sl)
+		_ = h.s.Index.Remove(ri.Hash)
+		h.s.Metrics.ReplicaCleanedUp()
+	}
+}
+
+func (h *hintedHandoff) owns(ri imageSpecifier) bool {
+	for _, uuid := range ringOwners(ri.Hash.String(), h.c.WriteRing(), h.s.Replication) {
+		if uuid == h.c.GetMyself().UUID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/thraxil/resize"
+)
+
+func Test_hintStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hints.json")
+	hs, err := openHintStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ri := testSpec(t, "full", ".jpg")
+	_ = hs.Add("target-uuid", ri)
+	_ = hs.Add("target-uuid", ri)
+	if hs.Len() != 1 {
+		t.Errorf("duplicate hint should be ignored, got %d", hs.Len())
+	}
+
+	hs, err = openHintStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hints := hs.For("target-uuid")
+	if len(hints) != 1 || hints[0].Hash != ri.Hash.String() {
+		t.Fatalf("hint didn't survive reopening: %v", hints)
+	}
+	if len(hs.ForHash(ri.Hash.String())) != 1 {
+		t.Error("should be able to find it by hash")
+	}
+	_ = hs.Remove(hints[0])
+	if hs.Len() != 0 {
+		t.Error("should be empty")
+	}
+
+	var nilStore *hintStore
+	if nilStore.Add("x", ri) != nil || nilStore.Len() != 0 {
+		t.Error("nil store should be a no-op")
+	}
+}
+
+// find a hash that the ring sends to the given node first
+func hashOwnedBy(t *testing.T, c *cluster, uuid string) *hash {
+	for i := 0; i < 1000; i++ {
+		h, _ := hashFromString(fmt.Sprintf("%x", sha1.Sum([]byte{byte(i), byte(i >> 8)})), "")
+		if c.WriteOrder(h.String())[0].UUID == uuid {
+			return h
+		}
+	}
+	t.Fatal("couldn't find a hash")
+	return nil
+}
+
+func Test_StashLeavesHint(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	_, c := makeNewClusterData([]nodeData{})
+	c.hints, _ = openHintStore(filepath.Join(t.TempDir(), "hints.json"))
+	c.AddNeighbor(nodeData{Nickname: "down", UUID: "down-uuid", BaseURL: server.URL, Writeable: true})
+
+	tmpfile := filepath.Join(t.TempDir(), "full.jpg")
+	_ = os.WriteFile(tmpfile, []byte("hello"), 0644)
+	b := mockBackend{fullPathFunc: func(ri imageSpecifier) string { return tmpfile }}
+
+	h := hashOwnedBy(t, c, "down-uuid")
+	ri := imageSpecifier{h, resize.MakeSizeSpec("full"), ".jpg"}
+	savedTo := c.Stash(context.Background(), ri, "", 1, 1, b)
+	if savedTo[0] != "myself" {
+		t.Errorf("we should have taken the copy, got %v", savedTo)
+	}
+	hints := c.hints.For("down-uuid")
+	if len(hints) != 1 || hints[0].Hash != h.String() {
+		t.Errorf("expected a hint for the down node, got %v", hints)
+	}
+}
+
+func Test_hintedHandoffReplay(t *testing.T) {
+	root := t.TempDir() + "/"
+	b := newDiskBackend(root)
+	_, c := makeNewClusterData([]nodeData{})
+
+	var stashed bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/stash/") {
+			stashed = true
+			_, _ = w.Write([]byte("ok"))
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"local": %v}`, stashed)
+	}))
+	defer server.Close()
+	n := nodeData{Nickname: "back", UUID: "back-uuid", BaseURL: server.URL, Writeable: true}
+	c.AddNeighbor(n)
+
+	h := hashOwnedBy(t, c, "back-uuid")
+	ri := imageSpecifier{h, resize.MakeSizeSpec("full"), ".jpg"}
+	_ = b.WriteFull(ri, io.NopCloser(strings.NewReader("hello")))
+
+	hints, _ := openHintStore(filepath.Join(t.TempDir(), "hints.json"))
+	_ = hints.Add("back-uuid", ri)
+	events, _ := testEventNotifier(t, webhookConfig{URL: "http://localhost:0/"})
+	s := siteConfig{Replication: 1, Backend: b, Hints: hints, Events: events}
+	hh := newHintedHandoff(c, s, log.NewNopLogger())
+	hh.replay(context.Background(), n)
+
+	if !stashed {
+		t.Error("should have stashed to the returning node")
+	}
+	if hints.Len() != 0 {
+		t.Error("hint should have been dropped")
+	}
+	if _, err := os.Stat(b.fullPath(ri)); !os.IsNotExist(err) {
+		t.Error("our excess copy should have been cleaned up")
+	}
+	// we had the one copy it needed already, so it's only a repair
+	due := events.outbox.Due("http://localhost:0/", time.Now())
+	if len(due) != 1 || due[0].Event.Type != eventRepairCompleted || due[0].Event.Nodes[0] != "back" {
+		t.Errorf("expected a repair.completed event, got %v", due)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"sync"
+)
+
+type cachedImage struct {
+	key  string
+	etag string
+	data []byte
+}
+
+// imageCache keeps the bytes of recently served images in memory
+// so that popular ones don't have to come off disk (or from
+// another node) every time. Images never change once stored, so
+// nothing ever needs to be invalidated; we just drop the least
+// recently used ones to stay within the budget.
+//
+// In shared mode, a node only keeps the images that it owns, and
+// everyone else gets them from the owners the same way they do
+// now, through /retrieve/. Like groupcache, that means each hot
+// image is held in memory by a few nodes instead of all of them.
+//
+// All the methods are safe to call on a nil *imageCache, which
+// never has anything.
+type imageCache struct {
+	budget  int64
+	shared  bool
+	metrics *metrics
+
+	mu    sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+	bytes int64
+}
+
+func newImageCache(budget int64, shared bool) *imageCache {
+	return &imageCache{
+		budget: budget,
+		shared: shared,
+		lru:    list.New(),
+		items:  make(map[string]*list.Element),
+	}
+}
+
+// anything bigger than this would push too much else out
+func (c *imageCache) maxEntry() int64 {
+	return c.budget / 8
+}
+
+func (c *imageCache) Get(key string) (cachedImage, bool) {
+	if c == nil {
+		return cachedImage{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		c.metrics.CacheRequest(imageCacheName, false)
+		return cachedImage{}, false
+	}
+	c.metrics.CacheRequest(imageCacheName, true)
+	c.lru.MoveToFront(e)
+	return *e.Value.(*cachedImage), true
+}
+
+func (c *imageCache) Add(key, etag string, data []byte) {
+	if c == nil || int64(len(data)) > c.maxEntry() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.lru.PushFront(&cachedImage{key, etag, data})
+	c.bytes += int64(len(data))
+	for c.bytes > c.budget {
+		e := c.lru.Back()
+		item := e.Value.(*cachedImage)
+		c.lru.Remove(e)
+		delete(c.items, item.key)
+		c.bytes -= int64(len(item.data))
+	}
+	c.metrics.CacheBytes(imageCacheName, c.bytes)
+}
+
+// Fill reads r into the cache if it is small enough, and returns
+// a reader that gives the caller the same bytes either way. Big
+// images are passed through without being read into memory.
+func (c *imageCache) Fill(key, etag string, r io.ReadCloser) (io.ReadCloser, error) {
+	if c == nil {
+		return r, nil
+	}
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, c.maxEntry()+1)
+	if err == io.EOF {
+		_ = r.Close()
+		c.Add(key, etag, buf.Bytes())
+		return bytesReadCloser(buf.Bytes()), nil
+	}
+	if err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+	// too big. start it over if we can, or else give back what
+	// we've read, followed by the rest
+	if rs, ok := r.(io.ReadSeeker); ok {
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			_ = r.Close()
+			return nil, err
+		}
+		return r, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf.Bytes()[:n]), r), r}, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/thraxil/resize"
+)
+
+func Test_imageCache(t *testing.T) {
+	c := newImageCache(80, false)
+	c.Add("a", "etag-a", make([]byte, 10))
+	c.Add("b", "etag-b", make([]byte, 10))
+	if _, ok := c.Get("a"); !ok {
+		t.Error("a should be cached")
+	}
+	// too big for the cache
+	c.Add("huge", "etag-huge", make([]byte, 11))
+	if _, ok := c.Get("huge"); ok {
+		t.Error("entries over an eighth of the budget shouldn't be cached")
+	}
+	for _, k := range []string{"c", "d", "e", "f", "g", "h", "i"} {
+		c.Add(k, "etag-"+k, make([]byte, 10))
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Error("b was the least recently used, and should have been dropped")
+	}
+	img, ok := c.Get("a")
+	if !ok {
+		t.Error("a was used recently and should still be there")
+	}
+	if img.etag != "etag-a" {
+		t.Errorf("wrong etag: %s", img.etag)
+	}
+	if c.bytes > c.budget {
+		t.Errorf("over budget: %d", c.bytes)
+	}
+}
+
+func Test_imageCacheFill(t *testing.T) {
+	c := newImageCache(80, false)
+
+	r, err := c.Fill("small", "etag", io.NopCloser(strings.NewReader("0123456789")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := readAndClose(t, r); string(data) != "0123456789" {
+		t.Errorf("got %q back", string(data))
+	}
+	if _, ok := c.Get("small"); !ok {
+		t.Error("small images should be cached")
+	}
+
+	r, err = c.Fill("big", "etag", io.NopCloser(strings.NewReader("0123456789abcdef")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := readAndClose(t, r); string(data) != "0123456789abcdef" {
+		t.Errorf("got %q back", string(data))
+	}
+	if _, ok := c.Get("big"); ok {
+		t.Error("big images should be passed through")
+	}
+
+	_, err = c.Fill("broken", "etag", io.NopCloser(failingReader{strings.NewReader("0123")}))
+	if err == nil {
+		t.Error("expected a read error")
+	}
+	if _, ok := c.Get("broken"); ok {
+		t.Error("a failed read shouldn't be cached")
+	}
+
+	var nilCache *imageCache
+	if _, ok := nilCache.Get("small"); ok {
+		t.Error("a nil cache never has anything")
+	}
+}
+
+func TestImageView_GetImage_cached(t *testing.T) {
+	reads := 0
+	backend := &mockBackend{
+		ReadFunc: func(spec imageSpecifier) ([]byte, error) {
+			reads++
+			return []byte("image data"), nil
+		},
+	}
+	myself := nodeData{UUID: "me", Writeable: true}
+	owners := []nodeData{myself, {UUID: "a"}}
+	cluster := &mockCluster{
+		GetMyselfFunc: func() nodeData { return myself },
+		ReadOrderFunc: func(hash string) []nodeData { return owners },
+		RetrieveImageFunc: func(ctx context.Context, ri *imageSpecifier) ([]byte, error) {
+			return nil, errors.New("not found")
+		},
+	}
+	s := &siteConfig{Replication: 1, ImageCache: newImageCache(1000, true)}
+	imageView := NewImageView(cluster, backend, s, sharedChannels{}, log.NewNopLogger())
+	hash, _ := hashFromString("c1986af3c26609b8b7d8933f99c51c1a89e9ea6b", "")
+	ri := &imageSpecifier{Hash: hash, Size: resize.MakeSizeSpec("100s"), Extension: ".png"}
+
+	var etags []string
+	for i := 0; i < 2; i++ {
+		img, etag, err := imageView.GetImage(context.Background(), ri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data := readAndClose(t, img); !bytes.Equal(data, []byte("image data")) {
+			t.Errorf("got %q", string(data))
+		}
+		etags = append(etags, etag)
+	}
+	if reads != 1 {
+		t.Errorf("second request should come from the cache, but read %d times", reads)
+	}
+	if etags[0] != etags[1] {
+		t.Error("cached image should have the same etag")
+	}
+
+	// in shared mode, images we don't own are left to their owners
+	owners = []nodeData{{UUID: "a"}, myself}
+	ri.Size = resize.MakeSizeSpec("200s")
+	for i := 0; i < 2; i++ {
+		img, _, err := imageView.GetImage(context.Background(), ri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readAndClose(t, img)
+	}
+	if reads != 3 {
+		t.Errorf("images we don't own shouldn't be cached, read %d times", reads)
+	}
+}
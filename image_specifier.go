@@ -50,6 +50,11 @@ func (i imageSpecifier) retrieveInfoURLPath() string {
 	return "/retrieve_info/" + i.Hash.String() + "/" + i.Size.String() + "/" + ext + "/"
 }
 
+func (i imageSpecifier) stashURLPath() string {
+	ext := strings.TrimLeft(i.Extension, ".")
+	return "/stash/" + i.Hash.String() + "/" + ext
+}
+
 func (i imageSpecifier) fullVersion() imageSpecifier {
 	i.Size = resize.MakeSizeSpec("full")
 	return i
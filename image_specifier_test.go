@@ -72,6 +72,15 @@ func Test_RetrieveInfoUrlPath(t *testing.T) {
 	}
 }
 
+func Test_StashUrlPath(t *testing.T) {
+	s := "112e42f26fce70d268438ac8137d81607499ee10/full/1250.jpg"
+	i := newImageSpecifier(s)
+	r := i.stashURLPath()
+	if r != "/stash/112e42f26fce70d268438ac8137d81607499ee10/jpg" {
+		t.Errorf("wrong stashURLPath: %s", r)
+	}
+}
+
 func Test_Webp(t *testing.T) {
 	s := "112e42f26fce70d268438ac8137d81607499ee10/200s/1250.webp"
 	i := newImageSpecifier(s)
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
-
 	"crypto/sha1"
-
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"time"
 
 	"github.com/go-kit/log"
 )
@@ -37,65 +40,259 @@ func NewImageView(
 }
 
 // GetImage retrieves and processes an image based on the image specifier.
-// It returns the image data, Etag, and an error.
-func (v *ImageView) GetImage(ctx context.Context, ri *imageSpecifier) ([]byte, string, error) {
+// It returns the image data, Etag, and an error. The caller must
+// close the returned reader.
+func (v *ImageView) GetImage(ctx context.Context, ri *imageSpecifier) (io.ReadCloser, string, error) {
+	if !v.cacheable(ri) {
+		return v.getImage(ctx, ri)
+	}
+	cache := v.siteConfig.ImageCache
+	key := ri.String()
+	if img, ok := cache.Get(key); ok {
+		return bytesReadCloser(img.data), img.etag, nil
+	}
+	contents, etag, err := v.getImage(ctx, ri)
+	if err != nil {
+		return nil, "", err
+	}
+	contents, err = cache.Fill(key, etag, contents)
+	if err != nil {
+		return nil, "", err
+	}
+	return contents, etag, nil
+}
+
+// whether the image belongs in the in-memory cache. In shared
+// mode, that's only if we're one of its owners.
+func (v *ImageView) cacheable(ri *imageSpecifier) bool {
+	if v.siteConfig == nil || v.siteConfig.ImageCache == nil {
+		return false
+	}
+	if !v.siteConfig.ImageCache.shared {
+		return true
+	}
+	myself := v.cluster.GetMyself()
+	for i, n := range v.cluster.ReadOrder(ri.Hash.String()) {
+		if i >= v.siteConfig.Replication {
+			break
+		}
+		if n.UUID == myself.UUID {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *ImageView) getImage(ctx context.Context, ri *imageSpecifier) (io.ReadCloser, string, error) {
 	// Try to serve directly from local backend
 	contents, err := v.backend.Read(*ri)
 	if err == nil {
+		if !ri.Size.IsFull() {
+			v.metrics().CacheRequest(derivativeCacheName, true)
+			v.touchDerivative(ri)
+		}
 		// We have it, calculate Etag and return
-		etag := fmt.Sprintf("%x", sha1.Sum(contents))
-		return contents, etag, nil
+		return imageEtag(ri, contents)
 	}
 
 	// If not found locally, check if full-size is available locally
+	if !v.haveImageFullsizeLocally(ri) && v.shouldHave(ri) {
+		// we're supposed to have it, so this is a good time to
+		// fix that. if it works, carry on as if we'd had it all along
+		if v.readRepair(ctx, ri) && ri.Size.IsFull() {
+			if contents, err := v.backend.Read(*ri); err == nil {
+				return imageEtag(ri, contents)
+			}
+		}
+	}
 	if !v.haveImageFullsizeLocally(ri) {
 		// If full-size not local, try to retrieve from cluster
-		imgData, err := v.cluster.RetrieveImage(ctx, ri)
+		imgData, err := v.retrieveFromCluster(ctx, ri)
 		if err != nil {
 			return nil, "", err // Not found in cluster either
 		}
-		etag := fmt.Sprintf("%x", sha1.Sum(imgData))
-		return imgData, etag, nil
+		return imageEtag(ri, imgData)
 	}
 
 	// We have the full-size, but not the scaled one, so resize it
 	if !v.locallyWriteable() {
 		// If not writeable, let another node in the cluster handle the scaling
-		imgData, err := v.cluster.RetrieveImage(ctx, ri) // Request scaled image from cluster
+		imgData, err := v.retrieveFromCluster(ctx, ri) // Request scaled image from cluster
 		if err != nil {
 			return nil, "", err
 		}
-		etag := fmt.Sprintf("%x", sha1.Sum(imgData))
-		return imgData, etag, nil
+		return imageEtag(ri, imgData)
 	}
 
 	// Resize locally
+	v.metrics().CacheRequest(derivativeCacheName, false)
 	_ = v.logger.Log("level", "DEBUG", "msg", "starting resize job")
 	result := v.makeResizeJob(ri)
-	if !result.Success {
-		resizeFailures.Add(1) // Global expvar, needs to be handled
-		return nil, "", fmt.Errorf("could not resize image")
-	}
-	servedScaled.Add(1) // Global expvar, needs to be handled
-
+	v.metrics().Resized(result.Success)
 	_ = v.logger.Log("level", "DEBUG", "msg", "resize job finished")
 	if !result.Success {
 		_ = v.logger.Log("level", "ERR", "msg", "resize job failed")
-		resizeFailures.Add(1) // Global expvar, needs to be handled
 		return nil, "", fmt.Errorf("could not resize image")
 	}
-	servedScaled.Add(1) // Global expvar, needs to be handled
 
 	if result.OutputData == nil {
 		_ = v.logger.Log("level", "ERR", "msg", "resize job returned nil data")
 		return nil, "", fmt.Errorf("resize succeeded but no data returned")
 	}
 	_ = v.logger.Log("level", "DEBUG", "msg", "calculating etag", "datalen", len(result.OutputData))
-	contents = result.OutputData
-	etag := fmt.Sprintf("%x", sha1.Sum(contents))
+	etag := fmt.Sprintf("%x", sha1.Sum(result.OutputData))
 
 	_ = v.logger.Log("level", "DEBUG", "msg", "returning contents")
-	return contents, etag, nil
+	return bytesReadCloser(result.OutputData), etag, nil
+}
+
+// the Etag is the SHA-1 of whatever we're sending. For a full-size
+// image that's just its hash, so we don't need to read it. Scaled
+// images are small enough that reading them twice is no bother.
+func imageEtag(ri *imageSpecifier, r io.ReadCloser) (io.ReadCloser, string, error) {
+	if ri.Size.IsFull() {
+		return r, ri.Hash.String(), nil
+	}
+	h := sha1.New()
+	if rs, ok := r.(io.ReadSeeker); ok {
+		if _, err := io.Copy(h, rs); err != nil {
+			_ = r.Close()
+			return nil, "", err
+		}
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			_ = r.Close()
+			return nil, "", err
+		}
+		return r, fmt.Sprintf("%x", h.Sum(nil)), nil
+	}
+	b, err := io.ReadAll(io.TeeReader(r, h))
+	_ = r.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	return bytesReadCloser(b), fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// get the image from another node. A read-only node with an edge
+// cache keeps a copy, and checks there first next time.
+func (v *ImageView) retrieveFromCluster(ctx context.Context, ri *imageSpecifier) (io.ReadCloser, error) {
+	var edge *edgeCache
+	if v.siteConfig != nil {
+		edge = v.siteConfig.EdgeCache
+	}
+	if r, ok := edge.Get(*ri); ok {
+		return r, nil
+	}
+	body, err := v.cluster.RetrieveImage(ctx, ri)
+	if err != nil || edge == nil {
+		return body, err
+	}
+	var r io.Reader = body
+	if ri.Size.IsFull() {
+		// don't hang on to a bad copy
+		r = newVerifyingReader(body, ri.Hash)
+	}
+	err = edge.Put(*ri, r)
+	_ = body.Close()
+	if err == nil {
+		if f, err := os.Open(edge.path(*ri)); err == nil {
+			return f, nil
+		}
+	} else {
+		_ = v.logger.Log("level", "WARN", "msg", "could not cache image", "image", ri.String(), "error", err.Error())
+	}
+	// we've used up the body, so go and get it again
+	return v.cluster.RetrieveImage(ctx, ri)
+}
+
+// let the derivative cache know that a resized image was used
+func (v *ImageView) touchDerivative(ri *imageSpecifier) {
+	if v.siteConfig == nil || v.siteConfig.Derivatives == nil {
+		return
+	}
+	path := resizedPath(v.backend.fullPath(ri.fullVersion()), ri.Size.String())
+	if fi, err := os.Stat(path); err == nil {
+		v.siteConfig.Derivatives.Touch(path, fi.Size())
+	}
+}
+
+type bytesReader struct {
+	*bytes.Reader
+}
+
+func (bytesReader) Close() error { return nil }
+
+// like io.NopCloser, but it can still Seek, so it can be
+// served with ranges
+func bytesReadCloser(b []byte) io.ReadCloser {
+	return bytesReader{bytes.NewReader(b)}
+}
+
+// what we can say about an image without sending it
+type imageHead struct {
+	Length   int64 // -1 if we don't know yet
+	Etag     string
+	Modified time.Time
+}
+
+// HeadImage finds out what it can about an image without resizing
+// it or fetching it from another node. If we don't have it at all,
+// and askCluster is set, we ask the nodes that should have it.
+func (v *ImageView) HeadImage(ctx context.Context, ri *imageSpecifier, askCluster bool) (imageHead, error) {
+	if v.cacheable(ri) {
+		if img, ok := v.siteConfig.ImageCache.Get(ri.String()); ok {
+			return imageHead{Length: int64(len(img.data)), Etag: img.etag}, nil
+		}
+	}
+	if contents, err := v.backend.Read(*ri); err == nil {
+		return headOf(ri, contents)
+	}
+	if v.siteConfig != nil {
+		if contents, ok := v.siteConfig.EdgeCache.Get(*ri); ok {
+			return headOf(ri, contents)
+		}
+	}
+	if v.haveImageFullsizeLocally(ri) && v.locallyWriteable() {
+		// we can make it, but we haven't yet
+		return imageHead{Length: -1}, nil
+	}
+	if !askCluster {
+		return imageHead{}, errors.New("not found")
+	}
+	return v.cluster.HeadImage(ctx, ri)
+}
+
+func headOf(ri *imageSpecifier, r io.ReadCloser) (imageHead, error) {
+	contents, etag, err := imageEtag(ri, r)
+	if err != nil {
+		return imageHead{}, err
+	}
+	defer func() { _ = contents.Close() }()
+	head := imageHead{Length: -1, Etag: etag, Modified: modTime(contents)}
+	if s, ok := contents.(io.Seeker); ok {
+		if n, err := s.Seek(0, io.SeekEnd); err == nil {
+			head.Length = n
+		}
+	}
+	return head, nil
+}
+
+// when the image was written, if it came from a file
+func modTime(r io.Reader) time.Time {
+	if f, ok := r.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if fi, err := f.Stat(); err == nil {
+			return fi.ModTime()
+		}
+	}
+	return time.Time{}
+}
+
+// may be nil
+func (v *ImageView) metrics() *metrics {
+	if v.siteConfig == nil {
+		return nil
+	}
+	return v.siteConfig.Metrics
 }
 
 func (v *ImageView) locallyWriteable() bool {
@@ -106,6 +303,51 @@ func (v *ImageView) haveImageFullsizeLocally(ri *imageSpecifier) bool {
 	return v.backend.Exists(ri.fullVersion())
 }
 
+// whether this node is one of the first Replication nodes in
+// the write order for the image
+func (v *ImageView) shouldHave(ri *imageSpecifier) bool {
+	if v.siteConfig == nil || !v.locallyWriteable() {
+		return false
+	}
+	myself := v.cluster.GetMyself()
+	for i, n := range v.cluster.WriteOrder(ri.Hash.String()) {
+		if i >= v.siteConfig.Replication {
+			break
+		}
+		if n.UUID == myself.UUID {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch the full-size image from the cluster, make sure it's
+// intact, and keep a copy of it
+func (v *ImageView) readRepair(ctx context.Context, ri *imageSpecifier) bool {
+	full := ri.fullVersion()
+	body, err := v.cluster.RetrieveImage(ctx, &full)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = body.Close() }()
+	err = v.backend.WriteFull(full, io.NopCloser(newVerifyingReader(body, ri.Hash)))
+	if err != nil {
+		// the write is atomic, so there's nothing to clean up
+		if errors.Is(err, errCorruptReplica) {
+			_ = v.logger.Log("level", "WARN", "msg", "read repair got a corrupt copy", "image", ri.Hash.String())
+		} else {
+			_ = v.logger.Log("level", "ERR", "msg", "read repair could not write image", "image", ri.Hash.String(), "error", err.Error())
+		}
+		return false
+	}
+	_ = v.logger.Log("level", "INFO", "msg", "read repaired image", "image", ri.Hash.String())
+	v.metrics().ReadRepaired()
+	v.siteConfig.Events.Fire(eventRepairCompleted, eventData(full, v.cluster.GetMyself().Nickname))
+	// don't hold up the response while we ask around
+	go replicaAdded(context.Background(), v.cluster, *v.siteConfig, full)
+	return true
+}
+
 func (v *ImageView) makeResizeJob(ri *imageSpecifier) resizeResponse {
 	_ = v.logger.Log("level", "DEBUG", "msg", "entering makeResizeJob")
 	c := make(chan resizeResponse)
@@ -113,11 +355,11 @@ func (v *ImageView) makeResizeJob(ri *imageSpecifier) resizeResponse {
 		_ = v.logger.Log("level", "ERR", "msg", "siteConfig is nil")
 		return resizeResponse{Success: false}
 	}
-	fmt.Println(ri.fullSizePath(v.siteConfig.UploadDirectory))
-	_ = v.logger.Log("level", "DEBUG", "msg", "sending to resize queue")
-	v.channels.ResizeQueue <- resizeRequest{ri.fullSizePath(v.siteConfig.UploadDirectory), ri.Extension, ri.Size.String(), c}
-	resizeQueueLength.Add(1) // Global expvar, needs to be handled
+	fullPath := v.backend.fullPath(ri.fullVersion())
+	_ = v.logger.Log("level", "DEBUG", "msg", "sending to resize queue", "path", fullPath)
+	v.channels.ResizeQueue <- resizeRequest{fullPath, ri.Extension, ri.Size.String(), c}
+	v.siteConfig.Metrics.ResizeQueued(1)
 	result := <-c
-	resizeQueueLength.Add(-1) // Global expvar, needs to be handled
+	v.siteConfig.Metrics.ResizeQueued(-1)
 	return result
 }
\ No newline at end of file
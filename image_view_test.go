@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha1"
 	"errors"
+	"fmt"
+	"io"
 	"testing"
 
 	"github.com/go-kit/log"
@@ -12,6 +16,7 @@ import (
 // mockCluster is a mock implementation of the Cluster interface for testing.
 type mockCluster struct {
 	RetrieveImageFunc       func(ctx context.Context, ri *imageSpecifier) ([]byte, error)
+	HeadImageFunc           func(ctx context.Context, ri *imageSpecifier) (imageHead, error)
 	GetMyselfFunc           func() nodeData
 	StashFunc               func(ctx context.Context, ri imageSpecifier, sizeHints string, replication int, minReplication int, backend Backend) []string
 	UploadedFunc            func(r imageRecord)
@@ -56,13 +61,24 @@ func (m *mockCluster) ReadOrder(hash string) []nodeData {
 	return nil
 }
 
-func (m *mockCluster) RetrieveImage(ctx context.Context, ri *imageSpecifier) ([]byte, error) {
+func (m *mockCluster) RetrieveImage(ctx context.Context, ri *imageSpecifier) (io.ReadCloser, error) {
 	if m.RetrieveImageFunc != nil {
-		return m.RetrieveImageFunc(ctx, ri)
+		b, err := m.RetrieveImageFunc(ctx, ri)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(b)), nil
 	}
 	return nil, errors.New("not implemented")
 }
 
+func (m *mockCluster) HeadImage(ctx context.Context, ri *imageSpecifier) (imageHead, error) {
+	if m.HeadImageFunc != nil {
+		return m.HeadImageFunc(ctx, ri)
+	}
+	return imageHead{}, errors.New("not implemented")
+}
+
 func (m *mockCluster) GetMyself() nodeData {
 	if m.GetMyselfFunc != nil {
 		return m.GetMyselfFunc()
@@ -136,6 +152,19 @@ func (m *mockCluster) GetRecentlyStashed() []imageRecord {
 	return nil
 }
 
+func readAndClose(t *testing.T, r io.ReadCloser) []byte {
+	t.Helper()
+	if r == nil {
+		return nil
+	}
+	defer func() { _ = r.Close() }()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
 func TestImageView_GetImage_serveDirect(t *testing.T) {
 	// Mock Backend
 	backend := &mockBackend{
@@ -152,7 +181,8 @@ func TestImageView_GetImage_serveDirect(t *testing.T) {
 	ri := &imageSpecifier{Hash: hash, Size: resize.MakeSizeSpec("100s"), Extension: ".png"}
 
 	// Execute
-	imgData, _, err := imageView.GetImage(context.Background(), ri)
+	img, _, err := imageView.GetImage(context.Background(), ri)
+	imgData := readAndClose(t, img)
 
 	// Assert
 	if err != nil {
@@ -184,7 +214,8 @@ func TestImageView_GetImage_serveFromCluster(t *testing.T) {
 	ri := &imageSpecifier{Hash: hash, Size: resize.MakeSizeSpec("100s"), Extension: ".png"}
 
 	// Execute
-	imgData, _, err := imageView.GetImage(context.Background(), ri)
+	img, _, err := imageView.GetImage(context.Background(), ri)
+	imgData := readAndClose(t, img)
 
 	// Assert
 	if err != nil {
@@ -223,7 +254,8 @@ func TestImageView_GetImage_serveScaledFromCluster(t *testing.T) {
 	ri := &imageSpecifier{Hash: hash, Size: resize.MakeSizeSpec("100s"), Extension: ".png"}
 
 	// Execute
-	imgData, _, err := imageView.GetImage(context.Background(), ri)
+	img, _, err := imageView.GetImage(context.Background(), ri)
+	imgData := readAndClose(t, img)
 
 	// Assert
 	if err != nil {
@@ -233,3 +265,110 @@ func TestImageView_GetImage_serveScaledFromCluster(t *testing.T) {
 		t.Errorf("Expected image data to be 'scaled cluster image data', but got '%s'", string(imgData))
 	}
 }
+
+func TestImageView_GetImage_readRepair(t *testing.T) {
+	data := []byte("full size image data")
+	hash, _ := hashFromString(fmt.Sprintf("%x", sha1.Sum(data)), "")
+
+	var written []byte
+	backend := &mockBackend{
+		ReadFunc: func(spec imageSpecifier) ([]byte, error) {
+			if written == nil {
+				return nil, errors.New("not found")
+			}
+			return written, nil
+		},
+		WriteFullFunc: func(ri imageSpecifier, f io.ReadCloser) error {
+			var err error
+			written, err = io.ReadAll(f)
+			return err
+		},
+	}
+	myself := nodeData{UUID: "me", Writeable: true}
+	cluster := &mockCluster{
+		GetMyselfFunc: func() nodeData { return myself },
+		WriteOrderFunc: func(hash string) []nodeData {
+			return []nodeData{{UUID: "other"}, myself}
+		},
+		RetrieveImageFunc: func(ctx context.Context, ri *imageSpecifier) ([]byte, error) {
+			if !ri.Size.IsFull() {
+				t.Errorf("read repair should fetch the full-size image, not %s", ri.Size.String())
+			}
+			return data, nil
+		},
+	}
+	imageView := NewImageView(cluster, backend, &siteConfig{Replication: 2}, sharedChannels{}, log.NewNopLogger())
+	ri := &imageSpecifier{Hash: hash, Size: resize.MakeSizeSpec("full"), Extension: ".jpg"}
+
+	img, _, err := imageView.GetImage(context.Background(), ri)
+	imgData := readAndClose(t, img)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if string(imgData) != string(data) {
+		t.Errorf("Expected the cluster's copy, but got '%s'", string(imgData))
+	}
+	if string(written) != string(data) {
+		t.Errorf("Expected the image to be written locally, got '%s'", string(written))
+	}
+}
+
+func TestImageView_GetImage_readRepairCorrupt(t *testing.T) {
+	hash, _ := hashFromString("c1986af3c26609b8b7d8933f99c51c1a89e9ea6b", "")
+
+	backend := &mockBackend{
+		ReadFunc: func(spec imageSpecifier) ([]byte, error) {
+			return nil, errors.New("not found")
+		},
+		WriteFullFunc: func(ri imageSpecifier, f io.ReadCloser) error {
+			_, err := io.ReadAll(f)
+			if !errors.Is(err, errCorruptReplica) {
+				t.Errorf("a corrupt copy should fail to write, got %v", err)
+			}
+			return err
+		},
+	}
+	myself := nodeData{UUID: "me", Writeable: true}
+	cluster := &mockCluster{
+		GetMyselfFunc: func() nodeData { return myself },
+		WriteOrderFunc: func(hash string) []nodeData {
+			return []nodeData{myself}
+		},
+		RetrieveImageFunc: func(ctx context.Context, ri *imageSpecifier) ([]byte, error) {
+			return []byte("not what was asked for"), nil
+		},
+	}
+	imageView := NewImageView(cluster, backend, &siteConfig{Replication: 1}, sharedChannels{}, log.NewNopLogger())
+	ri := &imageSpecifier{Hash: hash, Size: resize.MakeSizeSpec("full"), Extension: ".jpg"}
+
+	// it still gets served, we just don't keep it
+	img, _, err := imageView.GetImage(context.Background(), ri)
+	if err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+	readAndClose(t, img)
+}
+
+func TestImageView_shouldHave(t *testing.T) {
+	hash, _ := hashFromString("c1986af3c26609b8b7d8933f99c51c1a89e9ea6b", "")
+	ri := &imageSpecifier{Hash: hash, Size: resize.MakeSizeSpec("full"), Extension: ".jpg"}
+	myself := nodeData{UUID: "me", Writeable: true}
+	cluster := &mockCluster{
+		GetMyselfFunc: func() nodeData { return myself },
+		WriteOrderFunc: func(hash string) []nodeData {
+			return []nodeData{{UUID: "a"}, {UUID: "b"}, myself}
+		},
+	}
+	imageView := NewImageView(cluster, &mockBackend{}, &siteConfig{Replication: 2}, sharedChannels{}, log.NewNopLogger())
+	if imageView.shouldHave(ri) {
+		t.Error("third in the write order with replication 2 is not an owner")
+	}
+	imageView.siteConfig.Replication = 3
+	if !imageView.shouldHave(ri) {
+		t.Error("third in the write order with replication 3 is an owner")
+	}
+	myself.Writeable = false
+	if imageView.shouldHave(ri) {
+		t.Error("a non-writeable node shouldn't repair")
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// what we know about one locally stored image
+type indexEntry struct {
+	Hash      string    `json:"hash"`
+	Extension string    `json:"extension"`
+	Bytes     int64     `json:"bytes"`
+	Uploaded  time.Time `json:"uploaded"`
+	Sizes     []string  `json:"sizes,omitempty"`
+	Verified  time.Time `json:"verified,omitempty"`
+}
+
+func (e indexEntry) hasSize(size string) bool {
+	for _, s := range e.Sizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// one line in the journal
+type indexRecord struct {
+	Op    string     `json:"op"` // "put", "del", "complete", "open" or "closed"
+	Entry indexEntry `json:"entry"`
+}
+
+// imageIndex keeps track of every image stored on this node so
+// that we don't have to go to the filesystem to find out.
+//
+// It is an in-memory map backed by an append-only journal file.
+// Every change is appended to the journal, and the journal gets
+// compacted down to one record per image once it has grown well
+// past the number of images. It can always be rebuilt from what
+// is actually on disk with rebuildIndex.
+//
+// An index is complete once everything that was already on disk
+// has been put in it (by rebuildIndex or backfillIndex). Until
+// then it only knows about what has been written since, so a miss
+// means nothing and has to be checked on disk. After that a miss
+// is authoritative. A hit is always trusted, but can go stale if
+// a file disappears behind our back, so a read that doesn't find
+// the file drops the entry.
+//
+// The journal isn't synced on every write, so a crash can lose the
+// last few records while an older "complete" survives, and then a
+// miss would be believed when it shouldn't be. So Close ends the
+// journal with a "closed" record, and an index that wasn't closed
+// properly starts out incomplete again until it's been backfilled.
+//
+// All the methods are safe to call on a nil *imageIndex, which
+// acts as an index that never knows anything.
+type imageIndex struct {
+	path string
+
+	mu       sync.Mutex
+	entries  map[string]indexEntry
+	complete bool
+	journal  *os.File
+	writes   int
+}
+
+func openImageIndex(path string) (*imageIndex, error) {
+	idx := &imageIndex{
+		path:    path,
+		entries: make(map[string]indexEntry),
+	}
+	if err := idx.load(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	idx.journal = f
+	// so that it doesn't look closed if we crash before
+	// the next Close
+	if err := idx.record(indexRecord{Op: "open"}); err != nil {
+		_ = idx.journal.Close()
+		return nil, err
+	}
+	if err := idx.journal.Sync(); err != nil {
+		_ = idx.journal.Close()
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (idx *imageIndex) load() error {
+	f, err := os.Open(idx.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var closed = false
+	for scanner.Scan() {
+		var rec indexRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// most likely a partial write from a crash.
+			// whatever it was, a rebuild will catch it
+			closed = false
+			continue
+		}
+		if rec.Op == "open" && !closed {
+			// it crashed last time, and nothing since has
+			// backfilled it
+			idx.complete = false
+		}
+		idx.apply(rec)
+		idx.writes++
+		closed = rec.Op == "closed"
+	}
+	if !closed {
+		// we don't know what didn't make it to disk
+		idx.complete = false
+	}
+	return scanner.Err()
+}
+
+func (idx *imageIndex) apply(rec indexRecord) {
+	switch rec.Op {
+	case "put":
+		idx.entries[rec.Entry.Hash] = rec.Entry
+	case "del":
+		delete(idx.entries, rec.Entry.Hash)
+	case "complete":
+		idx.complete = true
+	}
+}
+
+// must be called with the lock held
+func (idx *imageIndex) record(rec indexRecord) error {
+	idx.apply(rec)
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := idx.journal.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	idx.writes++
+	if idx.writes > 2*len(idx.entries)+1000 {
+		return idx.compact()
+	}
+	return nil
+}
+
+// rewrite the journal with just the current entries.
+// must be called with the lock held
+func (idx *imageIndex) compact() error {
+	var sb strings.Builder
+	for _, e := range idx.sortedEntries() {
+		b, err := json.Marshal(indexRecord{Op: "put", Entry: e})
+		if err != nil {
+			return err
+		}
+		sb.Write(b)
+		sb.WriteByte('\n')
+	}
+	if idx.complete {
+		b, err := json.Marshal(indexRecord{Op: "complete"})
+		if err != nil {
+			return err
+		}
+		sb.Write(b)
+		sb.WriteByte('\n')
+	}
+	if err := writeFileAtomic(idx.path, []byte(sb.String()), 0644); err != nil {
+		return err
+	}
+	_ = idx.journal.Close()
+	f, err := os.OpenFile(idx.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	idx.journal = f
+	idx.writes = len(idx.entries)
+	return nil
+}
+
+func (idx *imageIndex) sortedEntries() []indexEntry {
+	entries := make([]indexEntry, 0, len(idx.entries))
+	for _, e := range idx.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Hash < entries[j].Hash })
+	return entries
+}
+
+func (idx *imageIndex) Close() error {
+	if idx == nil {
+		return nil
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	// everything else has to be on disk before we say so
+	if err := idx.journal.Sync(); err != nil {
+		_ = idx.journal.Close()
+		return err
+	}
+	b, err := json.Marshal(indexRecord{Op: "closed"})
+	if err == nil {
+		_, err = idx.journal.Write(append(b, '\n'))
+	}
+	if err == nil {
+		err = idx.journal.Sync()
+	}
+	if err != nil {
+		_ = idx.journal.Close()
+		return err
+	}
+	return idx.journal.Close()
+}
+
+func (idx *imageIndex) Get(hash string) (indexEntry, bool) {
+	if idx == nil {
+		return indexEntry{}, false
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	e, ok := idx.entries[hash]
+	return e, ok
+}
+
+// Has reports whether the index knows about this exact image
+// (full-size or a particular derivative)
+func (idx *imageIndex) Has(ri imageSpecifier) bool {
+	e, ok := idx.Get(ri.Hash.String())
+	if !ok || e.Extension != ri.Extension {
+		return false
+	}
+	if ri.Size.IsFull() {
+		return true
+	}
+	return e.hasSize(ri.Size.String())
+}
+
+// Complete reports whether everything on disk has been put in the
+// index, so that a miss can be believed
+func (idx *imageIndex) Complete() bool {
+	if idx == nil {
+		return false
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.complete
+}
+
+// Entries returns every image in the index, sorted by hash
+func (idx *imageIndex) Entries() []indexEntry {
+	if idx == nil {
+		return nil
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.sortedEntries()
+}
+
+func (idx *imageIndex) Len() int {
+	if idx == nil {
+		return 0
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return len(idx.entries)
+}
+
+// AddFull records a newly written full-size image
+func (idx *imageIndex) AddFull(ri imageSpecifier, bytes int64) error {
+	if idx == nil {
+		return nil
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	e, ok := idx.entries[ri.Hash.String()]
+	if !ok {
+		e = indexEntry{Hash: ri.Hash.String(), Uploaded: time.Now()}
+	}
+	e.Extension = ri.Extension
+	e.Bytes = bytes
+	return idx.record(indexRecord{Op: "put", Entry: e})
+}
+
+// AddSize records a newly created derivative
+func (idx *imageIndex) AddSize(h *hash, size string) error {
+	if idx == nil {
+		return nil
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	e, ok := idx.entries[h.String()]
+	if !ok || e.hasSize(size) {
+		return nil
+	}
+	e.Sizes = append(append([]string{}, e.Sizes...), size)
+	return idx.record(indexRecord{Op: "put", Entry: e})
+}
+
+// RemoveSize forgets about one derivative
+func (idx *imageIndex) RemoveSize(h *hash, size string) error {
+	if idx == nil {
+		return nil
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	e, ok := idx.entries[h.String()]
+	if !ok || !e.hasSize(size) {
+		return nil
+	}
+	var sizes []string
+	for _, s := range e.Sizes {
+		if s != size {
+			sizes = append(sizes, s)
+		}
+	}
+	e.Sizes = sizes
+	return idx.record(indexRecord{Op: "put", Entry: e})
+}
+
+// ClearSizes forgets about all of an image's derivatives
+func (idx *imageIndex) ClearSizes(h *hash) error {
+	if idx == nil {
+		return nil
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	e, ok := idx.entries[h.String()]
+	if !ok || len(e.Sizes) == 0 {
+		return nil
+	}
+	e.Sizes = nil
+	return idx.record(indexRecord{Op: "put", Entry: e})
+}
+
+// Verified records that the verifier just checked the image
+func (idx *imageIndex) Verified(h *hash) error {
+	if idx == nil {
+		return nil
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	e, ok := idx.entries[h.String()]
+	if !ok {
+		return nil
+	}
+	e.Verified = time.Now()
+	return idx.record(indexRecord{Op: "put", Entry: e})
+}
+
+// Forget drops whatever the index says about this exact image,
+// after finding that it isn't really there
+func (idx *imageIndex) Forget(ri imageSpecifier) error {
+	if ri.Size.IsFull() {
+		return idx.Remove(ri.Hash)
+	}
+	return idx.RemoveSize(ri.Hash, ri.Size.String())
+}
+
+// Remove forgets about an image entirely
+func (idx *imageIndex) Remove(h *hash) error {
+	if idx == nil {
+		return nil
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if _, ok := idx.entries[h.String()]; !ok {
+		return nil
+	}
+	return idx.record(indexRecord{Op: "del", Entry: indexEntry{Hash: h.String()}})
+}
+
+// rebuildIndex throws away whatever the index thinks it knows
+// and replaces it with what is actually on disk under the roots.
+func rebuildIndex(idx *imageIndex, roots ...string) error {
+	if idx == nil {
+		return errors.New("no index")
+	}
+	entries := make(map[string]indexEntry)
+	for _, root := range roots {
+		if err := indexRoot(idx, root, entries); err != nil {
+			return err
+		}
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.entries = entries
+	idx.complete = true
+	return idx.compact()
+}
+
+// backfillIndex adds anything on disk under the roots that the
+// index doesn't know about yet, and then marks it complete. Unlike
+// rebuildIndex, it keeps everything already in the index, so it is
+// safe to run while we're serving. It returns how many images it
+// added.
+func backfillIndex(idx *imageIndex, roots ...string) (int, error) {
+	if idx == nil {
+		return 0, errors.New("no index")
+	}
+	var added = 0
+	for _, root := range roots {
+		err := walkFullSize(root, func(ri imageSpecifier, path string) error {
+			if idx.Has(ri) {
+				return nil
+			}
+			e, err := indexImage(ri, path)
+			if err != nil {
+				// gone since the walk found it
+				return nil
+			}
+			idx.mu.Lock()
+			defer idx.mu.Unlock()
+			if _, ok := idx.entries[e.Hash]; ok {
+				// written while we were looking
+				return nil
+			}
+			added++
+			return idx.record(indexRecord{Op: "put", Entry: e})
+		})
+		if err != nil {
+			return added, err
+		}
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return added, idx.record(indexRecord{Op: "complete"})
+}
+
+func indexRoot(idx *imageIndex, root string, entries map[string]indexEntry) error {
+	return walkFullSize(root, func(ri imageSpecifier, path string) error {
+		e, err := indexImage(ri, path)
+		if err != nil {
+			return err
+		}
+		if old, ok := idx.Get(e.Hash); ok {
+			e.Verified = old.Verified
+		}
+		entries[e.Hash] = e
+		return nil
+	})
+}
+
+// what is on disk for the full-size image at path
+func indexImage(ri imageSpecifier, path string) (indexEntry, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return indexEntry{}, err
+	}
+	e := indexEntry{
+		Hash:      ri.Hash.String(),
+		Extension: ri.Extension,
+		Bytes:     fi.Size(),
+		Uploaded:  fi.ModTime(),
+	}
+	files, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return indexEntry{}, err
+	}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ri.Extension {
+			continue
+		}
+		size := basename(f.Name())
+		if size == "full" {
+			continue
+		}
+		e.Sizes = append(e.Sizes, size)
+	}
+	return e, nil
+}
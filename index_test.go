@@ -0,0 +1,245 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thraxil/resize"
+)
+
+func testSpec(t *testing.T, size, ext string) imageSpecifier {
+	h, err := hashFromString("fb682e05b9be61797601e60165825c0b089f755e", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return imageSpecifier{h, resize.MakeSizeSpec(size), ext}
+}
+
+func Test_imageIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.journal")
+	idx, err := openImageIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := testSpec(t, "full", ".jpg")
+	sized := testSpec(t, "100s", ".jpg")
+
+	if idx.Has(full) {
+		t.Error("empty index shouldn't have anything")
+	}
+	_ = idx.AddFull(full, 123)
+	_ = idx.AddSize(full.Hash, "100s")
+	_ = idx.Verified(full.Hash)
+	if !idx.Has(full) || !idx.Has(sized) {
+		t.Error("index should have both sizes")
+	}
+	if idx.Has(testSpec(t, "full", ".png")) {
+		t.Error("wrong extension")
+	}
+	if err := idx.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// and it should all come back when reopened
+	idx, err = openImageIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := idx.Get(full.Hash.String())
+	if !ok {
+		t.Fatal("entry didn't survive reopening")
+	}
+	if e.Bytes != 123 || len(e.Sizes) != 1 || e.Verified.IsZero() || e.Uploaded.IsZero() {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+
+	_ = idx.RemoveSize(full.Hash, "100s")
+	if idx.Has(sized) {
+		t.Error("size should be gone")
+	}
+	_ = idx.Remove(full.Hash)
+	if idx.Len() != 0 {
+		t.Error("should be empty again")
+	}
+	_ = idx.Close()
+}
+
+func Test_imageIndexPartialWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.journal")
+	idx, _ := openImageIndex(path)
+	_ = idx.AddFull(testSpec(t, "full", ".jpg"), 5)
+	_ = idx.Close()
+
+	// simulate a crash in the middle of a write
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	_, _ = f.WriteString(`{"op":"put","entry":{"hash":"ab`)
+	_ = f.Close()
+
+	idx, err := openImageIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.Len() != 1 {
+		t.Errorf("expected the good entry to survive, got %d", idx.Len())
+	}
+	_ = idx.Close()
+}
+
+func Test_imageIndexUncleanStart(t *testing.T) {
+	root := t.TempDir() + "/"
+	path := filepath.Join(root, "index.journal")
+	idx, _ := openImageIndex(path)
+	if _, err := backfillIndex(idx, root); err != nil {
+		t.Fatal(err)
+	}
+	_ = idx.Close()
+
+	// this time we crash instead of closing it, and whatever
+	// hadn't been synced might be lost
+	idx, _ = openImageIndex(path)
+	if !idx.Complete() {
+		t.Fatal("should still be complete after a clean close")
+	}
+	_ = idx.AddFull(testSpec(t, "full", ".jpg"), 5)
+	_ = idx.journal.Close()
+
+	idx, _ = openImageIndex(path)
+	if idx.Complete() {
+		t.Error("an index that wasn't closed can't be trusted to be complete")
+	}
+	_ = idx.Close()
+
+	// closing it properly later doesn't make it complete either
+	idx, _ = openImageIndex(path)
+	if idx.Complete() {
+		t.Error("reopening without a backfill shouldn't make it complete")
+	}
+	if _, err := backfillIndex(idx, root); err != nil {
+		t.Fatal(err)
+	}
+	_ = idx.Close()
+	idx, _ = openImageIndex(path)
+	defer func() { _ = idx.Close() }()
+	if !idx.Complete() {
+		t.Error("should be complete again once backfilled")
+	}
+}
+
+func Test_nilImageIndex(t *testing.T) {
+	var idx *imageIndex
+	full := testSpec(t, "full", ".jpg")
+	if idx.Has(full) || idx.Len() != 0 {
+		t.Error("nil index should be empty")
+	}
+	if idx.AddFull(full, 1) != nil || idx.Remove(full.Hash) != nil {
+		t.Error("nil index should be a no-op")
+	}
+}
+
+func Test_diskBackendUpdatesIndex(t *testing.T) {
+	root := t.TempDir() + "/"
+	idx, _ := openImageIndex(filepath.Join(root, "index.journal"))
+	defer func() { _ = idx.Close() }()
+	b := diskBackend{Root: root, Index: idx}
+
+	full := testSpec(t, "full", ".jpg")
+	if err := b.WriteFull(full, io.NopCloser(strings.NewReader("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	sized := testSpec(t, "100s", ".jpg")
+	if err := b.WriteSized(sized, io.NopCloser(strings.NewReader("hi"))); err != nil {
+		t.Fatal(err)
+	}
+	e, ok := idx.Get(full.Hash.String())
+	if !ok || e.Bytes != 5 || !e.hasSize("100s") {
+		t.Errorf("index not updated: %+v", e)
+	}
+	_ = b.Delete(sized)
+	if idx.Has(sized) {
+		t.Error("deleted size still in index")
+	}
+	_ = b.Delete(full)
+	if idx.Has(full) {
+		t.Error("deleted image still in index")
+	}
+}
+
+func Test_rebuildIndex(t *testing.T) {
+	root := t.TempDir() + "/"
+	b := newDiskBackend(root)
+	full := testSpec(t, "full", ".jpg")
+	_ = b.WriteFull(full, io.NopCloser(strings.NewReader("hello")))
+	_ = b.WriteSized(testSpec(t, "100s", ".jpg"), io.NopCloser(strings.NewReader("hi")))
+
+	idx, _ := openImageIndex(filepath.Join(root, "index.journal"))
+	defer func() { _ = idx.Close() }()
+	// something stale that isn't on disk
+	stale, _ := hashFromString("0051ec03fb813e8731224ee06feee7c828ceae22", "")
+	_ = idx.AddFull(imageSpecifier{stale, resize.MakeSizeSpec("full"), ".png"}, 1)
+
+	if err := rebuildIndex(idx, root); err != nil {
+		t.Fatal(err)
+	}
+	if idx.Len() != 1 {
+		t.Errorf("expected exactly one image, got %d", idx.Len())
+	}
+	e, _ := idx.Get(full.Hash.String())
+	if e.Bytes != 5 || !e.hasSize("100s") {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+}
+
+func Test_backfillIndex(t *testing.T) {
+	root := t.TempDir() + "/"
+	// already on disk from before there was an index
+	old := testSpec(t, "full", ".jpg")
+	_ = newDiskBackend(root).WriteFull(old, io.NopCloser(strings.NewReader("hello")))
+	_ = newDiskBackend(root).WriteSized(testSpec(t, "100s", ".jpg"), io.NopCloser(strings.NewReader("hi")))
+
+	path := filepath.Join(root, "index.journal")
+	idx, _ := openImageIndex(path)
+	b := diskBackend{Root: root, Index: idx}
+	newer, _ := hashFromString("0051ec03fb813e8731224ee06feee7c828ceae22", "")
+	newSpec := imageSpecifier{newer, resize.MakeSizeSpec("full"), ".png"}
+	_ = b.WriteFull(newSpec, io.NopCloser(strings.NewReader("new")))
+
+	if idx.Complete() || !b.Exists(old) {
+		t.Error("an incomplete index has to check the disk on a miss")
+	}
+	added, err := backfillIndex(idx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 1 || idx.Len() != 2 || !idx.Has(testSpec(t, "100s", ".jpg")) {
+		t.Errorf("expected the old image to be added with its size, got %d added: %v", added, idx.Entries())
+	}
+	_ = idx.Close()
+
+	idx, _ = openImageIndex(path)
+	defer func() { _ = idx.Close() }()
+	if !idx.Complete() || idx.Len() != 2 {
+		t.Error("should still be complete after reopening")
+	}
+	b = diskBackend{Root: root, Index: idx}
+
+	// once complete, a miss is believed without looking
+	_ = os.WriteFile(testSpec(t, "200s", ".jpg").sizedPath(root), []byte("sneaky"), 0644)
+	if b.Exists(testSpec(t, "200s", ".jpg")) {
+		t.Error("a complete index's miss should be authoritative")
+	}
+
+	// and a hit that turns out to be stale gets dropped
+	_ = os.Remove(newSpec.fullSizePath(root))
+	if !b.Exists(newSpec) {
+		t.Error("a hit is trusted")
+	}
+	if _, err := b.Read(newSpec); err == nil {
+		t.Fatal("expected the read to fail")
+	}
+	if idx.Has(newSpec) || b.Exists(newSpec) {
+		t.Error("the stale entry should have been dropped")
+	}
+}
@@ -7,7 +7,7 @@ import (
 
 // Backend is an interface for storing and retrieving images.
 type Backend interface {
-	Read(spec imageSpecifier) ([]byte, error)
+	Read(spec imageSpecifier) (io.ReadCloser, error)
 	WriteFull(spec imageSpecifier, reader io.ReadCloser) error
 	fullPath(ri imageSpecifier) string
 	Exists(spec imageSpecifier) bool
@@ -16,7 +16,8 @@ type Backend interface {
 
 // Cluster is an interface for interacting with the cluster.
 type Cluster interface {
-	RetrieveImage(ctx context.Context, ri *imageSpecifier) ([]byte, error)
+	RetrieveImage(ctx context.Context, ri *imageSpecifier) (io.ReadCloser, error)
+	HeadImage(ctx context.Context, ri *imageSpecifier) (imageHead, error)
 	Stash(ctx context.Context, ri imageSpecifier, sizeHints string, replication int, minReplication int, backend Backend) []string
 	Uploaded(r imageRecord)
 	GetNeighbors() []nodeData
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// how often to make sure that each disk is still there
+const diskCheckInterval = 30 * time.Second
+
+// the file that marks a directory as being one of our disks. an
+// empty mount point with nothing mounted on it is just as
+// writeable as an empty disk, but it won't have this.
+const diskIDFile = ".reticulum-disk"
+
+type jbodDisk struct {
+	Root string
+	// what's in its diskIDFile
+	id     string
+	failed bool
+}
+
+// what /status/ shows about each disk
+type diskStatus struct {
+	Root   string
+	Failed bool
+	Total  uint64
+	Free   uint64
+	Used   uint64
+	Error  string
+}
+
+func (d diskStatus) UsedPercent() float64 {
+	if d.Total == 0 {
+		return 0
+	}
+	return 100 * float64(d.Used) / float64(d.Total)
+}
+
+func (d diskStatus) UsedFormatted() string  { return formatBytes(d.Used) }
+func (d diskStatus) FreeFormatted() string  { return formatBytes(d.Free) }
+func (d diskStatus) TotalFormatted() string { return formatBytes(d.Total) }
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// jbodBackend spreads images across several independent disks,
+// each with the same layout that diskBackend uses.
+//
+// Every hash has a preferred disk, picked by rendezvous hashing
+// over the disks that are working, so adding or losing a disk
+// only changes the preference for the images on that disk. An
+// image stays wherever it was first written, and reads check
+// the preferred disk first and then all the others.
+//
+// Each disk gets an ID file the first time we see it, and from
+// then on a disk that doesn't have the same one has failed,
+// even if there's a perfectly good directory where it used to be.
+//
+// When a disk stops working, anything we no longer have a copy
+// of is dropped from the index. As far as the rest of the cluster
+// is concerned, we have just lost those images, and the usual
+// repair (read repair, anti-entropy, rebalancing) puts them back.
+type jbodBackend struct {
+	Index       *imageIndex
+	Purge       *purgeNotifier
+	Derivatives *derivativeCache
+	Metrics     *metrics
+	sl          log.Logger
+
+	mu    sync.RWMutex
+	disks []*jbodDisk
+}
+
+func newJbodBackend(roots []string, idx *imageIndex, sl log.Logger) *jbodBackend {
+	j := &jbodBackend{Index: idx, sl: sl}
+	for _, root := range roots {
+		d := &jbodDisk{Root: root}
+		id, err := setUpDisk(root)
+		if err != nil {
+			// Check will keep looking for it
+			_ = sl.Log("level", "ERR", "msg", "could not set up disk", "disk", root, "error", err.Error())
+		}
+		d.id = id
+		j.disks = append(j.disks, d)
+	}
+	return j
+}
+
+// the disk's ID, giving it one if it doesn't have one yet. we only
+// do that at startup, when all the disks are supposed to be there.
+func setUpDisk(root string) (string, error) {
+	id, err := readDiskID(root)
+	if !os.IsNotExist(err) {
+		return id, err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id = hex.EncodeToString(b)
+	if err := writeFileAtomic(filepath.Join(root, diskIDFile), []byte(id+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func readDiskID(root string) (string, error) {
+	b, err := os.ReadFile(filepath.Join(root, diskIDFile))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (j *jbodBackend) String() string {
+	return "JBOD"
+}
+
+// Roots returns the roots of the disks that are working
+func (j *jbodBackend) Roots() []string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	var roots []string
+	for _, d := range j.disks {
+		if !d.failed {
+			roots = append(roots, d.Root)
+		}
+	}
+	return roots
+}
+
+func diskScore(root string, h *hash) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(root+h.String())))
+}
+
+// the working disk that the hash would prefer to be on
+func (j *jbodBackend) preferred(h *hash) (string, bool) {
+	var best, bestScore string
+	for _, root := range j.Roots() {
+		if s := diskScore(root, h); s > bestScore {
+			best, bestScore = root, s
+		}
+	}
+	return best, best != ""
+}
+
+// the working disk that has the full-size image, if any
+func (j *jbodBackend) locate(ri imageSpecifier) (string, bool) {
+	full := ri.fullVersion()
+	pref, ok := j.preferred(ri.Hash)
+	if !ok {
+		return "", false
+	}
+	if _, err := os.Stat(full.fullSizePath(pref)); err == nil {
+		return pref, true
+	}
+	for _, root := range j.Roots() {
+		if root == pref {
+			continue
+		}
+		if _, err := os.Stat(full.fullSizePath(root)); err == nil {
+			return root, true
+		}
+	}
+	return "", false
+}
+
+// the disk to write to: wherever it already is, or else
+// where it would prefer to be
+func (j *jbodBackend) disk(ri imageSpecifier) (diskBackend, error) {
+	root, ok := j.locate(ri)
+	if !ok {
+		root, ok = j.preferred(ri.Hash)
+	}
+	if !ok {
+		return diskBackend{}, errors.New("no working disks")
+	}
+	return diskBackend{Root: root, Index: j.Index}, nil
+}
+
+func (j *jbodBackend) WriteFull(img imageSpecifier, r io.ReadCloser) error {
+	d, err := j.disk(img)
+	if err != nil {
+		return err
+	}
+	return d.WriteFull(img, r)
+}
+
+func (j *jbodBackend) WriteSized(img imageSpecifier, r io.ReadCloser) error {
+	d, err := j.disk(img)
+	if err != nil {
+		return err
+	}
+	return d.WriteSized(img, r)
+}
+
+func (j *jbodBackend) Read(img imageSpecifier) (io.ReadCloser, error) {
+	root, ok := j.locate(img)
+	if !ok {
+		_ = j.Index.Forget(img.fullVersion())
+		return nil, os.ErrNotExist
+	}
+	return diskBackend{Root: root, Index: j.Index}.Read(img)
+}
+
+// Exists works the same way as diskBackend's
+func (j *jbodBackend) Exists(img imageSpecifier) bool {
+	if j.Index.Has(img) {
+		return true
+	}
+	if j.Index.Complete() {
+		return false
+	}
+	root, ok := j.locate(img)
+	if !ok {
+		return false
+	}
+	_, err := os.Stat(img.sizedPath(root))
+	return err == nil
+}
+
+func (j *jbodBackend) Delete(img imageSpecifier) error {
+	root, ok := j.locate(img)
+	if !ok {
+		return nil
+	}
+	return diskBackend{Root: root, Index: j.Index, Purge: j.Purge, Derivatives: j.Derivatives}.Delete(img)
+}
+
+func (j *jbodBackend) fullPath(ri imageSpecifier) string {
+	d, err := j.disk(ri)
+	if err != nil {
+		return ""
+	}
+	return d.fullPath(ri)
+}
+
+// a disk is working if it's the one we think it is, and we can
+// write to it. if we never managed to give it an ID, whatever ID
+// turns up is the one.
+func (d *jbodDisk) works() error {
+	fi, err := os.Stat(d.Root)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", d.Root)
+	}
+	id, err := readDiskID(d.Root)
+	if err != nil {
+		return fmt.Errorf("no disk ID: %w", err)
+	}
+	if d.id == "" {
+		d.id = id
+	}
+	if id != d.id {
+		return fmt.Errorf("expected disk %s, found %s", d.id, id)
+	}
+	f, err := os.CreateTemp(d.Root, "diskcheck-*.tmp")
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
+
+// Check looks at each disk and deals with any that have
+// failed or come back since last time
+func (j *jbodBackend) Check() {
+	var lost, found []string
+	j.mu.Lock()
+	for _, d := range j.disks {
+		err := d.works()
+		if err != nil && !d.failed {
+			d.failed = true
+			lost = append(lost, d.Root)
+			_ = j.sl.Log("level", "ERR", "msg", "disk failed", "disk", d.Root, "error", err.Error())
+		}
+		if err == nil && d.failed {
+			d.failed = false
+			found = append(found, d.Root)
+			_ = j.sl.Log("level", "INFO", "msg", "disk is back", "disk", d.Root)
+		}
+	}
+	j.mu.Unlock()
+
+	if len(lost) > 0 {
+		j.Metrics.DiskFailures(len(lost))
+		j.forgetMissing()
+	}
+	for _, root := range found {
+		j.reindex(root)
+	}
+}
+
+// drop everything from the index that isn't on a working disk
+func (j *jbodBackend) forgetMissing() {
+	var forgotten = 0
+	for _, e := range j.Index.Entries() {
+		h, err := hashFromString(e.Hash, "")
+		if err != nil {
+			continue
+		}
+		ri := imageSpecifier{Hash: h, Extension: e.Extension}
+		if _, ok := j.locate(ri); ok {
+			continue
+		}
+		_ = j.Index.Remove(h)
+		forgotten++
+	}
+	_ = j.sl.Log("level", "WARN", "msg", "forgot images on failed disks", "images", forgotten)
+}
+
+// put whatever is on a returning disk back in the index
+func (j *jbodBackend) reindex(root string) {
+	err := walkFullSize(root, func(ri imageSpecifier, path string) error {
+		if j.Index.Has(ri) {
+			return nil
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil
+		}
+		return j.Index.AddFull(ri, fi.Size())
+	})
+	if err != nil {
+		_ = j.sl.Log("level", "WARN", "msg", "could not reindex disk", "disk", root, "error", err.Error())
+	}
+}
+
+// run this as a goroutine
+func (j *jbodBackend) Run() {
+	for {
+		time.Sleep(diskCheckInterval)
+		j.Check()
+	}
+}
+
+// Usage reports on each disk
+func (j *jbodBackend) Usage() []diskStatus {
+	j.mu.RLock()
+	disks := make([]jbodDisk, len(j.disks))
+	for i, d := range j.disks {
+		disks[i] = *d
+	}
+	j.mu.RUnlock()
+
+	statuses := make([]diskStatus, 0, len(disks))
+	for _, d := range disks {
+		statuses = append(statuses, newDiskStatus(d.Root, d.failed))
+	}
+	return statuses
+}
+
+func newDiskStatus(root string, failed bool) diskStatus {
+	ds := diskStatus{Root: root, Failed: failed}
+	total, free, err := diskUsage(root)
+	if err != nil {
+		ds.Error = err.Error()
+		return ds
+	}
+	ds.Total, ds.Free, ds.Used = total, free, total-free
+	return ds
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/thraxil/resize"
+)
+
+func newTestJbod(t *testing.T, n int) (*jbodBackend, []string) {
+	t.Helper()
+	var roots []string
+	for i := 0; i < n; i++ {
+		roots = append(roots, t.TempDir()+"/")
+	}
+	idx, err := openImageIndex(filepath.Join(t.TempDir(), "index.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = idx.Close() })
+	return newJbodBackend(roots, idx, log.NewNopLogger()), roots
+}
+
+func jbodSpec(t *testing.T, s string) imageSpecifier {
+	t.Helper()
+	h, err := hashFromString(s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return imageSpecifier{h, resize.MakeSizeSpec("full"), ".jpg"}
+}
+
+func Test_jbodBackend(t *testing.T) {
+	j, roots := newTestJbod(t, 3)
+	hashes := []string{
+		"fb682e05b9be61797601e60165825c0b089f755e",
+		"0051ec03fb813e8731224ee06feee7c828ceae24",
+		"1234567890123456789012345678901234567890",
+		"abcdefabcdefabcdefabcdefabcdefabcdefabcd",
+		"9999999999999999999999999999999999999999",
+		"5555555555555555555555555555555555555555",
+	}
+	used := make(map[string]bool)
+	for _, s := range hashes {
+		ri := jbodSpec(t, s)
+		if err := j.WriteFull(ri, io.NopCloser(strings.NewReader(s))); err != nil {
+			t.Fatal(err)
+		}
+		pref, _ := j.preferred(ri.Hash)
+		if _, err := os.Stat(ri.fullSizePath(pref)); err != nil {
+			t.Errorf("%s should have been written to its preferred disk", s)
+		}
+		used[pref] = true
+
+		if !j.Exists(ri) {
+			t.Errorf("%s should exist", s)
+		}
+		r, err := j.Read(ri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data := readAndClose(t, r); string(data) != s {
+			t.Errorf("read back %q, expected %q", string(data), s)
+		}
+	}
+	if len(used) < 2 {
+		t.Errorf("expected images to be spread across disks, only used %v", used)
+	}
+
+	// an image that was put somewhere else is still found
+	ri := jbodSpec(t, "2222222222222222222222222222222222222222")
+	pref, _ := j.preferred(ri.Hash)
+	other := roots[0]
+	if other == pref {
+		other = roots[1]
+	}
+	if err := (diskBackend{Root: other, Index: j.Index}).WriteFull(ri, io.NopCloser(strings.NewReader("elsewhere"))); err != nil {
+		t.Fatal(err)
+	}
+	if root, ok := j.locate(ri); !ok || root != other {
+		t.Errorf("expected to find it on %s, got %s", other, root)
+	}
+	if !strings.HasPrefix(j.fullPath(ri), other) {
+		t.Errorf("writes should go where the image already is, got %s", j.fullPath(ri))
+	}
+}
+
+func Test_jbodBackendFailedDisk(t *testing.T) {
+	j, roots := newTestJbod(t, 2)
+	// the disks' names are random, so keep going until at least
+	// one image lands on the first one
+	var onFirst imageSpecifier
+	for i := 0; i < 5 || onFirst.Hash == nil; i++ {
+		if i > 100 {
+			t.Fatal("expected at least one image on the first disk")
+		}
+		s := fmt.Sprintf("%x", sha1.Sum([]byte{byte(i)}))
+		ri := jbodSpec(t, s)
+		if err := j.WriteFull(ri, io.NopCloser(strings.NewReader(s))); err != nil {
+			t.Fatal(err)
+		}
+		if pref, _ := j.preferred(ri.Hash); pref == roots[0] {
+			onFirst = ri
+		}
+	}
+
+	// pull the disk out, leaving behind the empty directory
+	// that it was mounted on
+	gone := strings.TrimSuffix(roots[0], "/") + ".gone"
+	if err := os.Rename(roots[0], gone); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(roots[0], 0755); err != nil {
+		t.Fatal(err)
+	}
+	j.Check()
+	if got := j.Roots(); len(got) != 1 || got[0] != roots[1] {
+		t.Errorf("expected only the second disk to be working, got %v", got)
+	}
+	if j.Index.Has(onFirst) {
+		t.Error("images on the failed disk should be dropped from the index")
+	}
+	if j.Exists(onFirst) {
+		t.Error("images on the failed disk should no longer exist")
+	}
+	statuses := j.Usage()
+	if len(statuses) != 2 || !statuses[0].Failed || statuses[1].Failed {
+		t.Errorf("unexpected disk statuses: %+v", statuses)
+	}
+
+	// a different disk isn't it either
+	if err := os.WriteFile(filepath.Join(roots[0], diskIDFile), []byte("someone-else\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j.Check()
+	if len(j.Roots()) != 1 {
+		t.Errorf("a disk with a different ID shouldn't count, got %v", j.Roots())
+	}
+
+	// and put it back
+	if err := os.RemoveAll(roots[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(gone, roots[0]); err != nil {
+		t.Fatal(err)
+	}
+	j.Check()
+	if len(j.Roots()) != 2 {
+		t.Errorf("expected both disks to be working again, got %v", j.Roots())
+	}
+	if !j.Index.Has(onFirst) {
+		t.Error("images on a returning disk should be indexed again")
+	}
+}
+
+func Test_formatBytes(t *testing.T) {
+	cases := []struct {
+		n        uint64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 * 1024 * 1024 * 1024, "5.0 GiB"},
+	}
+	for _, c := range cases {
+		if got := formatBytes(c.n); got != c.expected {
+			t.Errorf("formatBytes(%d) = %q, expected %q", c.n, got, c.expected)
+		}
+	}
+}
+
+func Test_setUpDisk(t *testing.T) {
+	root := t.TempDir()
+	id, err := setUpDisk(root)
+	if err != nil || id == "" {
+		t.Fatalf("expected a new ID, got %q %v", id, err)
+	}
+	again, err := setUpDisk(root)
+	if err != nil || again != id {
+		t.Errorf("a disk should keep its ID, got %q %v", again, err)
+	}
+	if _, err := readDiskID(t.TempDir()); !os.IsNotExist(err) {
+		t.Errorf("a directory that was never set up shouldn't have an ID, got %v", err)
+	}
+}
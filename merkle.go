@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/thraxil/resize"
+)
+
+// how many hex characters of the hash make up a leaf's prefix.
+// a depth of 3 gives us 4096 leaves.
+const merkleDepth = 3
+
+const hexDigits = "0123456789abcdef"
+
+type merkleEntry struct {
+	Hash      string `json:"hash"`
+	Extension string `json:"extension"`
+}
+
+// one node of the tree, as exchanged between nodes. Interior
+// nodes list their children's digests, leaves list their hashes.
+type merkleNode struct {
+	Prefix   string            `json:"prefix"`
+	Digest   string            `json:"digest"`
+	Children map[string]string `json:"children,omitempty"`
+	Entries  []merkleEntry     `json:"entries,omitempty"`
+}
+
+// merkleTree is a 16-ary tree over a set of image hashes, keyed
+// by hash prefix. Two nodes holding the same set of images will
+// have the same root digest, and where they differ they can
+// find out which prefixes to look at without sending every hash.
+type merkleTree struct {
+	leaves  map[string][]merkleEntry
+	digests map[string]string
+}
+
+func buildMerkleTree(entries []merkleEntry) *merkleTree {
+	t := &merkleTree{
+		leaves:  make(map[string][]merkleEntry),
+		digests: make(map[string]string),
+	}
+	for _, e := range entries {
+		if len(e.Hash) < merkleDepth {
+			continue
+		}
+		p := e.Hash[:merkleDepth]
+		t.leaves[p] = append(t.leaves[p], e)
+	}
+	for p := range t.leaves {
+		sort.Slice(t.leaves[p], func(i, j int) bool {
+			return t.leaves[p][i].Hash < t.leaves[p][j].Hash
+		})
+	}
+	t.digest("")
+	return t
+}
+
+// empty subtrees have an empty digest so they are cheap to skip
+func (t *merkleTree) digest(prefix string) string {
+	if d, ok := t.digests[prefix]; ok {
+		return d
+	}
+	h := sha1.New()
+	var empty = true
+	if len(prefix) == merkleDepth {
+		for _, e := range t.leaves[prefix] {
+			_, _ = io.WriteString(h, e.Hash+e.Extension+"\n")
+			empty = false
+		}
+	} else {
+		for _, c := range hexDigits {
+			d := t.digest(prefix + string(c))
+			if d != "" {
+				empty = false
+			}
+			_, _ = io.WriteString(h, d+"\n")
+		}
+	}
+	var d string
+	if !empty {
+		d = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	t.digests[prefix] = d
+	return d
+}
+
+func (t *merkleTree) Root() string {
+	return t.digest("")
+}
+
+func (t *merkleTree) Node(prefix string) merkleNode {
+	n := merkleNode{Prefix: prefix, Digest: t.digest(prefix)}
+	if len(prefix) >= merkleDepth {
+		n.Entries = t.leaves[prefix]
+		return n
+	}
+	n.Children = make(map[string]string)
+	for _, c := range hexDigits {
+		if d := t.digest(prefix + string(c)); d != "" {
+			n.Children[string(c)] = d
+		}
+	}
+	return n
+}
+
+// entries under the prefix
+func (t *merkleTree) Entries(prefix string) []merkleEntry {
+	var entries []merkleEntry
+	for p, es := range t.leaves {
+		if strings.HasPrefix(p, prefix) {
+			entries = append(entries, es...)
+		}
+	}
+	return entries
+}
+
+// how long a tree is good for
+const merkleTreeTTL = 30 * time.Second
+
+var errUnknownPeer = errors.New("not a member of the cluster")
+
+type cachedTree struct {
+	tree  *merkleTree
+	built time.Time
+}
+
+// antiEntropy periodically compares what we hold with each of
+// the nodes that share ownership of the same hashes, and pushes
+// them anything they are missing.
+type antiEntropy struct {
+	c  *cluster
+	s  siteConfig
+	sl log.Logger
+
+	mu    sync.Mutex
+	trees map[string]cachedTree
+}
+
+func newAntiEntropy(c *cluster, s siteConfig, sl log.Logger) *antiEntropy {
+	return &antiEntropy{c: c, s: s, sl: sl, trees: make(map[string]cachedTree)}
+}
+
+func (a *antiEntropy) localImages() []merkleEntry {
+	var entries []merkleEntry
+	// until it's complete, the index may be missing whatever was
+	// on disk before it was turned on
+	if a.s.Index.Complete() {
+		for _, e := range a.s.Index.Entries() {
+			entries = append(entries, merkleEntry{e.Hash, e.Extension})
+		}
+		return entries
+	}
+	err := a.s.walkFullSize(func(ri imageSpecifier, path string) error {
+		entries = append(entries, merkleEntry{ri.Hash.String(), ri.Extension})
+		return nil
+	})
+	if err != nil {
+		_ = a.sl.Log("level", "WARN", "msg", "error listing local images", "error", err.Error())
+	}
+	return entries
+}
+
+// the images that both we and the peer should have a copy of
+func (a *antiEntropy) sharedWith(peer string) []merkleEntry {
+	ring := a.c.WriteRing()
+	me := a.c.GetMyself().UUID
+	var shared []merkleEntry
+	for _, e := range a.localImages() {
+		var mine, theirs bool
+		for _, uuid := range ringOwners(e.Hash, ring, a.s.Replication) {
+			mine = mine || uuid == me
+			theirs = theirs || uuid == peer
+		}
+		if mine && theirs {
+			shared = append(shared, e)
+		}
+	}
+	return shared
+}
+
+// building the tree means looking at every image we have, so
+// hang on to it for a little while. a peer drilling down will
+// ask for several nodes of it in quick succession.
+func (a *antiEntropy) tree(peer string) *merkleTree {
+	return a.cachedTree(peer, func() []merkleEntry { return a.sharedWith(peer) })
+}
+
+// a tree of everything we hold, for the placement report. it is
+// cached along with the per-peer trees; no peer has an empty UUID.
+func (a *antiEntropy) inventory() *merkleTree {
+	return a.cachedTree("", a.localImages)
+}
+
+func (a *antiEntropy) cachedTree(key string, entries func() []merkleEntry) *merkleTree {
+	a.mu.Lock()
+	ct, ok := a.trees[key]
+	a.mu.Unlock()
+	if ok && time.Since(ct.built) < merkleTreeTTL {
+		return ct.tree
+	}
+	t := buildMerkleTree(entries())
+	a.mu.Lock()
+	// and nothing else hangs on for any longer
+	for k, ct := range a.trees {
+		if time.Since(ct.built) >= merkleTreeTTL {
+			delete(a.trees, k)
+		}
+	}
+	a.trees[key] = cachedTree{t, time.Now()}
+	a.mu.Unlock()
+	return t
+}
+
+// Node returns the node of our tree for the given peer. Only
+// nodes that we know about get one, since every peer costs us
+// a tree.
+func (a *antiEntropy) Node(peer, prefix string) (merkleNode, error) {
+	if len(prefix) > merkleDepth || strings.Trim(prefix, hexDigits) != "" {
+		return merkleNode{}, fmt.Errorf("bad prefix: %s", prefix)
+	}
+	if !a.inRing(peer) {
+		return merkleNode{}, fmt.Errorf("%w: %s", errUnknownPeer, peer)
+	}
+	return a.tree(peer).Node(prefix), nil
+}
+
+func (a *antiEntropy) inRing(uuid string) bool {
+	for _, n := range a.c.NeighborsInclusive() {
+		if n.UUID == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+// run this as a goroutine
+func (a *antiEntropy) Run(baseTime int) {
+	_ = a.sl.Log("level", "INFO", "msg", "starting anti-entropy")
+	for {
+		jitter := rand.Intn(30)
+		time.Sleep(time.Duration(baseTime+jitter) * time.Second)
+		for _, n := range a.c.WriteableNeighbors() {
+			if n.UUID == a.c.GetMyself().UUID {
+				continue
+			}
+			repaired, err := a.syncWith(context.Background(), n)
+			if err != nil {
+				_ = a.sl.Log("level", "WARN", "msg", "anti-entropy failed",
+					"node", n.Nickname, "error", err.Error())
+				continue
+			}
+			_ = a.sl.Log("level", "INFO", "msg", "anti-entropy finished",
+				"node", n.Nickname, "repaired", repaired)
+		}
+	}
+}
+
+// syncWith finds the images that the peer should have but
+// doesn't and stashes them there. Anything we are missing is
+// the peer's job to send us on its own round.
+func (a *antiEntropy) syncWith(ctx context.Context, n nodeData) (int, error) {
+	mine := a.tree(n.UUID)
+	missing, err := a.diff(ctx, n, mine, "")
+	if err != nil {
+		return 0, err
+	}
+	var repaired = 0
+	for _, e := range missing {
+		h, err := hashFromString(e.Hash, "")
+		if err != nil {
+			continue
+		}
+		ri := imageSpecifier{h, resize.MakeSizeSpec("full"), e.Extension}
+		if n.Stash(ctx, ri, "", a.s.Backend) {
+			repaired++
+			a.s.Metrics.AntiEntropyRepair()
+			a.s.Events.Fire(eventRepairCompleted, eventData(ri, n.Nickname))
+			replicaAdded(ctx, a.c, a.s, ri)
+		} else {
+			_ = a.sl.Log("level", "WARN", "msg", "could not repair replica",
+				"node", n.Nickname, "image", e.Hash)
+		}
+	}
+	return repaired, nil
+}
+
+// walk down the tree wherever the digests disagree and collect
+// the entries that we have and the peer doesn't
+func (a *antiEntropy) diff(ctx context.Context, n nodeData, mine *merkleTree, prefix string) ([]merkleEntry, error) {
+	if mine.digest(prefix) == "" {
+		// nothing of ours down here
+		return nil, nil
+	}
+	theirs, err := n.MerkleNode(ctx, a.c.GetMyself().UUID, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if theirs.Digest == mine.digest(prefix) {
+		return nil, nil
+	}
+	if theirs.Digest == "" {
+		// they have nothing at all under here
+		return mine.Entries(prefix), nil
+	}
+	if len(prefix) >= merkleDepth {
+		have := make(map[string]bool)
+		var found []string
+		for _, e := range theirs.Entries {
+			have[e.Hash+e.Extension] = true
+			found = append(found, e.Hash)
+		}
+		// whatever they have, we don't need to go on thinking
+		// that nobody does
+		a.c.Found(found...)
+		var missing []merkleEntry
+		for _, e := range mine.leaves[prefix] {
+			if !have[e.Hash+e.Extension] {
+				missing = append(missing, e)
+			}
+		}
+		return missing, nil
+	}
+	var missing []merkleEntry
+	for _, c := range hexDigits {
+		child := prefix + string(c)
+		d := mine.digest(child)
+		if d == "" || d == theirs.Children[string(c)] {
+			continue
+		}
+		if theirs.Children[string(c)] == "" {
+			missing = append(missing, mine.Entries(child)...)
+			continue
+		}
+		m, err := a.diff(ctx, n, mine, child)
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, m...)
+	}
+	return missing, nil
+}
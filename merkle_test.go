@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/thraxil/resize"
+)
+
+func Test_merkleTree(t *testing.T) {
+	a := buildMerkleTree([]merkleEntry{
+		{"fb682e05b9be61797601e60165825c0b089f755e", ".jpg"},
+		{"0051ec03fb813e8731224ee06feee7c828ceae22", ".png"},
+	})
+	b := buildMerkleTree([]merkleEntry{
+		{"0051ec03fb813e8731224ee06feee7c828ceae22", ".png"},
+		{"fb682e05b9be61797601e60165825c0b089f755e", ".jpg"},
+	})
+	if a.Root() == "" || a.Root() != b.Root() {
+		t.Error("same entries should give the same root")
+	}
+	c := buildMerkleTree([]merkleEntry{
+		{"0051ec03fb813e8731224ee06feee7c828ceae22", ".png"},
+	})
+	if a.Root() == c.Root() {
+		t.Error("different entries should give a different root")
+	}
+	if a.digest("f") == "" || a.digest("f") == c.digest("f") {
+		t.Error("the 'f' subtree is where they differ")
+	}
+	if a.digest("0") != c.digest("0") {
+		t.Error("the '0' subtree should be the same")
+	}
+	if buildMerkleTree(nil).Root() != "" {
+		t.Error("empty tree should have an empty root")
+	}
+
+	n := a.Node("fb6")
+	if len(n.Entries) != 1 || n.Entries[0].Extension != ".jpg" {
+		t.Errorf("unexpected leaf: %+v", n)
+	}
+	n = a.Node("")
+	if len(n.Children) != 2 {
+		t.Errorf("expected two non-empty children: %+v", n)
+	}
+}
+
+func Test_antiEntropyNodeBadPrefix(t *testing.T) {
+	_, c := makeNewClusterData([]nodeData{})
+	a := newAntiEntropy(c, siteConfig{Replication: 1}, log.NewNopLogger())
+	if _, err := a.Node("peer", "xyz"); err == nil {
+		t.Error("not hex")
+	}
+	if _, err := a.Node("peer", "abcd"); err == nil {
+		t.Error("too deep")
+	}
+}
+
+func Test_antiEntropyNodeUnknownPeer(t *testing.T) {
+	c, a := makeAntiEntropyNode(t, "node-a", "fb682e05b9be61797601e60165825c0b089f755e")
+	c.AddNeighbor(nodeData{Nickname: "node-b", UUID: "node-b", Writeable: true})
+
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/merkle/made-up/", nil)
+	r.SetPathValue("uuid", "made-up")
+	merkleHandler(rec, r, sitecontext{AntiEntropy: a, SL: log.NewNopLogger()})
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected a 404 for a node we don't know, got %d", rec.Code)
+	}
+	if _, err := a.Node("node-b", ""); err != nil {
+		t.Fatal(err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.trees["made-up"]; ok || len(a.trees) != 1 {
+		t.Errorf("only the known peer should get a tree: %v", a.trees)
+	}
+}
+
+func Test_antiEntropyEvictsStaleTrees(t *testing.T) {
+	_, a := makeAntiEntropyNode(t, "node-a")
+	a.trees["gone"] = cachedTree{buildMerkleTree(nil), time.Now().Add(-merkleTreeTTL)}
+	a.inventory()
+	if _, ok := a.trees["gone"]; ok {
+		t.Error("a stale tree should have been dropped")
+	}
+}
+
+func makeAntiEntropyNode(t *testing.T, uuid string, hashes ...string) (*cluster, *antiEntropy) {
+	root := t.TempDir() + "/"
+	idx, err := openImageIndex(filepath.Join(root, "index.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = idx.Close() })
+	b := diskBackend{Root: root, Index: idx}
+	for _, h := range hashes {
+		ah, _ := hashFromString(h, "")
+		ri := imageSpecifier{ah, resize.MakeSizeSpec("full"), ".jpg"}
+		if err := b.WriteFull(ri, io.NopCloser(strings.NewReader(h))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newCluster(nodeData{Nickname: uuid, UUID: uuid, Writeable: true})
+	s := siteConfig{UploadDirectory: root, Replication: 2, Backend: b, Index: idx}
+	return c, newAntiEntropy(c, s, log.NewNopLogger())
+}
+
+func Test_antiEntropySync(t *testing.T) {
+	h1 := "fb682e05b9be61797601e60165825c0b089f755e"
+	h2 := "0051ec03fb813e8731224ee06feee7c828ceae22"
+	ca, a := makeAntiEntropyNode(t, "node-a", h1, h2)
+	cb, b := makeAntiEntropyNode(t, "node-b", h2)
+
+	var stashes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/stash/") {
+			atomic.AddInt32(&stashes, 1)
+			_, _ = w.Write([]byte("ok"))
+			return
+		}
+		// /merkle/{uuid}/{prefix}
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/merkle/"), "/", 2)
+		r.SetPathValue("uuid", parts[0])
+		r.SetPathValue("prefix", parts[1])
+		merkleHandler(w, r, sitecontext{AntiEntropy: b, SL: log.NewNopLogger()})
+	}))
+	defer server.Close()
+
+	nb := nodeData{Nickname: "node-b", UUID: "node-b", BaseURL: server.URL, Writeable: true}
+	ca.AddNeighbor(nb)
+	cb.AddNeighbor(nodeData{Nickname: "node-a", UUID: "node-a", Writeable: true})
+
+	repaired, err := a.syncWith(context.Background(), nb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired != 1 || atomic.LoadInt32(&stashes) != 1 {
+		t.Errorf("expected exactly one repair, got %d (%d stashes)", repaired, stashes)
+	}
+}
+
+func Test_antiEntropyLocalImagesUpgradedNode(t *testing.T) {
+	root := t.TempDir() + "/"
+	h1 := "fb682e05b9be61797601e60165825c0b089f755e"
+	ah, _ := hashFromString(h1, "")
+	// written before there was an index
+	_ = newDiskBackend(root).WriteFull(imageSpecifier{ah, resize.MakeSizeSpec("full"), ".jpg"},
+		io.NopCloser(strings.NewReader(h1)))
+	idx, err := openImageIndex(filepath.Join(root, "index.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = idx.Close() }()
+	_, c := makeNewClusterData([]nodeData{})
+	a := newAntiEntropy(c, siteConfig{UploadDirectory: root, Index: idx}, log.NewNopLogger())
+
+	if got := a.localImages(); len(got) != 1 || got[0].Hash != h1 {
+		t.Errorf("an incomplete index shouldn't hide what's on disk: %v", got)
+	}
+	if _, err := backfillIndex(idx, root); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.localImages(); len(got) != 1 {
+		t.Errorf("expected the image from the index, got %v", got)
+	}
+}
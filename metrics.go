@@ -0,0 +1,524 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics holds everything we export to Prometheus. It's made once
+// in main and handed to whatever needs it (tests make their own,
+// with their own registry, so they can check what was recorded).
+//
+// All the methods are safe to call on a nil *metrics, which just
+// doesn't record anything.
+type metrics struct {
+	requestDuration *prometheus.HistogramVec
+	responseBytes   *prometheus.CounterVec
+
+	resizeDuration *prometheus.HistogramVec
+	resizeQueue    prometheus.Gauge
+	resizedImages  *prometheus.CounterVec
+	servedImages   prometheus.Counter
+	readRepairs    prometheus.Counter
+
+	peerDuration     *prometheus.HistogramVec
+	gossipRTT        *prometheus.HistogramVec
+	neighbors        prometheus.Gauge
+	neighborFailures prometheus.Counter
+	missCacheHits    prometheus.Counter
+
+	verifierImages    *prometheus.CounterVec
+	verifierBytes     prometheus.Counter
+	verifierCorrupted *prometheus.CounterVec
+	verifierPasses    prometheus.Counter
+
+	rebalancedImages   *prometheus.CounterVec
+	replicaCleanups    prometheus.Counter
+	rebalancerPasses   prometheus.Counter
+	antiEntropyRepairs prometheus.Counter
+	handoffReplays     prometheus.Counter
+	diskFailures       prometheus.Counter
+
+	cacheRequests  *prometheus.CounterVec
+	cacheBytes     *prometheus.GaugeVec
+	cacheEvictions *prometheus.CounterVec
+	// for the hit ratio of resized images
+	derivativeHits, derivativeLookups atomic.Int64
+
+	purges            *prometheus.CounterVec
+	webhookDeliveries *prometheus.CounterVec
+	activityDropped   prometheus.Counter
+
+	placementImages          prometheus.Gauge
+	placementUnderReplicated prometheus.Gauge
+	placementOverReplicated  prometheus.Gauge
+	placementMisplaced       prometheus.Gauge
+	placementNodeImages      *prometheus.GaugeVec
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	started := time.Now()
+	m := &metrics{
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "reticulum_http_request_duration_seconds",
+			Help:    "Time taken to handle HTTP requests, by route and status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		responseBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reticulum_http_response_bytes_total",
+			Help: "Bytes written in HTTP responses, by route.",
+		}, []string{"route"}),
+		resizeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "reticulum_resize_duration_seconds",
+			Help:    "Time taken to resize an image, by size and format.",
+			Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		}, []string{"size", "format"}),
+		resizeQueue: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "reticulum_resize_queue_length",
+			Help: "Resize jobs waiting on a worker.",
+		}),
+		resizedImages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reticulum_resized_images_total",
+			Help: "Images resized to serve a request, by result.",
+		}, []string{"result"}),
+		servedImages: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "reticulum_served_images_total",
+			Help: "Images served.",
+		}),
+		readRepairs: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "reticulum_read_repairs_total",
+			Help: "Missing images fetched back from the cluster when they were asked for.",
+		}),
+		peerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "reticulum_peer_request_duration_seconds",
+			Help:    "Time taken to stash an image on, or retrieve one from, another node.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"peer", "op", "result"}),
+		gossipRTT: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "reticulum_gossip_round_trip_seconds",
+			Help:    "Round trip time of gossip pings to other nodes.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"peer", "result"}),
+		neighbors: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "reticulum_neighbors",
+			Help: "Nodes in the cluster that we know about.",
+		}),
+		neighborFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "reticulum_neighbor_failures_total",
+			Help: "Times another node couldn't be reached.",
+		}),
+		missCacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "reticulum_miss_cache_hits_total",
+			Help: "Requests for images that nobody had recently, so the cluster wasn't asked again.",
+		}),
+		verifierImages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reticulum_verifier_images_total",
+			Help: "Images checked by the verifier, by result.",
+		}, []string{"result"}),
+		verifierBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "reticulum_verifier_bytes_total",
+			Help: "Bytes read and hashed by the verifier.",
+		}),
+		verifierCorrupted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reticulum_verifier_corrupted_images_total",
+			Help: "Corrupted images found by the verifier, by whether they could be repaired.",
+		}, []string{"result"}),
+		verifierPasses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "reticulum_verifier_passes_total",
+			Help: "Complete passes of the verifier over every image.",
+		}),
+		rebalancedImages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reticulum_rebalanced_images_total",
+			Help: "Images checked for a full set of replicas, by result.",
+		}, []string{"result"}),
+		replicaCleanups: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "reticulum_replica_cleanups_total",
+			Help: "Excess replicas removed from this node.",
+		}),
+		rebalancerPasses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "reticulum_rebalancer_passes_total",
+			Help: "Rebalances after the ring changed.",
+		}),
+		antiEntropyRepairs: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "reticulum_anti_entropy_repairs_total",
+			Help: "Missing replicas sent to other nodes by anti-entropy.",
+		}),
+		handoffReplays: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "reticulum_handoff_replays_total",
+			Help: "Hinted images handed off to the node they were meant for.",
+		}),
+		diskFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "reticulum_disk_failures_total",
+			Help: "Disks that have stopped working.",
+		}),
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reticulum_cache_requests_total",
+			Help: "Lookups in each cache, by whether they were a hit or a miss.",
+		}, []string{"cache", "result"}),
+		cacheBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "reticulum_cache_bytes",
+			Help: "Bytes held in each cache.",
+		}, []string{"cache"}),
+		cacheEvictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reticulum_cache_evictions_total",
+			Help: "Entries removed from each cache to stay under its budget.",
+		}, []string{"cache"}),
+		purges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reticulum_purges_total",
+			Help: "Purge requests for the CDN, by result.",
+		}, []string{"result"}),
+		webhookDeliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reticulum_webhook_deliveries_total",
+			Help: "Events for webhooks, by result.",
+		}, []string{"result"}),
+		activityDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "reticulum_activity_dropped_total",
+			Help: "Activity events that a slow subscriber missed.",
+		}),
+		placementImages: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "reticulum_placement_images",
+			Help: "Distinct images held anywhere in the cluster.",
+		}),
+		placementUnderReplicated: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "reticulum_placement_under_replicated_images",
+			Help: "Images with fewer copies than Replication.",
+		}),
+		placementOverReplicated: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "reticulum_placement_over_replicated_images",
+			Help: "Images with more copies than Replication.",
+		}),
+		placementMisplaced: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "reticulum_placement_misplaced_images",
+			Help: "Images held by a node that WriteOrder doesn't give them to.",
+		}),
+		placementNodeImages: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "reticulum_placement_node_images",
+			Help: "Images held by each node, as of its last inventory.",
+		}, []string{"node"}),
+	}
+	derivativeHitRatio := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "reticulum_derivative_hit_ratio",
+		Help: "Fraction of requests for resized images that didn't need a resize.",
+	}, func() float64 {
+		lookups := m.derivativeLookups.Load()
+		if lookups == 0 {
+			return 0
+		}
+		return float64(m.derivativeHits.Load()) / float64(lookups)
+	})
+	uptime := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "reticulum_uptime_seconds",
+		Help: "Time since this node started.",
+	}, func() float64 { return time.Since(started).Seconds() })
+	reg.MustRegister(
+		m.requestDuration, m.responseBytes,
+		m.resizeDuration, m.resizeQueue, m.resizedImages, m.servedImages, m.readRepairs,
+		m.peerDuration, m.gossipRTT, m.neighbors, m.neighborFailures, m.missCacheHits,
+		m.verifierImages, m.verifierBytes, m.verifierCorrupted, m.verifierPasses,
+		m.rebalancedImages, m.replicaCleanups, m.rebalancerPasses,
+		m.antiEntropyRepairs, m.handoffReplays, m.diskFailures,
+		m.cacheRequests, m.cacheBytes, m.cacheEvictions, derivativeHitRatio,
+		m.purges, m.webhookDeliveries, m.activityDropped,
+		m.placementImages, m.placementUnderReplicated, m.placementOverReplicated,
+		m.placementMisplaced, m.placementNodeImages,
+		uptime,
+	)
+	return m
+}
+
+// the route a request was handled by, as registered with the mux,
+// which (unlike the path) has a bounded number of values
+func requestRoute(r *http.Request) string {
+	pattern := r.Pattern
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		pattern = path
+	}
+	if pattern == "" {
+		return "other"
+	}
+	return pattern
+}
+
+func (m *metrics) Request(r *http.Request, status int, bytes int64, d time.Duration) {
+	if m == nil {
+		return
+	}
+	route := requestRoute(r)
+	m.requestDuration.WithLabelValues(route, r.Method, strconv.Itoa(status)).Observe(d.Seconds())
+	m.responseBytes.WithLabelValues(route).Add(float64(bytes))
+}
+
+func (m *metrics) Resize(size, extension string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.resizeDuration.WithLabelValues(size, strings.TrimPrefix(extension, ".")).Observe(d.Seconds())
+}
+
+// Peer records how long a stash to, or retrieve from, another node
+// took
+func (m *metrics) Peer(op string, n nodeData, ok bool, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.peerDuration.WithLabelValues(n.Nickname, op, resultLabel(ok)).Observe(d.Seconds())
+}
+
+func (m *metrics) Gossip(n nodeData, ok bool, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.gossipRTT.WithLabelValues(n.Nickname, resultLabel(ok)).Observe(d.Seconds())
+}
+
+// Verified records an image the verifier has read through. result
+// is "ok", "repaired" or "failed"
+func (m *metrics) Verified(result string, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.verifierImages.WithLabelValues(result).Inc()
+	m.verifierBytes.Add(float64(bytes))
+}
+
+// ResizeQueued adds to (or, once the resize is done, takes away
+// from) the number of resizes waiting
+func (m *metrics) ResizeQueued(n int) {
+	if m == nil {
+		return
+	}
+	m.resizeQueue.Add(float64(n))
+}
+
+func (m *metrics) Resized(ok bool) {
+	if m == nil {
+		return
+	}
+	m.resizedImages.WithLabelValues(resultLabel(ok)).Inc()
+}
+
+func (m *metrics) Served() {
+	if m == nil {
+		return
+	}
+	m.servedImages.Inc()
+}
+
+func (m *metrics) ReadRepaired() {
+	if m == nil {
+		return
+	}
+	m.readRepairs.Inc()
+}
+
+func (m *metrics) Neighbors(n int) {
+	if m == nil {
+		return
+	}
+	m.neighbors.Set(float64(n))
+}
+
+func (m *metrics) NeighborFailed() {
+	if m == nil {
+		return
+	}
+	m.neighborFailures.Inc()
+}
+
+func (m *metrics) MissCacheHit() {
+	if m == nil {
+		return
+	}
+	m.missCacheHits.Inc()
+}
+
+// Corrupted records a corrupted image the verifier found. result
+// is "repaired" or "unrepairable"
+func (m *metrics) Corrupted(result string) {
+	if m == nil {
+		return
+	}
+	m.verifierCorrupted.WithLabelValues(result).Inc()
+}
+
+func (m *metrics) VerifierPass() {
+	if m == nil {
+		return
+	}
+	m.verifierPasses.Inc()
+}
+
+// Rebalanced records whether an image had a full set of replicas
+// once the verifier or rebalancer was done with it
+func (m *metrics) Rebalanced(ok bool) {
+	if m == nil {
+		return
+	}
+	m.rebalancedImages.WithLabelValues(resultLabel(ok)).Inc()
+}
+
+func (m *metrics) ReplicaCleanedUp() {
+	if m == nil {
+		return
+	}
+	m.replicaCleanups.Inc()
+}
+
+func (m *metrics) RebalancerPass() {
+	if m == nil {
+		return
+	}
+	m.rebalancerPasses.Inc()
+}
+
+func (m *metrics) AntiEntropyRepair() {
+	if m == nil {
+		return
+	}
+	m.antiEntropyRepairs.Inc()
+}
+
+func (m *metrics) HandoffReplay() {
+	if m == nil {
+		return
+	}
+	m.handoffReplays.Inc()
+}
+
+func (m *metrics) DiskFailures(n int) {
+	if m == nil {
+		return
+	}
+	m.diskFailures.Add(float64(n))
+}
+
+// the caches, as they're labelled
+const (
+	derivativeCacheName = "derivative"
+	imageCacheName      = "image"
+	edgeCacheName       = "edge"
+)
+
+// CacheRequest records a lookup in one of the caches
+func (m *metrics) CacheRequest(cache string, hit bool) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheRequests.WithLabelValues(cache, result).Inc()
+	if cache == derivativeCacheName {
+		m.derivativeLookups.Add(1)
+		if hit {
+			m.derivativeHits.Add(1)
+		}
+	}
+}
+
+func (m *metrics) CacheBytes(cache string, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.cacheBytes.WithLabelValues(cache).Set(float64(bytes))
+}
+
+func (m *metrics) CacheEviction(cache string) {
+	if m == nil {
+		return
+	}
+	m.cacheEvictions.WithLabelValues(cache).Inc()
+}
+
+// Purge records what happened to a purge request. result is
+// "sent", "failed" or "dropped"
+func (m *metrics) Purge(result string) {
+	if m == nil {
+		return
+	}
+	m.purges.WithLabelValues(result).Inc()
+}
+
+// Webhook records what happened to n webhook deliveries. result is
+// "sent", "failed" or "dropped"
+func (m *metrics) Webhook(result string, n int) {
+	if m == nil {
+		return
+	}
+	m.webhookDeliveries.WithLabelValues(result).Add(float64(n))
+}
+
+func (m *metrics) ActivityDropped() {
+	if m == nil {
+		return
+	}
+	m.activityDropped.Inc()
+}
+
+func (m *metrics) Placement(sum placementSummary) {
+	if m == nil {
+		return
+	}
+	m.placementImages.Set(float64(sum.Images))
+	m.placementUnderReplicated.Set(float64(sum.UnderReplicated))
+	m.placementOverReplicated.Set(float64(sum.OverReplicated))
+	m.placementMisplaced.Set(float64(sum.Misplaced))
+	m.placementNodeImages.Reset()
+	for _, n := range sum.Nodes {
+		m.placementNodeImages.WithLabelValues(n.Nickname).Set(float64(n.Images))
+	}
+}
+
+func resultLabel(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "error"
+}
+
+// statusRecorder remembers what a handler sent, for the metrics
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Status() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
+
+// the activity stream needs to flush
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thraxil/resize"
+)
+
+// how many observations the histogram has with exactly these labels
+func sampleCount(t *testing.T, reg *prometheus.Registry, name string, labels map[string]string) uint64 {
+	t.Helper()
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	metric:
+		for _, m := range mf.GetMetric() {
+			if len(m.GetLabel()) != len(labels) {
+				continue
+			}
+			for _, l := range m.GetLabel() {
+				if labels[l.GetName()] != l.GetValue() {
+					continue metric
+				}
+			}
+			return m.GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
+
+func Test_metricsRequest(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	ctx := makeTestContextWithUploadDir(t.TempDir())
+	ctx.Cfg.Metrics = newMetrics(reg)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /image/{hash}/{size}/{filename}", makeHandler(
+		func(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+			_, _ = w.Write([]byte("not really an image"))
+		}, ctx))
+	mux.HandleFunc("GET /missing/", makeHandler(
+		func(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+			http.Error(w, "not found", http.StatusNotFound)
+		}, ctx))
+
+	for _, path := range []string{"/image/abc/full/image.jpg", "/image/def/100s/image.jpg", "/missing/"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	image := map[string]string{"route": "/image/{hash}/{size}/{filename}", "method": "GET", "status": "200"}
+	if n := sampleCount(t, reg, "reticulum_http_request_duration_seconds", image); n != 2 {
+		t.Errorf("expected both image requests under one route, got %d", n)
+	}
+	missing := map[string]string{"route": "/missing/", "method": "GET", "status": "404"}
+	if n := sampleCount(t, reg, "reticulum_http_request_duration_seconds", missing); n != 1 {
+		t.Errorf("expected the 404, got %d", n)
+	}
+	served := testutil.ToFloat64(ctx.Cfg.Metrics.responseBytes.WithLabelValues("/image/{hash}/{size}/{filename}"))
+	if served != float64(2*len("not really an image")) {
+		t.Errorf("wrong bytes served: %v", served)
+	}
+}
+
+func Test_metricsPeer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	reg := prometheus.NewRegistry()
+	_, c := makeNewClusterData([]nodeData{})
+	c.metrics = newMetrics(reg)
+	c.AddNeighbor(nodeData{Nickname: "neighbor1", UUID: "neighbor1-uuid", BaseURL: server.URL, Writeable: true})
+
+	h, _ := hashFromString("fb682e05b9be61797601e60165825c0b089f755e", "")
+	ri := &imageSpecifier{h, resize.MakeSizeSpec("full"), ".jpg"}
+	if _, err := c.RetrieveImage(context.Background(), ri); err == nil {
+		t.Fatal("expected an error")
+	}
+	labels := map[string]string{"peer": "neighbor1", "op": "retrieve", "result": "error"}
+	if n := sampleCount(t, reg, "reticulum_peer_request_duration_seconds", labels); n != 1 {
+		t.Errorf("expected the failed retrieve to be timed, got %d", n)
+	}
+}
+
+func Test_metricsVerified(t *testing.T) {
+	m := newMetrics(prometheus.NewRegistry())
+	m.Verified("ok", 100)
+	m.Verified("repaired", 50)
+	m.Verified("ok", 10)
+	if testutil.ToFloat64(m.verifierImages.WithLabelValues("ok")) != 2 ||
+		testutil.ToFloat64(m.verifierBytes) != 160 {
+		t.Error("wrong verifier throughput")
+	}
+}
+
+func Test_metricsCaches(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := newMetrics(reg)
+	m.CacheRequest(derivativeCacheName, true)
+	m.CacheRequest(derivativeCacheName, true)
+	m.CacheRequest(derivativeCacheName, true)
+	m.CacheRequest(derivativeCacheName, false)
+	m.CacheRequest(imageCacheName, false)
+	m.CacheBytes(edgeCacheName, 100)
+	if testutil.ToFloat64(m.cacheRequests.WithLabelValues(derivativeCacheName, "hit")) != 3 ||
+		testutil.ToFloat64(m.cacheRequests.WithLabelValues(imageCacheName, "miss")) != 1 ||
+		testutil.ToFloat64(m.cacheBytes.WithLabelValues(edgeCacheName)) != 100 {
+		t.Error("wrong cache counts")
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == "reticulum_derivative_hit_ratio" {
+			if v := mf.GetMetric()[0].GetGauge().GetValue(); v != 0.75 {
+				t.Errorf("expected a hit ratio of 0.75, got %v", v)
+			}
+			return
+		}
+	}
+	t.Error("the hit ratio should be exported")
+}
+
+func Test_metricsNil(t *testing.T) {
+	var m *metrics
+	m.Request(httptest.NewRequest("GET", "/", nil), 200, 10, time.Second)
+	m.Resize("100s", ".jpg", time.Second)
+	m.Peer("stash", nodeData{}, true, time.Second)
+	m.Gossip(nodeData{}, false, time.Second)
+	m.Verified("ok", 10)
+	m.Placement(placementSummary{})
+	m.CacheRequest(derivativeCacheName, true)
+	m.Purge("sent")
+	m.Webhook("dropped", 2)
+}
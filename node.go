@@ -15,6 +15,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -29,6 +30,10 @@ type nodeData struct {
 	BaseURL    string    `json:"base_url"`
 	Location   string    `json:"location"`
 	Writeable  bool      `json:"writeable"`
+	Draining   bool      `json:"draining"`
+	Full       bool      `json:"full"`
+	BytesUsed  uint64    `json:"bytes_used"`
+	BytesFree  uint64    `json:"bytes_free"`
 	LastSeen   time.Time `json:"last_seen"`
 	LastFailed time.Time `json:"last_failed"`
 }
@@ -50,6 +55,23 @@ func (n nodeData) LastFailedFormatted() string {
 	return n.LastFailed.Format("2006-01-02 15:04:05")
 }
 
+// how full the node's disks are, as a percentage
+func (n nodeData) UsedPercent() float64 {
+	total := n.BytesUsed + n.BytesFree
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n.BytesUsed) / float64(total)
+}
+
+func (n nodeData) CapacityFormatted() string {
+	if n.BytesUsed+n.BytesFree == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%s / %s (%.1f%%)",
+		formatBytes(n.BytesUsed), formatBytes(n.BytesUsed+n.BytesFree), n.UsedPercent())
+}
+
 func (n nodeData) hashKeys() []string {
 	keys := make([]string, REPLICAS)
 	h := sha1.New()
@@ -88,7 +110,9 @@ func (n nodeData) stashURL() string {
 	return n.goodBaseURL() + "/stash/"
 }
 
-func (n *nodeData) RetrieveImage(ctx context.Context, ri *imageSpecifier) (data []byte, err error) {
+// RetrieveImage fetches the image from the node. The caller must
+// close the returned body.
+func (n *nodeData) RetrieveImage(ctx context.Context, ri *imageSpecifier) (io.ReadCloser, error) {
 	req, err := http.NewRequest("GET", n.retrieveURL(ri), nil)
 	if err != nil {
 		return nil, err
@@ -103,16 +127,55 @@ func (n *nodeData) RetrieveImage(ctx context.Context, ri *imageSpecifier) (data
 	return n.processRetrieveImageResponse(resp)
 }
 
-func (n *nodeData) processRetrieveImageResponse(resp *http.Response) (data []byte, err error) {
-	defer func() {
-		if closeErr := resp.Body.Close(); closeErr != nil && err == nil {
-			err = closeErr
-		}
-	}()
+// HeadImage asks the node what it knows about an image, without
+// having it send (or make) it.
+func (n *nodeData) HeadImage(ctx context.Context, ri *imageSpecifier) (imageHead, error) {
+	req, err := http.NewRequest("HEAD", n.retrieveURL(ri), nil)
+	if err != nil {
+		return imageHead{}, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		n.LastFailed = time.Now()
+		return imageHead{}, err
+	}
+	_ = resp.Body.Close()
+	n.LastSeen = time.Now()
+	if resp.StatusCode == http.StatusNotFound {
+		return imageHead{}, errNotOnNode
+	}
+	if resp.StatusCode != http.StatusOK {
+		return imageHead{}, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	head := imageHead{
+		Length: resp.ContentLength,
+		Etag:   strings.Trim(resp.Header.Get("Etag"), `"`),
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		head.Modified = t
+	}
+	return head, nil
+}
+
+// the node answered, and doesn't have it
+var errNotOnNode = errors.New("404, probably")
+
+func (n *nodeData) processRetrieveImageResponse(resp *http.Response) (io.ReadCloser, error) {
+	if resp.StatusCode == http.StatusNotFound {
+		_ = resp.Body.Close()
+		return nil, errNotOnNode
+	}
 	if resp.Status != "200 OK" {
-		return nil, errors.New("404, probably")
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected response: %s", resp.Status)
 	}
-	return io.ReadAll(resp.Body)
+	return resp.Body, nil
+}
+
+// asks whether a node has the full-size image
+type imageInfoRequest struct {
+	Hash      string `json:"hash"`
+	Extension string `json:"extension"`
 }
 
 type imageInfoResponse struct {
@@ -162,70 +225,288 @@ func (n *nodeData) processRetrieveInfoResponse(resp *http.Response) (*imageInfoR
 	return &response, nil
 }
 
-func postFile(ctx context.Context, filename string, targetURL string, sizeHints string) (*http.Response, error) {
-	bodyBuf := bytes.NewBufferString("")
-	bodyWriter := multipart.NewWriter(bodyBuf)
-	var err error
-	_ = bodyWriter.WriteField("sizeHints", sizeHints)
+func (n nodeData) retrieveInfoBatchURL() string {
+	return n.goodBaseURL() + "/retrieve_info/batch/"
+}
+
+// RetrieveImageInfoBatch asks the node about many full-size
+// images in one request. The responses come back in the same
+// order as the images.
+func (n *nodeData) RetrieveImageInfoBatch(ctx context.Context, ris []imageSpecifier) ([]imageInfoResponse, error) {
+	reqs := make([]imageInfoRequest, len(ris))
+	for i, ri := range ris {
+		reqs[i] = imageInfoRequest{Hash: ri.Hash.String(), Extension: ri.Extension}
+	}
+	b, err := json.Marshal(reqs)
 	if err != nil {
 		return nil, err
 	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
 
-	ext := filepath.Ext(filename)
-	contentType, ok := extmimes[ext]
-	if !ok {
-		contentType = "application/octet-stream"
+	req, err := http.NewRequest("POST", n.retrieveInfoBatchURL(), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		n.LastFailed = time.Now()
+		return nil, err
+	}
+	n.LastSeen = time.Now()
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("batch info request failed: %s", resp.Status)
+	}
+	var responses []imageInfoResponse
+	if err := json.NewDecoder(resp.Body).Decode(&responses); err != nil {
+		return nil, err
 	}
+	if len(responses) != len(ris) {
+		return nil, errors.New("batch info response doesn't match request")
+	}
+	return responses, nil
+}
 
-	h := make(textproto.MIMEHeader)
-	h.Set("Content-Disposition",
-		fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
-			"image", filepath.Base(filename)))
-	h.Set("Content-Type", contentType)
+func (n nodeData) merkleURL(requester, prefix string) string {
+	return n.goodBaseURL() + "/merkle/" + requester + "/" + prefix
+}
 
-	fileWriter, err := bodyWriter.CreatePart(h)
+// MerkleNode fetches a node of the peer's merkle tree of the
+// images it shares with requester
+func (n *nodeData) MerkleNode(ctx context.Context, requester, prefix string) (*merkleNode, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", n.merkleURL(requester, prefix), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
+		n.LastFailed = time.Now()
+		return nil, err
+	}
+	n.LastSeen = time.Now()
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("merkle request failed: %s", resp.Status)
+	}
+	var node merkleNode
+	if err := json.NewDecoder(resp.Body).Decode(&node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+func (n nodeData) inventoryURL(prefix string) string {
+	return n.goodBaseURL() + "/inventory/" + prefix
+}
+
+// InventoryDigests fetches the digest of each shard of the
+// node's inventory
+func (n *nodeData) InventoryDigests(ctx context.Context) (map[string]string, error) {
+	var inv inventoryDigests
+	if err := n.getInventory(ctx, "", &inv); err != nil {
+		return nil, err
+	}
+	return inv.Digests, nil
+}
+
+// InventoryShard fetches the images the node holds under the prefix
+func (n *nodeData) InventoryShard(ctx context.Context, prefix string) ([]merkleEntry, error) {
+	var entries []merkleEntry
+	if err := n.getInventory(ctx, prefix, &entries); err != nil {
 		return nil, err
 	}
+	return entries, nil
+}
+
+func (n *nodeData) getInventory(ctx context.Context, prefix string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", n.inventoryURL(prefix), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		n.LastFailed = time.Now()
+		return err
+	}
+	n.LastSeen = time.Now()
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("inventory request failed: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func postFile(ctx context.Context, filename string, targetURL string, sizeHints string) (*http.Response, error) {
+	return postFileWithHint(ctx, filename, targetURL, sizeHints, "")
+}
+
+func (n nodeData) rawStashURL(ri imageSpecifier, sizeHints string, hintFor string) string {
+	params := url.Values{}
+	if sizeHints != "" {
+		params.Set("size_hints", sizeHints)
+	}
+	if hintFor != "" {
+		params.Set("hint_for", hintFor)
+	}
+	u := n.goodBaseURL() + ri.stashURLPath()
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	return u
+}
+
+// putFile sends the file as the raw body of the request, along
+// with the hash that the receiver should find when it's done.
+func putFile(ctx context.Context, filename string, targetURL string, expected string) (*http.Response, error) {
 	fh, err := os.Open(filename)
 	if err != nil {
-		_ = bodyWriter.Close()
 		return nil, err
 	}
 	defer func() { _ = fh.Close() }()
-	_, err = io.Copy(fileWriter, fh)
+	fi, err := fh.Stat()
 	if err != nil {
 		return nil, err
 	}
-	// .Close() finishes setting it up
-	// do not defer this or it will make and empty POST request
-	if err := bodyWriter.Close(); err != nil {
+	req, err := http.NewRequest("PUT", targetURL, fh)
+	if err != nil {
 		return nil, err
 	}
-	contentType = bodyWriter.FormDataContentType()
-	req, err := http.NewRequest("POST", targetURL, bodyBuf)
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(expectedDigestHeader, expected)
+	return http.DefaultClient.Do(req.WithContext(ctx))
+}
+
+// the multipart body is written into a pipe as the request is
+// being sent, so we never hold more than a buffer's worth of
+// the file in memory, however big it is.
+func postFileWithHint(ctx context.Context, filename string, targetURL string, sizeHints string, hintFor string) (*http.Response, error) {
+	fh, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", contentType)
-	return http.DefaultClient.Do(req.WithContext(ctx))
+
+	pr, pw := io.Pipe()
+	bodyWriter := multipart.NewWriter(pw)
+	go func() {
+		defer func() { _ = fh.Close() }()
+		_ = pw.CloseWithError(writeStashBody(bodyWriter, fh, filename, sizeHints, hintFor))
+	}()
+
+	req, err := http.NewRequest("POST", targetURL, pr)
+	if err != nil {
+		_ = pr.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", bodyWriter.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		// make sure the writer goroutine isn't left blocked
+		_ = pr.CloseWithError(err)
+	}
+	return resp, err
+}
+
+func writeStashBody(bodyWriter *multipart.Writer, fh io.Reader, filename, sizeHints, hintFor string) error {
+	if err := bodyWriter.WriteField("sizeHints", sizeHints); err != nil {
+		return err
+	}
+	if hintFor != "" {
+		if err := bodyWriter.WriteField("hint_for", hintFor); err != nil {
+			return err
+		}
+	}
+
+	ext := filepath.Ext(filename)
+	contentType, ok := extmimes[ext]
+	if !ok {
+		contentType = "application/octet-stream"
+	}
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition",
+		fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+			"image", filepath.Base(filename)))
+	h.Set("Content-Type", contentType)
+
+	fileWriter, err := bodyWriter.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fileWriter, fh); err != nil {
+		return err
+	}
+	// .Close() writes the final boundary
+	return bodyWriter.Close()
 }
 
 func (n *nodeData) Stash(ctx context.Context, ri imageSpecifier, sizeHints string, backend Backend) bool {
+	return n.StashWithHint(ctx, ri, sizeHints, "", backend)
+}
+
+// StashWithHint stashes the image on the node. If hintFor is set,
+// the node is told that it is holding the copy on behalf of that
+// (currently unavailable) node.
+func (n *nodeData) StashWithHint(ctx context.Context, ri imageSpecifier, sizeHints string, hintFor string, backend Backend) bool {
+	return n.stash(ctx, ri, sizeHints, hintFor, backend) == nil
+}
+
+// errStashCorrupted means that the copy the node got didn't match
+// its digest, even after trying again. that's the transfer's
+// fault, not the node's.
+var errStashCorrupted = errors.New("stashed copy was corrupted in transit")
+
+// how many more times to send an image that arrived corrupted
+const stashTransferRetries = 2
+
+func (n *nodeData) stash(ctx context.Context, ri imageSpecifier, sizeHints string, hintFor string, backend Backend) error {
 	filename := backend.fullPath(ri)
-	resp, err := postFile(ctx, filename, n.stashURL(), sizeHints)
+	var err error
+	for i := 0; i <= stashTransferRetries; i++ {
+		err = n.stashOnce(ctx, filename, ri, sizeHints, hintFor)
+		if !errors.Is(err, errStashCorrupted) {
+			return err
+		}
+	}
+	return err
+}
+
+func (n *nodeData) stashOnce(ctx context.Context, filename string, ri imageSpecifier, sizeHints string, hintFor string) error {
+	resp, err := putFile(ctx, filename, n.rawStashURL(ri, sizeHints, hintFor), ri.Hash.String())
 	if err != nil {
-		return false
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		// an older node that only takes multipart posts
+		_ = resp.Body.Close()
+		resp, err = postFileWithHint(ctx, filename, n.stashURL(), sizeHints, hintFor)
+		if err != nil {
+			return err
+		}
 	}
 	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		return errStashCorrupted
+	}
 	if resp.StatusCode != 200 {
-		return false
+		return fmt.Errorf("stash failed: %s", resp.Status)
 	}
 	b, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return false
+		return err
+	}
+	if string(b) != "ok" {
+		return fmt.Errorf("stash failed: %s", b)
 	}
-	return string(b) == "ok"
+	return nil
 }
 
 func (n nodeData) announceURL() string {
@@ -237,6 +518,10 @@ type announceResponse struct {
 	UUID      string     `json:"uuid"`
 	Location  string     `json:"location"`
 	Writeable bool       `json:"writeable"`
+	Draining  bool       `json:"draining"`
+	Full      bool       `json:"full"`
+	BytesUsed uint64     `json:"bytes_used"`
+	BytesFree uint64     `json:"bytes_free"`
 	BaseURL   string     `json:"base_url"`
 	Neighbors []nodeData `json:"neighbors"`
 }
@@ -257,6 +542,14 @@ func makeParams(originator nodeData) url.Values {
 	} else {
 		params.Set("writeable", "false")
 	}
+	if originator.Draining {
+		params.Set("draining", "true")
+	}
+	if originator.Full {
+		params.Set("full", "true")
+	}
+	params.Set("bytes_used", strconv.FormatUint(originator.BytesUsed, 10))
+	params.Set("bytes_free", strconv.FormatUint(originator.BytesFree, 10))
 	return params
 }
 
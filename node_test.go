@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -193,9 +195,19 @@ func Test_makeParams(t *testing.T) {
 func TestStash(t *testing.T) {
 	// Create a mock HTTP server that will act as the remote node.
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check that the request is for the /stash/ endpoint.
-		if r.URL.Path != "/stash/" {
-			t.Errorf("Expected to request '/stash/', got: %s", r.URL.Path)
+		// Check that the image is PUT to its own stash URL
+		if r.Method != "PUT" || r.URL.Path != "/stash/fb682e05b9be61797601e60165825c0b089f755e/jpg" {
+			t.Errorf("Expected to PUT to the image's stash URL, got: %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get(expectedDigestHeader) != "fb682e05b9be61797601e60165825c0b089f755e" {
+			t.Errorf("Expected the image's hash in %s, got: %s", expectedDigestHeader, r.Header.Get(expectedDigestHeader))
+		}
+		if r.URL.Query().Get("size_hints") != "somesizehints" {
+			t.Errorf("Expected size hints to be passed along, got: %s", r.URL.RawQuery)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "hello" {
+			t.Errorf("Expected the raw image as the body, got: %s", string(body))
 		}
 		_, _ = w.Write([]byte("ok"))
 	}))
@@ -247,6 +259,12 @@ func TestStash(t *testing.T) {
 func TestStashContentType(t *testing.T) {
 	// Create a mock HTTP server that will act as the remote node.
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// act like an older node without the raw stash endpoint
+		// so that it falls back to a multipart post
+		if r.Method == "PUT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
 		// Check that the request is for the /stash/ endpoint.
 		if r.URL.Path != "/stash/" {
 			t.Errorf("Expected to request '/stash/', got: %s", r.URL.Path)
@@ -487,9 +505,14 @@ func TestRetrieveImage(t *testing.T) {
 					t.Fatal(err)
 				}
 				resp.Body = &mockReadCloser{resp.Body}
-				_, err = n.processRetrieveImageResponse(resp)
-				if err == nil {
-					t.Error("expected an error from processRetrieveImageResponse")
+				body, err := n.processRetrieveImageResponse(resp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// the body is handed back to the caller, so
+				// that's who sees the error
+				if err := body.Close(); err == nil {
+					t.Error("expected an error closing the body")
 				}
 				return
 			}
@@ -519,8 +542,13 @@ func TestRetrieveImage(t *testing.T) {
 				if err != nil {
 					t.Fatal(err)
 				}
-				if string(img) != "image data" {
-					t.Errorf("Expected image data to be 'image data', but got '%s'", string(img))
+				defer func() { _ = img.Close() }()
+				data, err := io.ReadAll(img)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != "image data" {
+					t.Errorf("Expected image data to be 'image data', but got '%s'", string(data))
 				}
 			} else {
 				if err == nil {
@@ -805,3 +833,160 @@ func TestPostFile(t *testing.T) {
 		})
 	}
 }
+
+// a sparse file is fine here; we only care about how much of it
+// ends up in memory along the way
+func make200MBImage(b *testing.B) string {
+	b.Helper()
+	filename := filepath.Join(b.TempDir(), "full.jpg")
+	f, err := os.Create(filename)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := f.Truncate(200 << 20); err != nil {
+		b.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		b.Fatal(err)
+	}
+	return filename
+}
+
+// B/op should stay at a small fraction of the 200MB file
+func BenchmarkPostFile200MB(b *testing.B) {
+	filename := make200MBImage(b)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			_, _ = io.Copy(io.Discard, part)
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	b.SetBytes(200 << 20)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp, err := postFile(context.Background(), filename, server.URL, "")
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = resp.Body.Close()
+	}
+}
+
+func BenchmarkRetrieveImage200MB(b *testing.B) {
+	filename := make200MBImage(b)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filename)
+	}))
+	defer server.Close()
+	h, err := hashFromString("fb682e05b9be61797601e60165825c0b089f755e", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	ri := &imageSpecifier{h, resize.MakeSizeSpec("full"), ".jpg"}
+	n := nodeData{BaseURL: server.URL}
+
+	b.SetBytes(200 << 20)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		body, err := n.RetrieveImage(context.Background(), ri)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, body)
+		_ = body.Close()
+	}
+}
+
+func TestRetrieveImageInfoBatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/retrieve_info/batch/" {
+			http.NotFound(w, r)
+			return
+		}
+		var reqs []imageInfoRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var infos []imageInfoResponse
+		for i, req := range reqs {
+			infos = append(infos, imageInfoResponse{req.Hash, req.Extension, i%2 == 0})
+		}
+		if len(reqs) == 3 {
+			// pretend to have lost one
+			infos = infos[:2]
+		}
+		_ = json.NewEncoder(w).Encode(infos)
+	}))
+	defer server.Close()
+
+	h, _ := hashFromString("fb682e05b9be61797601e60165825c0b089f755e", "")
+	ri := imageSpecifier{h, resize.MakeSizeSpec("full"), ".jpg"}
+	n := nodeData{BaseURL: server.URL}
+
+	infos, err := n.RetrieveImageInfoBatch(context.Background(), []imageSpecifier{ri, ri})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || !infos[0].Local || infos[1].Local {
+		t.Errorf("unexpected responses: %v", infos)
+	}
+	if infos[0].Hash != h.String() || infos[0].Extension != ".jpg" {
+		t.Errorf("wrong image in response: %v", infos[0])
+	}
+
+	if _, err := n.RetrieveImageInfoBatch(context.Background(), []imageSpecifier{ri, ri, ri}); err == nil {
+		t.Error("a short response should be an error")
+	}
+
+	n.BaseURL = server.URL + "/nothing-here"
+	if _, err := n.RetrieveImageInfoBatch(context.Background(), []imageSpecifier{ri}); err == nil {
+		t.Error("expected an error from a 404")
+	}
+}
+
+func TestHeadImage(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			t.Errorf("expected a HEAD, got %s", r.Method)
+		}
+		if r.URL.Path != "/retrieve/fb682e05b9be61797601e60165825c0b089f755e/full/jpg/" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Etag", `"fb682e05b9be61797601e60165825c0b089f755e"`)
+		w.Header().Set("Content-Length", "1234")
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	}))
+	defer server.Close()
+
+	n := nodeData{BaseURL: server.URL}
+	h, _ := hashFromString("fb682e05b9be61797601e60165825c0b089f755e", "")
+	ri := &imageSpecifier{h, resize.MakeSizeSpec("full"), ".jpg"}
+	head, err := n.HeadImage(context.Background(), ri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Length != 1234 || head.Etag != h.String() || !head.Modified.Equal(modified) {
+		t.Errorf("unexpected head: %+v", head)
+	}
+
+	ri.Size = resize.MakeSizeSpec("100s")
+	if _, err := n.HeadImage(context.Background(), ri); !errors.Is(err, errNotOnNode) {
+		t.Errorf("expected errNotOnNode, got %v", err)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// nodes hand out their inventory in shards of this many hex
+// characters of hash prefix (so 256 of them), each with a digest
+// so that only the shards that have changed need to be fetched
+// again.
+const inventoryPrefixLen = 2
+
+type inventoryDigests struct {
+	Digests map[string]string `json:"digests"`
+}
+
+// InventoryDigests returns the digest of every non-empty shard of
+// what we hold
+func (a *antiEntropy) InventoryDigests() inventoryDigests {
+	t := a.inventory()
+	digests := make(map[string]string)
+	for _, p := range inventoryPrefixes() {
+		if d := t.digest(p); d != "" {
+			digests[p] = d
+		}
+	}
+	return inventoryDigests{Digests: digests}
+}
+
+// InventoryShard returns the images we hold under the prefix
+func (a *antiEntropy) InventoryShard(prefix string) ([]merkleEntry, error) {
+	if len(prefix) != inventoryPrefixLen || strings.Trim(prefix, hexDigits) != "" {
+		return nil, fmt.Errorf("bad prefix: %s", prefix)
+	}
+	entries := a.inventory().Entries(prefix)
+	if entries == nil {
+		entries = []merkleEntry{}
+	}
+	return entries, nil
+}
+
+func inventoryPrefixes() []string {
+	var prefixes []string
+	for _, a := range hexDigits {
+		for _, b := range hexDigits {
+			prefixes = append(prefixes, string(a)+string(b))
+		}
+	}
+	return prefixes
+}
+
+// what we know of one node's inventory
+type placementNode struct {
+	Nickname  string
+	Reachable bool
+	Images    int
+	shards    map[string]placementShard
+}
+
+type placementShard struct {
+	digest  string
+	entries []merkleEntry
+}
+
+// an image that isn't where it should be
+type placementImage struct {
+	Hash            string
+	Extension       string
+	Replicas        int
+	Holders         []string
+	Owners          []string
+	UnderReplicated bool
+	OverReplicated  bool
+	Misplaced       bool
+}
+
+type placementPrefix struct {
+	images, under, over, misplaced int
+	problems                       []placementImage
+}
+
+// most problem images to keep per prefix. the counts are always
+// exact; this only limits how many get listed
+const maxPlacementProblems = 16
+
+// placementSummary is what the report says about the whole
+// cluster
+type placementSummary struct {
+	Updated         time.Time
+	Replication     int
+	Images          int
+	UnderReplicated int
+	OverReplicated  int
+	Misplaced       int
+	Nodes           map[string]placementNode
+	Problems        []placementImage
+}
+
+// placementReport works out, for every image held anywhere in the
+// cluster, how many copies there are and whether they're on the
+// nodes that WriteOrder says they should be on.
+//
+// It keeps a copy of every node's inventory, and each time round
+// only fetches the shards whose digests have changed, and only
+// re-checks the prefixes where something changed on some node (or
+// all of them, if the ring has changed).
+type placementReport struct {
+	c  *cluster
+	s  siteConfig
+	sl log.Logger
+	// our own inventory, without going over HTTP
+	local *antiEntropy
+
+	// only touched by Refresh, which must not run concurrently
+	nodes    map[string]*placementNode
+	epoch    int
+	prefixes map[string]placementPrefix
+
+	mu      sync.Mutex
+	summary placementSummary
+}
+
+func newPlacementReport(c *cluster, s siteConfig, local *antiEntropy, sl log.Logger) *placementReport {
+	return &placementReport{
+		c:        c,
+		s:        s,
+		sl:       sl,
+		local:    local,
+		nodes:    make(map[string]*placementNode),
+		epoch:    -1,
+		prefixes: make(map[string]placementPrefix),
+	}
+}
+
+// run this as a goroutine
+func (p *placementReport) Run(interval int) {
+	for {
+		p.Refresh(context.Background())
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+// Summary returns the report as of the last Refresh
+func (p *placementReport) Summary() placementSummary {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.summary
+}
+
+func (p *placementReport) Refresh(ctx context.Context) {
+	epoch := p.c.RingEpoch()
+	ring := p.c.WriteRing()
+
+	changed := make(map[string]bool)
+	current := make(map[string]bool)
+	for _, n := range p.c.NeighborsInclusive() {
+		current[n.UUID] = true
+		pn, ok := p.nodes[n.UUID]
+		if !ok {
+			pn = &placementNode{shards: make(map[string]placementShard)}
+			p.nodes[n.UUID] = pn
+		}
+		pn.Nickname = n.Nickname
+		err := p.refreshNode(ctx, n, pn, changed)
+		pn.Reachable = err == nil
+		if err != nil {
+			// keep what we had for it. it's the best we know
+			_ = p.sl.Log("level", "WARN", "msg", "could not get inventory", "node", n.Nickname, "error", err.Error())
+		}
+	}
+	for uuid, pn := range p.nodes {
+		if !current[uuid] {
+			for prefix := range pn.shards {
+				changed[prefix] = true
+			}
+			delete(p.nodes, uuid)
+		}
+	}
+	if epoch != p.epoch {
+		// everyone's owners may have moved
+		for prefix := range p.prefixes {
+			changed[prefix] = true
+		}
+		for _, pn := range p.nodes {
+			for prefix := range pn.shards {
+				changed[prefix] = true
+			}
+		}
+		p.epoch = epoch
+	}
+	for prefix := range changed {
+		pp := p.check(prefix, ring)
+		if pp.images == 0 {
+			delete(p.prefixes, prefix)
+		} else {
+			p.prefixes[prefix] = pp
+		}
+	}
+	p.summarize()
+}
+
+// fetches the shards of the node's inventory that have changed
+// since last time, and notes their prefixes
+func (p *placementReport) refreshNode(ctx context.Context, n nodeData, pn *placementNode, changed map[string]bool) error {
+	var digests map[string]string
+	var shard func(prefix string) ([]merkleEntry, error)
+	if n.UUID == p.c.GetMyself().UUID && p.local != nil {
+		digests = p.local.InventoryDigests().Digests
+		shard = p.local.InventoryShard
+	} else {
+		var err error
+		digests, err = n.InventoryDigests(ctx)
+		if err != nil {
+			return err
+		}
+		shard = func(prefix string) ([]merkleEntry, error) { return n.InventoryShard(ctx, prefix) }
+	}
+	for prefix, d := range digests {
+		if pn.shards[prefix].digest == d {
+			continue
+		}
+		entries, err := shard(prefix)
+		if err != nil {
+			return err
+		}
+		pn.shards[prefix] = placementShard{digest: d, entries: entries}
+		changed[prefix] = true
+	}
+	for prefix := range pn.shards {
+		if _, ok := digests[prefix]; !ok {
+			delete(pn.shards, prefix)
+			changed[prefix] = true
+		}
+	}
+	return nil
+}
+
+// classifies every image under the prefix
+func (p *placementReport) check(prefix string, ring ringEntryList) placementPrefix {
+	holders := make(map[merkleEntry][]string)
+	for uuid, pn := range p.nodes {
+		for _, e := range pn.shards[prefix].entries {
+			holders[e] = append(holders[e], uuid)
+		}
+	}
+	var pp placementPrefix
+	for e, held := range holders {
+		pp.images++
+		owners := ringOwners(e.Hash, ring, p.s.Replication)
+		isOwner := make(map[string]bool)
+		for _, uuid := range owners {
+			isOwner[uuid] = true
+		}
+		img := placementImage{
+			Hash:            e.Hash,
+			Extension:       e.Extension,
+			Replicas:        len(held),
+			UnderReplicated: len(held) < p.s.Replication,
+			OverReplicated:  len(held) > p.s.Replication,
+		}
+		for _, uuid := range held {
+			if !isOwner[uuid] {
+				img.Misplaced = true
+			}
+		}
+		if !img.UnderReplicated && !img.OverReplicated && !img.Misplaced {
+			continue
+		}
+		if img.UnderReplicated {
+			pp.under++
+		}
+		if img.OverReplicated {
+			pp.over++
+		}
+		if img.Misplaced {
+			pp.misplaced++
+		}
+		img.Holders = p.nicknames(held)
+		img.Owners = p.nicknames(owners)
+		pp.problems = append(pp.problems, img)
+	}
+	sort.Slice(pp.problems, func(i, j int) bool { return pp.problems[i].Hash < pp.problems[j].Hash })
+	if len(pp.problems) > maxPlacementProblems {
+		pp.problems = pp.problems[:maxPlacementProblems]
+	}
+	return pp
+}
+
+func (p *placementReport) nicknames(uuids []string) []string {
+	names := make([]string, 0, len(uuids))
+	for _, uuid := range uuids {
+		if pn, ok := p.nodes[uuid]; ok && pn.Nickname != "" {
+			names = append(names, pn.Nickname)
+		} else {
+			names = append(names, uuid)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *placementReport) summarize() {
+	sum := placementSummary{
+		Updated:     time.Now(),
+		Replication: p.s.Replication,
+		Nodes:       make(map[string]placementNode),
+	}
+	prefixes := make([]string, 0, len(p.prefixes))
+	for prefix, pp := range p.prefixes {
+		sum.Images += pp.images
+		sum.UnderReplicated += pp.under
+		sum.OverReplicated += pp.over
+		sum.Misplaced += pp.misplaced
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		sum.Problems = append(sum.Problems, p.prefixes[prefix].problems...)
+	}
+
+	for uuid, pn := range p.nodes {
+		pn.Images = 0
+		for _, shard := range pn.shards {
+			pn.Images += len(shard.entries)
+		}
+		sum.Nodes[uuid] = placementNode{Nickname: pn.Nickname, Reachable: pn.Reachable, Images: pn.Images}
+	}
+	p.s.Metrics.Placement(sum)
+
+	p.mu.Lock()
+	p.summary = sum
+	p.mu.Unlock()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thraxil/resize"
+)
+
+func addToInventory(t *testing.T, a *antiEntropy, hash string) {
+	t.Helper()
+	ah, _ := hashFromString(hash, "")
+	ri := imageSpecifier{ah, resize.MakeSizeSpec("full"), ".jpg"}
+	if err := a.s.Backend.WriteFull(ri, io.NopCloser(strings.NewReader(hash))); err != nil {
+		t.Fatal(err)
+	}
+	// don't wait for the cached tree to expire
+	a.mu.Lock()
+	a.trees = make(map[string]cachedTree)
+	a.mu.Unlock()
+}
+
+// serves the node's inventory, counting how many shards get fetched
+func inventoryServer(t *testing.T, a *antiEntropy, shards *int32) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := strings.TrimPrefix(r.URL.Path, "/inventory/")
+		if prefix != "" {
+			atomic.AddInt32(shards, 1)
+		}
+		r.SetPathValue("prefix", prefix)
+		inventoryHandler(w, r, sitecontext{AntiEntropy: a, SL: log.NewNopLogger()})
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func Test_placementReport(t *testing.T) {
+	ca, a := makeAntiEntropyNode(t, "node-a")
+	_, b := makeAntiEntropyNode(t, "node-b")
+	_, c := makeAntiEntropyNode(t, "node-c")
+	var bShards, cShards int32
+	ca.AddNeighbor(nodeData{Nickname: "node-b", UUID: "node-b", Writeable: true,
+		BaseURL: inventoryServer(t, b, &bShards).URL})
+	ca.AddNeighbor(nodeData{Nickname: "node-c", UUID: "node-c", Writeable: true,
+		BaseURL: inventoryServer(t, c, &cShards).URL})
+	ca.Sync()
+	nodes := map[string]*antiEntropy{"node-a": a, "node-b": b, "node-c": c}
+
+	ring := ca.WriteRing()
+	owners := func(hash string) []string { return ringOwners(hash, ring, 2) }
+	notOwner := func(hash string) string {
+		o := owners(hash)
+		for uuid := range nodes {
+			if uuid != o[0] && uuid != o[1] {
+				return uuid
+			}
+		}
+		return ""
+	}
+
+	// exactly where it should be
+	fine := "fb682e05b9be61797601e60165825c0b089f755e"
+	for _, uuid := range owners(fine) {
+		addToInventory(t, nodes[uuid], fine)
+	}
+	// one copy, on an owner
+	under := "0051ec03fb813e8731224ee06feee7c828ceae22"
+	addToInventory(t, nodes[owners(under)[0]], under)
+	// everywhere, which is too many, and one is in the wrong place
+	over := "c1986af3c26609b8b7d8933f99c51c1a89e9ea6b"
+	for _, n := range nodes {
+		addToInventory(t, n, over)
+	}
+	// the right number of copies, but one is in the wrong place
+	misplaced := "a94a8fe5ccb19ba61c4c0873d391e987982fbbd3"
+	addToInventory(t, nodes[owners(misplaced)[0]], misplaced)
+	addToInventory(t, nodes[notOwner(misplaced)], misplaced)
+
+	m := newMetrics(prometheus.NewRegistry())
+	p := newPlacementReport(ca, siteConfig{Replication: 2, Metrics: m}, a, log.NewNopLogger())
+	p.Refresh(context.Background())
+	sum := p.Summary()
+	if sum.Images != 4 || sum.UnderReplicated != 1 || sum.OverReplicated != 1 || sum.Misplaced != 2 {
+		t.Errorf("wrong counts: %d images, %d under, %d over, %d misplaced",
+			sum.Images, sum.UnderReplicated, sum.OverReplicated, sum.Misplaced)
+	}
+	if len(sum.Problems) != 3 {
+		t.Fatalf("expected three problems, got %v", sum.Problems)
+	}
+	for _, img := range sum.Problems {
+		if img.Hash == fine {
+			t.Error("a well placed image isn't a problem")
+		}
+		if img.Hash == over && (img.Replicas != 3 || !img.Misplaced || len(img.Owners) != 2) {
+			t.Errorf("wrong over-replicated image: %+v", img)
+		}
+	}
+	if len(sum.Nodes) != 3 || !sum.Nodes["node-b"].Reachable || sum.Nodes["node-a"].Images == 0 {
+		t.Errorf("wrong nodes: %v", sum.Nodes)
+	}
+	if testutil.ToFloat64(m.placementMisplaced) != 2 || testutil.ToFloat64(m.placementImages) != 4 {
+		t.Error("the gauges should match the summary")
+	}
+
+	// nothing has changed, so nothing gets fetched again
+	fetched := atomic.LoadInt32(&bShards)
+	if fetched == 0 {
+		t.Fatal("should have fetched node-b's shards")
+	}
+	p.Refresh(context.Background())
+	if atomic.LoadInt32(&bShards) != fetched {
+		t.Errorf("unchanged shards were fetched again")
+	}
+
+	// only the shard that changed does
+	addToInventory(t, b, "ffffffffffffffffffffffffffffffffffffffff")
+	p.Refresh(context.Background())
+	if got := atomic.LoadInt32(&bShards) - fetched; got != 1 {
+		t.Errorf("expected one shard to be fetched again, got %d", got)
+	}
+	if sum := p.Summary(); sum.Images != 5 || sum.UnderReplicated != 2 {
+		t.Errorf("should have picked up the new image: %d images, %d under", sum.Images, sum.UnderReplicated)
+	}
+}
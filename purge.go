@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// what a CDN in front of us should forget about.
+//
+// Images can be requested under any filename, so URLs only covers
+// the canonical one (/image/<hash>/<size>/image.<ext>, which is
+// what we link to). SurrogateKey is set whenever we tag images
+// with a Surrogate-Key header (the default), and purging by it
+// gets every size and every filename at once.
+type purgeRequest struct {
+	Hash         string   `json:"hash"`
+	SurrogateKey string   `json:"surrogate_key,omitempty"`
+	URLs         []string `json:"urls"`
+	Reason       string   `json:"reason"`
+}
+
+// Purger gets told whenever something we may have already served
+// changes or goes away, so that it can tell whatever is caching
+// it. Purge must not block.
+type Purger interface {
+	Purge(req purgeRequest)
+}
+
+// purgeNotifier works out which URLs an image has been served at
+// and passes them on to the Purger. baseURL is whatever is in
+// front of us (a CDN, say), or our own BaseURL if nothing is.
+//
+// All the methods are safe to call on a nil *purgeNotifier, which
+// doesn't tell anyone anything.
+type purgeNotifier struct {
+	p             Purger
+	baseURL       string
+	surrogateKeys bool
+}
+
+func newPurgeNotifier(p Purger, baseURL string, surrogateKeys bool) *purgeNotifier {
+	// a CDN is likely to be https, so only add a scheme if
+	// there isn't one
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+	return &purgeNotifier{p: p, baseURL: strings.TrimSuffix(baseURL, "/"), surrogateKeys: surrogateKeys}
+}
+
+// the canonical URLs for each of the given sizes of the image
+func (pn *purgeNotifier) imageURLs(h *hash, extension string, sizes []string) []string {
+	var urls []string
+	for _, size := range sizes {
+		urls = append(urls, pn.baseURL+"/image/"+h.String()+"/"+size+"/image"+extension)
+	}
+	return urls
+}
+
+// Image tells the Purger that those sizes of the image (which
+// may include "full") are no longer what we served before
+func (pn *purgeNotifier) Image(h *hash, extension string, sizes []string, reason string) {
+	if pn == nil {
+		return
+	}
+	req := purgeRequest{
+		Hash:   h.String(),
+		URLs:   pn.imageURLs(h, extension, sizes),
+		Reason: reason,
+	}
+	if pn.surrogateKeys {
+		// the same key setCacheHeaders tags them with
+		req.SurrogateKey = h.String()
+	}
+	pn.p.Purge(req)
+}
+
+const (
+	defaultPurgeQueueSize = 1000
+	purgeRetries          = 3
+)
+
+// webhookPurger POSTs each purge request, as JSON, to a URL. It
+// keeps a bounded queue so that a slow or broken webhook can't
+// hold anything else up; if the queue fills, purges are dropped
+// (and counted) rather than waiting.
+type webhookPurger struct {
+	url     string
+	client  *http.Client
+	queue   chan purgeRequest
+	sl      log.Logger
+	metrics *metrics
+
+	// for testing
+	backoff time.Duration
+}
+
+func newWebhookPurger(url string, queueSize int, sl log.Logger) *webhookPurger {
+	return &webhookPurger{
+		url:     url,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan purgeRequest, queueSize),
+		sl:      sl,
+		backoff: time.Second,
+	}
+}
+
+func (p *webhookPurger) Purge(req purgeRequest) {
+	select {
+	case p.queue <- req:
+	default:
+		p.metrics.Purge("dropped")
+		_ = p.sl.Log("level", "WARN", "msg", "purge queue is full, dropping purge", "hash", req.Hash)
+	}
+}
+
+// run this as a goroutine
+func (p *webhookPurger) Run() {
+	for req := range p.queue {
+		p.send(req)
+	}
+}
+
+// try a few times, backing off in between
+func (p *webhookPurger) send(req purgeRequest) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	wait := p.backoff
+	for attempt := 1; ; attempt++ {
+		err = p.post(body)
+		if err == nil {
+			p.metrics.Purge("sent")
+			return
+		}
+		if attempt >= purgeRetries {
+			break
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+	p.metrics.Purge("failed")
+	_ = p.sl.Log("level", "ERR", "msg", "could not send purge", "hash", req.Hash, "error", err.Error())
+}
+
+func (p *webhookPurger) post(body []byte) error {
+	resp, err := p.client.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("purge webhook returned %s", resp.Status)
+	}
+	return nil
+}
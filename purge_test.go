@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thraxil/resize"
+)
+
+// a stand-in for a CDN's purge endpoint, which fails the first
+// few requests it gets
+type purgeStub struct {
+	mu       sync.Mutex
+	failures int
+	attempts int
+	got      []purgeRequest
+}
+
+func (ps *purgeStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.attempts++
+	if ps.attempts <= ps.failures {
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	var req purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ps.got = append(ps.got, req)
+}
+
+func Test_webhookPurgerRetries(t *testing.T) {
+	stub := &purgeStub{failures: 2}
+	ts := httptest.NewServer(stub)
+	defer ts.Close()
+
+	p := newWebhookPurger(ts.URL, 10, log.NewNopLogger())
+	p.backoff = 0
+	p.metrics = newMetrics(prometheus.NewRegistry())
+	p.send(purgeRequest{Hash: "fb682e05b9be61797601e60165825c0b089f755e", URLs: []string{"/a"}, Reason: "repaired"})
+
+	if stub.attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", stub.attempts)
+	}
+	if len(stub.got) != 1 || stub.got[0].Reason != "repaired" || stub.got[0].URLs[0] != "/a" {
+		t.Errorf("wrong purge request: %v", stub.got)
+	}
+	if testutil.ToFloat64(p.metrics.purges.WithLabelValues("sent")) != 1 {
+		t.Error("purge wasn't counted")
+	}
+}
+
+func Test_webhookPurgerGivesUp(t *testing.T) {
+	stub := &purgeStub{failures: 100}
+	ts := httptest.NewServer(stub)
+	defer ts.Close()
+
+	p := newWebhookPurger(ts.URL, 10, log.NewNopLogger())
+	p.backoff = 0
+	p.metrics = newMetrics(prometheus.NewRegistry())
+	p.send(purgeRequest{Hash: "fb682e05b9be61797601e60165825c0b089f755e"})
+	if stub.attempts != purgeRetries {
+		t.Errorf("expected %d attempts, got %d", purgeRetries, stub.attempts)
+	}
+	if testutil.ToFloat64(p.metrics.purges.WithLabelValues("failed")) != 1 {
+		t.Error("failure wasn't counted")
+	}
+}
+
+func Test_webhookPurgerQueueFull(t *testing.T) {
+	// nothing is running to empty the queue
+	p := newWebhookPurger("http://localhost:0/", 2, log.NewNopLogger())
+	p.metrics = newMetrics(prometheus.NewRegistry())
+	for i := 0; i < 5; i++ {
+		p.Purge(purgeRequest{Hash: "fb682e05b9be61797601e60165825c0b089f755e"})
+	}
+	if len(p.queue) != 2 {
+		t.Errorf("expected 2 queued, got %d", len(p.queue))
+	}
+	if dropped := testutil.ToFloat64(p.metrics.purges.WithLabelValues("dropped")); dropped != 3 {
+		t.Errorf("expected 3 dropped, got %v", dropped)
+	}
+}
+
+type recordingPurger struct {
+	got []purgeRequest
+}
+
+func (rp *recordingPurger) Purge(req purgeRequest) {
+	rp.got = append(rp.got, req)
+}
+
+func Test_purgeNotifier(t *testing.T) {
+	rp := &recordingPurger{}
+	pn := newPurgeNotifier(rp, "https://cdn.example.com/", true)
+	ri := jbodSpec(t, "fb682e05b9be61797601e60165825c0b089f755e")
+	pn.Image(ri.Hash, ".jpg", []string{"full", "100s"}, "repaired")
+	if len(rp.got) != 1 {
+		t.Fatalf("expected one purge, got %d", len(rp.got))
+	}
+	expected := []string{
+		"https://cdn.example.com/image/fb682e05b9be61797601e60165825c0b089f755e/full/image.jpg",
+		"https://cdn.example.com/image/fb682e05b9be61797601e60165825c0b089f755e/100s/image.jpg",
+	}
+	got := rp.got[0]
+	if got.Hash != ri.Hash.String() || got.SurrogateKey != ri.Hash.String() || len(got.URLs) != len(expected) {
+		t.Fatalf("wrong purge request: %v", got)
+	}
+	for i := range expected {
+		if got.URLs[i] != expected[i] {
+			t.Errorf("expected %s, got %s", expected[i], got.URLs[i])
+		}
+	}
+
+	pn = newPurgeNotifier(rp, "localhost:8080", false)
+	if pn.baseURL != "http://localhost:8080" {
+		t.Error("should default to http")
+	}
+	pn.Image(ri.Hash, ".jpg", []string{"full"}, "repaired")
+	if got := rp.got[1]; got.SurrogateKey != "" || len(got.URLs) != 1 {
+		t.Errorf("without surrogate keys, only the URLs can be purged: %v", got)
+	}
+
+	var nilNotifier *purgeNotifier
+	nilNotifier.Image(ri.Hash, ".jpg", nil, "deleted")
+}
+
+func Test_diskBackendDeletePurges(t *testing.T) {
+	root := t.TempDir() + "/"
+	idx, err := openImageIndex(filepath.Join(t.TempDir(), "index.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = idx.Close() }()
+	rp := &recordingPurger{}
+	d := diskBackend{Root: root, Index: idx, Purge: newPurgeNotifier(rp, "http://localhost:8080", false)}
+
+	ri := jbodSpec(t, "fb682e05b9be61797601e60165825c0b089f755e")
+	writeDerivative(t, root, ri, "full", 10)
+	writeDerivative(t, root, ri, "100s", 10)
+	_ = idx.AddFull(ri, 10)
+	_ = idx.AddSize(ri.Hash, "100s")
+
+	small := ri
+	small.Size = resize.MakeSizeSpec("100s")
+	if err := d.Delete(small); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ri); err != nil {
+		t.Fatal(err)
+	}
+	if len(rp.got) != 2 {
+		t.Fatalf("expected two purges, got %d", len(rp.got))
+	}
+	if len(rp.got[0].URLs) != 1 || rp.got[0].Reason != "deleted" {
+		t.Errorf("wrong purge for the resized image: %v", rp.got[0])
+	}
+	if len(rp.got[1].URLs) != 1 {
+		t.Errorf("wrong purge for the full-size image: %v", rp.got[1])
+	}
+}
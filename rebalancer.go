@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// ringRebalancer watches for changes to the ring and, when one
+// happens, moves any locally held images whose owners changed.
+// This is separate from the verifier, which only gets around to
+// rebalancing as a side effect of its (slow) integrity checks.
+type ringRebalancer struct {
+	c  *cluster
+	s  siteConfig
+	sl log.Logger
+
+	epoch int
+	ring  ringEntryList
+
+	// for testing
+	sleep func(time.Duration)
+}
+
+func newRingRebalancer(c *cluster, s siteConfig, sl log.Logger) *ringRebalancer {
+	return &ringRebalancer{
+		c:     c,
+		s:     s,
+		sl:    sl,
+		epoch: c.RingEpoch(),
+		ring:  c.WriteRing(),
+		sleep: time.Sleep,
+	}
+}
+
+// run this as a goroutine
+func (r *ringRebalancer) Run() {
+	_ = r.sl.Log("level", "INFO", "msg", "starting rebalancer")
+	for {
+		r.sleep(time.Duration(r.s.RebalanceInterval) * time.Second)
+		r.check()
+	}
+}
+
+// check looks for a new ring epoch. we only act on it once it
+// has settled for a full interval so that a flapping node
+// doesn't send us shuffling everything back and forth.
+func (r *ringRebalancer) check() {
+	epoch := r.c.RingEpoch()
+	if epoch == r.epoch {
+		return
+	}
+	r.sleep(time.Duration(r.s.RebalanceInterval) * time.Second)
+	if r.c.RingEpoch() != epoch {
+		// still changing. try again next time around
+		return
+	}
+	newRing := r.c.WriteRing()
+	_ = r.sl.Log("level", "INFO", "msg", "ring changed, rebalancing",
+		"old_epoch", r.epoch, "new_epoch", epoch)
+	r.rebalance(r.ring, newRing)
+	r.epoch = epoch
+	r.ring = newRing
+	r.s.Metrics.RebalancerPass()
+}
+
+// how many moved images to ask each node about at once
+const rebalanceBatchSize = 100
+
+type movedImage struct {
+	ri   imageSpecifier
+	path string
+}
+
+func (r *ringRebalancer) rebalance(oldRing, newRing ringEntryList) {
+	var batch []movedImage
+	err := r.s.walkFullSize(func(ri imageSpecifier, path string) error {
+		if r.c.GetMyself().Draining {
+			// the drainer has it covered
+			return nil
+		}
+		h := ri.Hash.String()
+		if sameOwners(ringOwners(h, oldRing, r.s.Replication), ringOwners(h, newRing, r.s.Replication)) {
+			return nil
+		}
+		_ = r.sl.Log("level", "INFO", "msg", "ownership moved", "image", path)
+		batch = append(batch, movedImage{ri, path})
+		if len(batch) >= rebalanceBatchSize {
+			r.rebalanceBatch(batch)
+			batch = nil
+		}
+		return nil
+	})
+	if err != nil {
+		_ = r.sl.Log("level", "WARN", "msg", "rebalancer walk returned error", "error", err.Error())
+	}
+	if len(batch) > 0 {
+		r.rebalanceBatch(batch)
+	}
+}
+
+// find out who has what for the whole batch up front, then
+// rebalance each image with that
+func (r *ringRebalancer) rebalanceBatch(batch []movedImage) {
+	ris := make([]imageSpecifier, len(batch))
+	for i, m := range batch {
+		ris[i] = m.ri
+	}
+	held := checkReplicas(context.Background(), r.c.GetNeighbors(), ris, r.c.GetMyself().UUID)
+	for _, m := range batch {
+		ir := newImageRebalancer(m.path, m.ri.Extension, m.ri.Hash, r.c, r.s, r.sl)
+		ir.held = held
+		if err := ir.Rebalance(); err != nil {
+			_ = r.sl.Log("level", "ERR", "msg", "error rebalancing", "image", m.path, "error", err.Error())
+		}
+		r.throttle(m.path)
+	}
+}
+
+// keep us under RebalanceBandwidth by sleeping for as long as
+// it should have taken to send the file
+func (r *ringRebalancer) throttle(path string) {
+	if r.s.RebalanceBandwidth <= 0 {
+		return
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	r.sleep(time.Duration(fi.Size() * int64(time.Second) / r.s.RebalanceBandwidth))
+}
+
+// the UUIDs of the first n nodes that the ring would write
+// the hash to
+func ringOwners(hash string, ring ringEntryList, n int) []string {
+	var owners []string
+	// every node is in the ring REPLICAS times, so this is
+	// always enough room
+	for _, node := range hashOrder(hash, len(ring), ring) {
+		if len(owners) >= n {
+			break
+		}
+		if node.UUID == "" {
+			break
+		}
+		owners = append(owners, node.UUID)
+	}
+	return owners
+}
+
+func sameOwners(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]bool)
+	for _, uuid := range a {
+		seen[uuid] = true
+	}
+	for _, uuid := range b {
+		if !seen[uuid] {
+			return false
+		}
+	}
+	return true
+}
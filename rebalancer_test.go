@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/thraxil/resize"
+)
+
+func Test_RingEpoch(t *testing.T) {
+	_, c := makeNewClusterData([]nodeData{})
+	e := c.RingEpoch()
+	nd := nodeData{Nickname: "neighbor", UUID: "neighbor-uuid", Writeable: true}
+	c.AddNeighbor(nd)
+	if c.RingEpoch() == e {
+		t.Error("adding a neighbor should change the epoch")
+	}
+	e = c.RingEpoch()
+	nd.Nickname = "renamed"
+	c.UpdateNeighbor(nd)
+	if c.RingEpoch() != e {
+		t.Error("renaming a neighbor shouldn't change the epoch")
+	}
+	c.FailedNeighbor(nd)
+	if c.RingEpoch() == e {
+		t.Error("a neighbor becoming unwriteable should change the epoch")
+	}
+	e = c.RingEpoch()
+	c.RemoveNeighbor(nd)
+	if c.RingEpoch() == e {
+		t.Error("removing a neighbor should change the epoch")
+	}
+}
+
+func Test_ringOwners(t *testing.T) {
+	_, c := makeNewClusterData([]nodeData{})
+	before := c.WriteRing()
+	c.AddNeighbor(nodeData{Nickname: "n1", UUID: "n1-uuid", Writeable: true})
+	c.AddNeighbor(nodeData{Nickname: "n2", UUID: "n2-uuid", Writeable: true})
+	after := c.WriteRing()
+
+	h := "fb682e05b9be61797601e60165825c0b089f755e"
+	if o := ringOwners(h, before, 2); len(o) != 1 {
+		t.Errorf("only one node to own it before, got %v", o)
+	}
+	if o := ringOwners(h, after, 2); len(o) != 2 {
+		t.Errorf("expected two owners, got %v", o)
+	}
+	// a ring with more nodes than we now know about
+	if o := ringOwners(h, after, 5); len(o) != 3 {
+		t.Errorf("expected three owners, got %v", o)
+	}
+	if !sameOwners([]string{"a", "b"}, []string{"b", "a"}) {
+		t.Error("order shouldn't matter")
+	}
+	if sameOwners([]string{"a", "b"}, []string{"a", "c"}) {
+		t.Error("those are different")
+	}
+}
+
+func Test_ringRebalancer(t *testing.T) {
+	uploadDir := t.TempDir() + "/"
+	h, _ := hashFromString("fb682e05b9be61797601e60165825c0b089f755e", "")
+	ri := imageSpecifier{h, resize.MakeSizeSpec("full"), ".jpg"}
+	_ = os.MkdirAll(ri.baseDir(uploadDir), 0755)
+	if err := os.WriteFile(ri.fullSizePath(uploadDir), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stashes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/stash/") {
+			atomic.AddInt32(&stashes, 1)
+			_, _ = w.Write([]byte("ok"))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	_, c := makeNewClusterData([]nodeData{})
+	s := siteConfig{
+		UploadDirectory:    uploadDir,
+		Replication:        2,
+		MinReplication:     2,
+		MaxReplication:     2,
+		RebalanceInterval:  1,
+		RebalanceBandwidth: 1,
+		Backend:            newDiskBackend(uploadDir),
+	}
+	r := newRingRebalancer(c, s, log.NewNopLogger())
+	var slept time.Duration
+	r.sleep = func(d time.Duration) { slept += d }
+
+	r.check()
+	if atomic.LoadInt32(&stashes) != 0 {
+		t.Error("nothing changed, so nothing should move")
+	}
+
+	c.AddNeighbor(nodeData{
+		Nickname:  "neighbor",
+		UUID:      "neighbor-uuid",
+		BaseURL:   server.URL,
+		Writeable: true,
+	})
+	slept = 0
+	r.check()
+	if atomic.LoadInt32(&stashes) != 1 {
+		t.Errorf("new owner should have been sent a copy, got %d stashes", stashes)
+	}
+	// interval to settle, plus 5 bytes at 1 byte per second
+	if slept != 6*time.Second {
+		t.Errorf("expected to be throttled, slept %v", slept)
+	}
+	if r.epoch != c.RingEpoch() {
+		t.Error("rebalancer should be caught up")
+	}
+}
+
+func Test_ringRebalancerBatch(t *testing.T) {
+	uploadDir := t.TempDir() + "/"
+	h, _ := hashFromString("fb682e05b9be61797601e60165825c0b089f755e", "")
+	ri := imageSpecifier{h, resize.MakeSizeSpec("full"), ".jpg"}
+	_ = os.MkdirAll(ri.baseDir(uploadDir), 0755)
+	if err := os.WriteFile(ri.fullSizePath(uploadDir), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stashes, singles, batches int32
+	var local atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/stash/"):
+			atomic.AddInt32(&stashes, 1)
+			_, _ = w.Write([]byte("ok"))
+		case r.URL.Path == "/retrieve_info/batch/":
+			atomic.AddInt32(&batches, 1)
+			var reqs []imageInfoRequest
+			_ = json.NewDecoder(r.Body).Decode(&reqs)
+			var infos []imageInfoResponse
+			for _, req := range reqs {
+				infos = append(infos, imageInfoResponse{req.Hash, req.Extension, local.Load()})
+			}
+			_ = json.NewEncoder(w).Encode(infos)
+		default:
+			atomic.AddInt32(&singles, 1)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	_, c := makeNewClusterData([]nodeData{})
+	s := siteConfig{
+		UploadDirectory: uploadDir,
+		Replication:     2,
+		MinReplication:  2,
+		MaxReplication:  2,
+		Backend:         newDiskBackend(uploadDir),
+	}
+	r := newRingRebalancer(c, s, log.NewNopLogger())
+	r.sleep = func(time.Duration) {}
+	c.AddNeighbor(nodeData{
+		Nickname:  "neighbor",
+		UUID:      "neighbor-uuid",
+		BaseURL:   server.URL,
+		Writeable: true,
+	})
+
+	local.Store(true)
+	r.rebalance(ringEntryList{}, c.WriteRing())
+	if atomic.LoadInt32(&stashes) != 0 {
+		t.Error("the neighbor already has it")
+	}
+
+	local.Store(false)
+	r.rebalance(ringEntryList{}, c.WriteRing())
+	if atomic.LoadInt32(&stashes) != 1 {
+		t.Errorf("the neighbor should have been sent a copy, got %d stashes", stashes)
+	}
+	if atomic.LoadInt32(&batches) != 2 {
+		t.Errorf("expected one batch request per pass, got %d", batches)
+	}
+	if atomic.LoadInt32(&singles) != 0 {
+		t.Errorf("shouldn't need to ask about images one at a time, asked %d times", singles)
+	}
+}
@@ -3,7 +3,6 @@ package main // import "github.com/thraxil/reticulum"
 import (
 	"context"
 	"encoding/json"
-	"expvar"
 	"flag"
 	"fmt"
 
@@ -16,13 +15,18 @@ import (
 	"time"
 
 	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func makeHandler(fn func(http.ResponseWriter, *http.Request, sitecontext), ctx sitecontext) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fn(w, r, ctx)
-		totalRequests.Add(1)
+		t0 := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		fn(sr, r, ctx)
+		if ctx.Cfg != nil {
+			ctx.Cfg.Metrics.Request(r, sr.Status(), sr.bytes, time.Since(t0))
+		}
 	}
 }
 
@@ -48,61 +52,15 @@ func logTop(handler http.Handler, nodeName string, sl log.Logger) http.Handler {
 	})
 }
 
-var (
-	resizeQueueLength  *expvar.Int
-	numNeighbors       *expvar.Int
-	neighborFailures   *expvar.Int
-	corruptedImages    *expvar.Int
-	repairedImages     *expvar.Int
-	unrepairableImages *expvar.Int
-	verifiedImages     *expvar.Int
-	verifierPass       *expvar.Int
-
-	rebalanceFailures  *expvar.Int
-	rebalanceSuccesses *expvar.Int
-	rebalanceCleanups  *expvar.Int
-
-	servedLocally *expvar.Int
-
-	resizeFailures *expvar.Int
-	servedScaled   *expvar.Int
-
-	totalRequests *expvar.Int
-
-	expUptime *expvar.Int
-)
-
-func init() {
-	// prep expvar values
-	resizeQueueLength = expvar.NewInt("resizeQueue")
-	numNeighbors = expvar.NewInt("numNeighbors")
-	neighborFailures = expvar.NewInt("neighborFailures")
-	corruptedImages = expvar.NewInt("corruptedImages")
-	repairedImages = expvar.NewInt("repairedImages")
-	unrepairableImages = expvar.NewInt("unrepairableImages")
-	verifiedImages = expvar.NewInt("verifiedImages")
-	verifierPass = expvar.NewInt("verifierPass")
-	rebalanceFailures = expvar.NewInt("rebalanceFailures")
-	rebalanceSuccesses = expvar.NewInt("rebalanceSuccesses")
-	rebalanceCleanups = expvar.NewInt("rebalanceCleanups")
-
-	servedLocally = expvar.NewInt("servedLocally")
-
-	resizeFailures = expvar.NewInt("resizeFailures")
-	servedScaled = expvar.NewInt("servedScaled")
-
-	totalRequests = expvar.NewInt("totalRequests")
-
-	expUptime = expvar.NewInt("uptime")
-}
-
 func main() {
 	sl := newSTDLogger()
 	_ = sl.Log("level", "INFO", "msg", "starting logger")
 
 	// read the config file
 	var configfile string
+	var rebuild bool
 	flag.StringVar(&configfile, "config", "./config.json", "JSON config file")
+	flag.BoolVar(&rebuild, "rebuild-index", false, "rebuild the local image index from disk and exit")
 	flag.Parse()
 
 	file, err := os.ReadFile(configfile)
@@ -119,21 +77,157 @@ func main() {
 	}
 
 	siteconfig := f.MyConfig()
+	siteconfig.Metrics = newMetrics(prometheus.DefaultRegisterer)
+	if siteconfig.PurgeWebhookURL != "" {
+		p := newWebhookPurger(siteconfig.PurgeWebhookURL, siteconfig.PurgeQueueSize,
+			log.With(sl, "component", "purge"))
+		p.metrics = siteconfig.Metrics
+		go p.Run()
+		siteconfig.Purge = newPurgeNotifier(p, siteconfig.PurgeBaseURL, siteconfig.SurrogateKeys)
+		siteconfig.Backend = diskBackend{Root: siteconfig.UploadDirectory, Purge: siteconfig.Purge}
+	}
+	if len(siteconfig.Webhooks) > 0 {
+		outbox, err := openWebhookOutbox(siteconfig.WebhookOutboxFile, siteconfig.WebhookOutboxSize)
+		if err != nil {
+			_ = sl.Log("level", "ERR", "msg", "could not load webhook outbox", "error", err.Error())
+			os.Exit(1)
+		}
+		siteconfig.Events = newEventNotifier(siteconfig.Webhooks, outbox, log.With(sl, "component", "webhooks"))
+		siteconfig.Events.metrics = siteconfig.Metrics
+		siteconfig.Events.replication = siteconfig.Replication
+		siteconfig.Events.minReplication = siteconfig.MinReplication
+		go siteconfig.Events.Run()
+	}
+	if siteconfig.IndexFile != "" {
+		idx, err := openImageIndex(siteconfig.IndexFile)
+		if err != nil {
+			_ = sl.Log("level", "ERR", "msg", "could not open index", "error", err.Error())
+			os.Exit(1)
+		}
+		defer func() { _ = idx.Close() }()
+		siteconfig.Index = idx
+		siteconfig.Backend = diskBackend{Root: siteconfig.UploadDirectory, Index: idx, Purge: siteconfig.Purge}
+	}
+	var jbod *jbodBackend
+	if len(siteconfig.Disks) > 0 {
+		jbod = newJbodBackend(siteconfig.Disks, siteconfig.Index, log.With(sl, "component", "jbod"))
+		jbod.Purge = siteconfig.Purge
+		jbod.Metrics = siteconfig.Metrics
+		jbod.Check()
+		siteconfig.Backend = jbod
+	}
+	if idx := siteconfig.Index; idx != nil {
+		if rebuild {
+			err = rebuildIndex(idx, siteconfig.imageRoots()...)
+			if err != nil {
+				_ = sl.Log("level", "ERR", "msg", "could not rebuild index", "error", err.Error())
+				_ = idx.Close()
+				os.Exit(1)
+			}
+			_ = sl.Log("level", "INFO", "msg", "rebuilt index", "images", idx.Len())
+			return
+		}
+		if !idx.Complete() {
+			// a new index on a node that already has images, or
+			// one that wasn't closed cleanly last time. until this
+			// finishes, misses get checked on disk
+			go func() {
+				added, err := backfillIndex(idx, siteconfig.imageRoots()...)
+				if err != nil {
+					_ = sl.Log("level", "ERR", "msg", "could not backfill index", "error", err.Error())
+					return
+				}
+				_ = sl.Log("level", "INFO", "msg", "backfilled index", "images", added)
+			}()
+		}
+	}
+
+	if siteconfig.UploadDirectory != "" {
+		// anything left over from before we started is from a
+		// write that never finished
+		started := time.Now()
+		roots := siteconfig.imageRoots()
+		if jbod != nil {
+			roots = append(roots, siteconfig.UploadDirectory)
+		}
+		go func() {
+			var removed = 0
+			for _, root := range roots {
+				removed += cleanStaleTemps(root, started, sl)
+			}
+			_ = sl.Log("level", "INFO", "msg", "cleaned up stale temp files", "removed", removed)
+		}()
+	}
+	if jbod != nil {
+		go jbod.Run()
+	}
+	if siteconfig.DerivativeCacheBytes > 0 {
+		siteconfig.Derivatives = newDerivativeCache(siteconfig.DerivativeCacheBytes, siteconfig.Index,
+			log.With(sl, "component", "derivatives"))
+		siteconfig.Derivatives.metrics = siteconfig.Metrics
+		go siteconfig.Derivatives.Run(siteconfig.imageRoots())
+		// so that deleting one some other way stops counting it
+		if d, ok := siteconfig.Backend.(diskBackend); ok {
+			d.Derivatives = siteconfig.Derivatives
+			siteconfig.Backend = d
+		}
+		if jbod != nil {
+			jbod.Derivatives = siteconfig.Derivatives
+		}
+	}
+	if siteconfig.GroupCacheSize > 0 {
+		siteconfig.ImageCache = newImageCache(siteconfig.GroupCacheSize, siteconfig.GroupCacheShared)
+		siteconfig.ImageCache.metrics = siteconfig.Metrics
+	}
+	if siteconfig.EdgeCacheBytes > 0 {
+		if siteconfig.Writeable {
+			// it has its own copies of the images it's meant to have
+			_ = sl.Log("level", "WARN", "msg", "ignoring EdgeCacheBytes on a writeable node")
+		} else {
+			siteconfig.EdgeCache = newEdgeCache(siteconfig.EdgeCacheDirectory, siteconfig.EdgeCacheBytes,
+				log.With(sl, "component", "edge_cache"))
+			siteconfig.EdgeCache.metrics = siteconfig.Metrics
+			if err := siteconfig.EdgeCache.Load(); err != nil {
+				_ = sl.Log("level", "ERR", "msg", "could not load edge cache", "error", err.Error())
+				os.Exit(1)
+			}
+		}
+	}
+
+	if siteconfig.HintsFile != "" {
+		hints, err := openHintStore(siteconfig.HintsFile)
+		if err != nil {
+			_ = sl.Log("level", "ERR", "msg", "could not load hints", "error", err.Error())
+			os.Exit(1)
+		}
+		siteconfig.Hints = hints
+	}
 
 	c := newCluster(f.MyNode())
-	for i := range f.Neighbors {
-		c.AddNeighbor(f.Neighbors[i])
+	c.hints = siteconfig.Hints
+	c.missTTL = time.Duration(siteconfig.MissCacheTTL) * time.Second
+	c.purge = siteconfig.Purge
+	c.events = siteconfig.Events
+	c.metrics = siteconfig.Metrics
+	c.derivatives = siteconfig.Derivatives
+	siteconfig.Activity = newActivityFeed()
+	siteconfig.Activity.metrics = siteconfig.Metrics
+	c.activity = siteconfig.Activity
+	neighbors := f.Neighbors
+	if siteconfig.StateFile != "" {
+		state, err := loadClusterState(siteconfig.StateFile)
+		if err != nil {
+			_ = sl.Log("level", "WARN", "msg", "could not load cluster state",
+				"path", siteconfig.StateFile, "error", err.Error())
+		}
+		neighbors = mergeNeighbors(f.Neighbors, state.Neighbors, f.UUID)
+	}
+	for i := range neighbors {
+		c.AddNeighbor(neighbors[i])
 	}
 
 	runtime.GOMAXPROCS(siteconfig.GoMaxProcs)
 
-	go func() {
-		// update uptime
-		for {
-			time.Sleep(1 * time.Second)
-			expUptime.Add(1)
-		}
-	}()
 	rwSL := log.With(sl, "component", "resize_worker")
 	// start our resize worker goroutines
 	var channels = sharedChannels{
@@ -143,21 +237,37 @@ func main() {
 		go resizeWorker(channels.ResizeQueue, rwSL, &siteconfig)
 	}
 
+	// find out how much room we have before telling anyone
+	capacity := newCapacityMonitor(c, siteconfig, log.With(sl, "component", "capacity"))
+	capacity.check()
+	go capacity.Run()
+
 	gSL := log.With(sl, "component", "gossiper")
 	// start our gossiper
 	go c.Gossip(int(f.Port), siteconfig.GossiperSleep, gSL)
+	if siteconfig.StateFile != "" {
+		go c.PersistState(siteconfig.StateFile, siteconfig.GossiperSleep, gSL)
+	}
 
 	// seed the RNG
 	rand.New(rand.NewSource(time.Now().UnixNano()))
 	vSL := log.With(sl, "component", "verifier")
 	go verify(c, siteconfig, vSL)
+	rSL := log.With(sl, "component", "rebalancer")
+	go newRingRebalancer(c, siteconfig, rSL).Run()
+	go newHintedHandoff(c, siteconfig, log.With(sl, "component", "handoff")).Run()
+	antiEntropy := newAntiEntropy(c, siteconfig, log.With(sl, "component", "anti_entropy"))
+	go antiEntropy.Run(siteconfig.AntiEntropySleep)
+	placement := newPlacementReport(c, siteconfig, antiEntropy, log.With(sl, "component", "placement"))
+	go placement.Run(siteconfig.PlacementInterval)
 
 	imageView := NewImageView(c, siteconfig.Backend, &siteconfig, channels, sl)
 	uploadView := NewUploadView(c, siteconfig.Backend, &siteconfig, channels, sl)
 	stashView := NewStashView(c, siteconfig.Backend, &siteconfig, channels, sl)
 	retrieveInfoView := NewRetrieveInfoView(c, &siteconfig, sl)
 	retrieveView := NewRetrieveView(imageView, sl)
-	ctx := sitecontext{cluster: c, Cfg: &siteconfig, Ch: channels, SL: sl, ImageView: imageView, UploadView: uploadView, StashView: stashView, RetrieveInfoView: retrieveInfoView, RetrieveView: retrieveView}
+	drainer := newDrainer(c, siteconfig, log.With(sl, "component", "drainer"))
+	ctx := sitecontext{cluster: c, Cfg: &siteconfig, Ch: channels, SL: sl, ImageView: imageView, UploadView: uploadView, StashView: stashView, RetrieveInfoView: retrieveInfoView, RetrieveView: retrieveView, Drainer: drainer, AntiEntropy: antiEntropy, Placement: placement}
 	// set up HTTP Handlers
 
 	mux := http.NewServeMux()
@@ -165,20 +275,37 @@ func main() {
 	mux.HandleFunc("GET /logs/", makeHandler(logsHandler, ctx))
 	mux.HandleFunc("POST /", makeHandler(postAddHandler, ctx))
 	mux.HandleFunc("POST /stash/", makeHandler(stashHandler, ctx))
+	mux.HandleFunc("PUT /stash/{hash}/{ext}", makeHandler(putStashHandler, ctx))
 	mux.HandleFunc("GET /image/{hash}/{size}/{filename}", makeHandler(serveImageHandler, ctx))
 	mux.HandleFunc("GET /retrieve/{hash}/{size}/{ext}/", makeHandler(retrieveHandler, ctx))
 	mux.HandleFunc("GET /retrieve_info/{hash}/{size}/{ext}/", makeHandler(retrieveInfoHandler, ctx))
+	mux.HandleFunc("POST /retrieve_info/batch/", makeHandler(retrieveInfoBatchHandler, ctx))
 	mux.HandleFunc("GET /announce/", makeHandler(getAnnounceHandler, ctx))
 	mux.HandleFunc("POST /announce/", makeHandler(postAnnounceHandler, ctx))
 	mux.HandleFunc("GET /status/", makeHandler(statusHandler, ctx))
 	mux.HandleFunc("GET /dashboard/", makeHandler(dashboardHandler, ctx))
+	mux.HandleFunc("GET /dashboard/events", makeHandler(activityHandler, ctx))
 	mux.HandleFunc("GET /config/", makeHandler(configHandler, ctx))
 	mux.HandleFunc("GET /join/", makeHandler(getJoinHandler, ctx))
 	mux.HandleFunc("POST /join/", makeHandler(postJoinHandler, ctx))
+	mux.HandleFunc("GET /drain/", makeHandler(getDrainHandler, ctx))
+	mux.HandleFunc("POST /drain/", makeHandler(postDrainHandler, ctx))
+	mux.HandleFunc("GET /merkle/{uuid}/{prefix...}", makeHandler(merkleHandler, ctx))
+	mux.HandleFunc("GET /inventory/", makeHandler(inventoryHandler, ctx))
+	mux.HandleFunc("GET /inventory/{prefix}", makeHandler(inventoryHandler, ctx))
+	mux.HandleFunc("GET /api/v1/status", makeHandler(apiStatusHandler, ctx))
+	mux.HandleFunc("GET /api/v1/config", makeHandler(apiConfigHandler, ctx))
+	mux.HandleFunc("GET /api/v1/myself", makeHandler(apiMyselfHandler, ctx))
+	mux.HandleFunc("GET /api/v1/neighbors", makeHandler(apiNeighborsHandler, ctx))
+	mux.HandleFunc("GET /api/v1/disks", makeHandler(apiDisksHandler, ctx))
+	mux.HandleFunc("GET /api/v1/activity", makeHandler(apiActivityHandler, ctx))
+	mux.HandleFunc("GET /api/v1/logs", makeHandler(apiLogsHandler, ctx))
+	mux.HandleFunc("GET /api/v1/images/{hash}/{ext}", makeHandler(apiImageHandler, ctx))
+	mux.HandleFunc("GET /api/v1/placement", makeHandler(apiPlacementReportHandler, ctx))
 	mux.HandleFunc("GET /favicon.ico", faviconHandler)
 	mux.HandleFunc("GET /metrics", promhttp.Handler().ServeHTTP)
 
-	hs := http.Server{Addr: fmt.Sprintf(":%d", f.Port), Handler: logTop(mux, c.Myself.Nickname, sl)}
+	hs := http.Server{Addr: fmt.Sprintf(":%d", f.Port), Handler: logTop(mux, c.GetMyself().Nickname, sl)}
 	// everything is ready, let's go
 	go func() {
 		if err := hs.ListenAndServe(); err != nil {
@@ -199,4 +326,9 @@ func main() {
 	} else {
 		_ = sl.Log("level", "INFO", "msg", "Server stopped")
 	}
+	if siteconfig.StateFile != "" {
+		if err = saveClusterState(siteconfig.StateFile, c.GetNeighbors()); err != nil {
+			_ = sl.Log("level", "ERR", "msg", "could not save cluster state", "error", err)
+		}
+	}
 }
@@ -3,9 +3,9 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"os"
 
 	"github.com/go-kit/log"
+	"github.com/thraxil/resize"
 )
 
 // RetrieveInfoView encapsulates the business logic for retrieving image info.
@@ -36,13 +36,7 @@ func (v *RetrieveInfoView) GetImageInfo(hash, size, ext string) ([]byte, error)
 		return nil, fmt.Errorf("bad hash: %w", err)
 	}
 	extension := "." + ext
-	var local = true
-	baseDir := v.siteConfig.UploadDirectory + ahash.AsPath()
-	path := baseDir + "/full" + extension
-	_, err = os.Open(path)
-	if err != nil {
-		local = false
-	}
+	var local = v.haveFullsize(ahash, extension)
 
 	// if we aren't writeable, we can't resize locally
 	// let them know this as early as possible
@@ -50,8 +44,8 @@ func (v *RetrieveInfoView) GetImageInfo(hash, size, ext string) ([]byte, error)
 	if size != "full" && !n.Writeable {
 		// anything other than full-size, we can't do
 		// if we don't have it already
-		_, err = os.Open(baseDir + "/" + size + extension)
-		if err != nil {
+		sized := imageSpecifier{ahash, resize.MakeSizeSpec(size), extension}
+		if !v.siteConfig.Backend.Exists(sized) {
 			local = false
 		}
 	}
@@ -63,3 +57,38 @@ func (v *RetrieveInfoView) GetImageInfo(hash, size, ext string) ([]byte, error)
 	}
 	return b, nil
 }
+
+func (v *RetrieveInfoView) haveFullsize(ahash *hash, extension string) bool {
+	full := imageSpecifier{ahash, resize.MakeSizeSpec("full"), extension}
+	return v.siteConfig.Backend.Exists(full)
+}
+
+// the most images we'll look up in one batch request
+const maxInfoBatch = 1000
+
+// GetImageInfoBatch is GetImageInfo for a list of full-size
+// images at once. It returns the JSON marshalled list of
+// imageInfoResponses, in the same order as they were asked for.
+func (v *RetrieveInfoView) GetImageInfoBatch(reqs []imageInfoRequest) ([]byte, error) {
+	if len(reqs) > maxInfoBatch {
+		return nil, fmt.Errorf("batch too large: %d > %d", len(reqs), maxInfoBatch)
+	}
+	responses := make([]imageInfoResponse, 0, len(reqs))
+	for _, req := range reqs {
+		ahash, err := hashFromString(req.Hash, "")
+		if err != nil {
+			return nil, fmt.Errorf("bad hash: %w", err)
+		}
+		responses = append(responses, imageInfoResponse{
+			Hash:      ahash.String(),
+			Extension: req.Extension,
+			Local:     v.haveFullsize(ahash, req.Extension),
+		})
+	}
+	b, err := json.Marshal(responses)
+	if err != nil {
+		_ = v.logger.Log("level", "ERR", "msg", "error marshalling image info", "error", err.Error())
+		return nil, fmt.Errorf("failed to marshal image info: %w", err)
+	}
+	return b, nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 
 	"github.com/go-kit/log"
 	"github.com/thraxil/resize"
@@ -26,18 +27,12 @@ func NewRetrieveView(
 }
 
 // RetrieveImage retrieves and processes an image based on the image specifier parts.
-// It returns the image data, Etag, and an error.
-func (v *RetrieveView) RetrieveImage(ctx context.Context, hash, size, ext, ifNoneMatch string) ([]byte, string, error) {
-	ahash, err := hashFromString(hash, "")
+// It returns the image data, Etag, and an error. The caller must
+// close the returned reader.
+func (v *RetrieveView) RetrieveImage(ctx context.Context, hash, size, ext, ifNoneMatch string) (io.ReadCloser, string, error) {
+	ri, err := retrieveSpec(hash, size, ext)
 	if err != nil {
-		return nil, "", fmt.Errorf("bad hash: %w", err)
-	}
-	extension := "." + ext
-
-	ri := &imageSpecifier{
-		ahash,
-		resize.MakeSizeSpec(size),
-		extension,
+		return nil, "", err
 	}
 
 	// Delegate to ImageView's GetImage logic
@@ -50,3 +45,25 @@ func (v *RetrieveView) RetrieveImage(ctx context.Context, hash, size, ext, ifNon
 
 	return imgData, etag, nil
 }
+
+// HeadImage reports on an image that this node has (or can make)
+// without going to the rest of the cluster.
+func (v *RetrieveView) HeadImage(ctx context.Context, hash, size, ext string) (imageHead, error) {
+	ri, err := retrieveSpec(hash, size, ext)
+	if err != nil {
+		return imageHead{}, err
+	}
+	return v.imageView.HeadImage(ctx, ri, false)
+}
+
+func retrieveSpec(hash, size, ext string) (*imageSpecifier, error) {
+	ahash, err := hashFromString(hash, "")
+	if err != nil {
+		return nil, fmt.Errorf("bad hash: %w", err)
+	}
+	return &imageSpecifier{
+		ahash,
+		resize.MakeSizeSpec(size),
+		"." + ext,
+	}, nil
+}
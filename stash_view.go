@@ -3,13 +3,16 @@ package main
 import (
 	"context"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/go-kit/log"
+	"github.com/thraxil/resize"
 )
 
 // StashView encapsulates the business logic for stashing images.
@@ -45,11 +48,18 @@ func (v *StashView) StashImage(
 	imageFile io.ReadSeeker, // io.ReadSeeker for seek operations
 	fileHeader *multipart.FileHeader,
 	sizeHints string,
+	hintFor string,
 ) (string, error) {
 	n := v.cluster.GetMyself()
 	if !n.Writeable {
 		return "", fmt.Errorf("non-writeable node")
 	}
+	if n.Draining {
+		return "", fmt.Errorf("non-writeable node: draining")
+	}
+	if n.Full {
+		return "", fmt.Errorf("non-writeable node: full")
+	}
 
 	// Determine mimetype and extension
 	mimetype := fileHeader.Header.Get("Content-Type")
@@ -67,19 +77,27 @@ func (v *StashView) StashImage(
 
 	_, _ = imageFile.Seek(0, io.SeekStart)
 
-	path := v.siteConfig.UploadDirectory + "/" + ahash.AsPath()
-	_ = os.MkdirAll(path, 0755)
-	fullpath := path + "/full." + ext
-	f, err := os.OpenFile(fullpath, os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		_ = v.logger.Log("level", "ERR", "msg", "error opening file for stashing", "error", err.Error())
-		return "", fmt.Errorf("failed to open file for stashing: %w", err)
+	ri := imageSpecifier{
+		ahash,
+		resize.MakeSizeSpec("full"),
+		"." + ext,
 	}
-	defer func() { _ = f.Close() }()
-	_, err = io.Copy(f, imageFile)
-	if err != nil {
-		_ = v.logger.Log("level", "ERR", "msg", "error copying file for stashing", "error", err.Error())
-		return "", fmt.Errorf("failed to copy file for stashing: %w", err)
+	return v.store(ri, imageFile, sizeHints, hintFor)
+}
+
+// write a stashed image that we know is good, and take
+// care of everything that goes along with that
+func (v *StashView) store(ri imageSpecifier, imageFile io.Reader, sizeHints string, hintFor string) (string, error) {
+	if err := v.backend.WriteFull(ri, io.NopCloser(imageFile)); err != nil {
+		_ = v.logger.Log("level", "ERR", "msg", "error writing file for stashing", "error", err.Error())
+		return "", fmt.Errorf("failed to write file for stashing: %w", err)
+	}
+	fullpath := v.backend.fullPath(ri)
+	if hintFor != "" {
+		// we're holding this on behalf of another node
+		if err := v.siteConfig.Hints.Add(hintFor, ri); err != nil {
+			_ = v.logger.Log("level", "ERR", "msg", "could not save hint", "error", err.Error())
+		}
 	}
 
 	// do any eager resizing in the background
@@ -90,13 +108,85 @@ func (v *StashView) StashImage(
 				continue
 			}
 			c := make(chan resizeResponse)
-			v.channels.ResizeQueue <- resizeRequest{fullpath, "." + ext, size, c}
+			v.channels.ResizeQueue <- resizeRequest{fullpath, ri.Extension, size, c}
 			result := <-c
 			if !result.Success {
 				_ = v.logger.Log("level", "ERR", "msg", "could not pre-resize")
 			}
 		}
 	}()
-	v.cluster.Stashed(imageRecord{*ahash, "." + ext})
+	v.cluster.Stashed(imageRecord{*ri.Hash, ri.Extension})
 	return "ok", nil
 }
+
+// the sender's SHA-1 of the body of a raw stash
+const expectedDigestHeader = "X-Expected-Sha1"
+
+var errDigestMismatch = errors.New("digest mismatch")
+
+// StashRaw handles a stash where the body is just the image and
+// the sender has told us what its hash should be. The body is
+// written to a temp file as it comes in and only stored once
+// it checks out. A mismatch returns errDigestMismatch.
+func (v *StashView) StashRaw(
+	ctx context.Context,
+	hashStr string,
+	ext string,
+	expected string,
+	body io.Reader,
+	sizeHints string,
+	hintFor string,
+) (string, error) {
+	n := v.cluster.GetMyself()
+	if !n.Writeable {
+		return "", fmt.Errorf("non-writeable node")
+	}
+	if n.Draining {
+		return "", fmt.Errorf("non-writeable node: draining")
+	}
+	if n.Full {
+		return "", fmt.Errorf("non-writeable node: full")
+	}
+	ahash, err := hashFromString(hashStr, "")
+	if err != nil {
+		return "", fmt.Errorf("bad hash: %w", err)
+	}
+	if _, ok := extmimes["."+ext]; !ok {
+		return "", fmt.Errorf("unsupported image type: %s", ext)
+	}
+	if expected != ahash.String() {
+		return "", fmt.Errorf("bad request: %s header doesn't match the hash", expectedDigestHeader)
+	}
+
+	ri := imageSpecifier{ahash, resize.MakeSizeSpec("full"), "." + ext}
+	// receive it next to where it's going, so that it's on the
+	// same disk (and cleaned up with the other temp files there)
+	dir := v.siteConfig.UploadDirectory
+	if dest := v.backend.fullPath(ri); dest != "" {
+		dir = filepath.Dir(dest)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", fmt.Errorf("failed to create directory for stashing: %w", err)
+		}
+	}
+	tmp, err := os.CreateTemp(dir, "stash-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file for stashing: %w", err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	h := sha1.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), body); err != nil {
+		return "", fmt.Errorf("failed to receive image for stashing: %w", err)
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); got != expected {
+		_ = v.logger.Log("level", "WARN", "msg", "stashed image didn't match its digest",
+			"expected", expected, "got", got)
+		return "", errDigestMismatch
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return v.store(ri, tmp, sizeHints, hintFor)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// what we remember about the cluster between restarts
+type clusterState struct {
+	Saved     time.Time  `json:"saved"`
+	Neighbors []nodeData `json:"neighbors"`
+}
+
+func saveClusterState(path string, neighbors []nodeData) error {
+	b, err := json.MarshalIndent(clusterState{Saved: time.Now(), Neighbors: neighbors}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b, 0644)
+}
+
+// a missing state file just means we haven't saved one yet
+func loadClusterState(path string) (clusterState, error) {
+	var state clusterState
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(b, &state)
+	return state, err
+}
+
+// the config file is authoritative about who a configured
+// neighbor is, but the saved state knows how they were doing
+// when we went down and about anyone we learned of since.
+func mergeNeighbors(configured, saved []nodeData, myUUID string) []nodeData {
+	merged := make([]nodeData, 0, len(configured)+len(saved))
+	index := make(map[string]int)
+	for _, n := range configured {
+		index[n.UUID] = len(merged)
+		merged = append(merged, n)
+	}
+	for _, n := range saved {
+		if n.UUID == "" || n.UUID == myUUID {
+			continue
+		}
+		i, ok := index[n.UUID]
+		if !ok {
+			index[n.UUID] = len(merged)
+			merged = append(merged, n)
+			continue
+		}
+		merged[i].LastSeen = n.LastSeen
+		merged[i].LastFailed = n.LastFailed
+		merged[i].Draining = n.Draining
+	}
+	return merged
+}
+
+// periodically saves what we know about our neighbors
+// run this as a goroutine
+func (c *cluster) PersistState(path string, interval int, sl log.Logger) {
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+		if err := saveClusterState(path, c.GetNeighbors()); err != nil {
+			_ = sl.Log("level", "ERR", "msg", "could not save cluster state",
+				"path", path, "error", err.Error())
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_clusterStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	state, err := loadClusterState(path)
+	if err != nil {
+		t.Fatalf("missing state file should not be an error: %v", err)
+	}
+	if len(state.Neighbors) != 0 {
+		t.Error("expected no neighbors")
+	}
+
+	seen := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	neighbors := []nodeData{
+		{Nickname: "n1", UUID: "n1-uuid", BaseURL: "localhost:8081", Writeable: true, LastSeen: seen},
+	}
+	if err := saveClusterState(path, neighbors); err != nil {
+		t.Fatal(err)
+	}
+	state, err = loadClusterState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Neighbors) != 1 || !state.Neighbors[0].LastSeen.Equal(seen) {
+		t.Errorf("state didn't survive the round trip: %+v", state)
+	}
+
+	// no temp files left behind
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*.tmp"))
+	if len(matches) != 0 {
+		t.Errorf("leftover temp files: %v", matches)
+	}
+}
+
+func Test_loadClusterStateCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	_ = os.WriteFile(path, []byte("{not json"), 0644)
+	if _, err := loadClusterState(path); err == nil {
+		t.Error("expected an error for a corrupt state file")
+	}
+}
+
+func Test_mergeNeighbors(t *testing.T) {
+	seen := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	configured := []nodeData{
+		{Nickname: "n1", UUID: "n1-uuid", BaseURL: "new.example.com", Writeable: true},
+	}
+	saved := []nodeData{
+		{Nickname: "old-n1", UUID: "n1-uuid", BaseURL: "old.example.com", LastSeen: seen},
+		{Nickname: "n2", UUID: "n2-uuid", BaseURL: "gossiped.example.com"},
+		{Nickname: "me", UUID: "my-uuid"},
+	}
+	merged := mergeNeighbors(configured, saved, "my-uuid")
+	if len(merged) != 2 {
+		t.Fatalf("expected 2 neighbors, got %d", len(merged))
+	}
+	if merged[0].BaseURL != "new.example.com" || merged[0].Nickname != "n1" {
+		t.Error("config should win on identity")
+	}
+	if !merged[0].LastSeen.Equal(seen) {
+		t.Error("should have kept LastSeen from the saved state")
+	}
+	if merged[1].UUID != "n2-uuid" {
+		t.Error("should have kept neighbor learned via gossip")
+	}
+}
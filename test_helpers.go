@@ -5,8 +5,10 @@ import (
 )
 
 type mockBackend struct {
-	fullPathFunc func(ri imageSpecifier) string
-	ReadFunc     func(spec imageSpecifier) ([]byte, error)
+	fullPathFunc  func(ri imageSpecifier) string
+	ReadFunc      func(spec imageSpecifier) ([]byte, error)
+	WriteFullFunc func(ri imageSpecifier, f io.ReadCloser) error
+	ExistsFunc    func(ri imageSpecifier) bool
 }
 
 func (m mockBackend) String() string {
@@ -18,17 +20,27 @@ func (m mockBackend) WriteSized(ri imageSpecifier, f io.ReadCloser) error {
 }
 
 func (m mockBackend) WriteFull(ri imageSpecifier, f io.ReadCloser) error {
+	if m.WriteFullFunc != nil {
+		return m.WriteFullFunc(ri, f)
+	}
 	return nil
 }
 
-func (m mockBackend) Read(ri imageSpecifier) ([]byte, error) {
+func (m mockBackend) Read(ri imageSpecifier) (io.ReadCloser, error) {
 	if m.ReadFunc != nil {
-		return m.ReadFunc(ri)
+		b, err := m.ReadFunc(ri)
+		if err != nil {
+			return nil, err
+		}
+		return bytesReadCloser(b), nil
 	}
-	return nil, nil
+	return bytesReadCloser(nil), nil
 }
 
 func (m mockBackend) Exists(ri imageSpecifier) bool {
+	if m.ExistsFunc != nil {
+		return m.ExistsFunc(ri)
+	}
 	return false
 }
 
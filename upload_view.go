@@ -84,6 +84,7 @@ func (v *UploadView) UploadImage(
 		_ = v.logger.Log("level", "ERR", "msg", "error writing full image to backend", "error", err.Error())
 		return nil, fmt.Errorf("failed to write image to backend: %w", err)
 	}
+	v.siteConfig.Events.Fire(eventUploadAccepted, imageData{Hash: ahash.String(), Extension: ext})
 
 	// do any eager resizing in the background
 	go func() {
@@ -103,10 +104,17 @@ func (v *UploadView) UploadImage(
 	}()
 
 	// Stash to other nodes in the cluster
-	nodes := v.cluster.Stash(
+	savedTo := v.cluster.Stash(
 		ctx, ri, sizeHints, v.siteConfig.Replication,
 		v.siteConfig.MinReplication, v.backend,
 	)
+	// Stash leaves blanks for the copies it couldn't make
+	nodes := []string{}
+	for _, nickname := range savedTo {
+		if nickname != "" {
+			nodes = append(nodes, nickname)
+		}
+	}
 
 	// Prepare response data
 	id := imageData{
@@ -115,6 +123,14 @@ func (v *UploadView) UploadImage(
 		FullURL:   "/image/" + ahash.String() + "/full/image." + ext,
 		Satisfied: len(nodes) >= v.siteConfig.MinReplication,
 		Nodes:     nodes,
+		Replicas:  len(nodes),
+	}
+	// in between, it's up to the background processes to make the
+	// rest of the copies, and whichever makes the last one says so
+	if len(nodes) >= v.siteConfig.Replication {
+		v.siteConfig.Events.Fire(eventReplicationSatisfied, id)
+	} else if !id.Satisfied {
+		v.siteConfig.Events.Fire(eventReplicationFailed, id)
 	}
 	b, err := json.Marshal(id)
 	if err != nil {
@@ -49,28 +49,36 @@ func verifyImage(path string, extension string, hash *hash, ahash string,
 	//    VERIFY PHASE
 	if hash.String() != ahash {
 		_ = sl.Log("level", "WARN", "msg", "image appears to be corrupted!", "image", path)
-		corruptedImages.Add(1)
+		id := imageData{
+			Hash:      hash.String(),
+			Extension: strings.TrimPrefix(extension, "."),
+			Nodes:     []string{c.GetMyself().Nickname},
+		}
+		c.events.Fire(eventCorruptionDetected, id)
 		// trust that the hash was correct on upload
 		// ask other nodes for a copy
 		repaired, err := repairImage(path, extension, hash, c, sl)
 		if err != nil {
 			_ = sl.Log("level", "ERR", "msg", "error attempting to repair image", "error", err.Error())
+			c.metrics.Corrupted("unrepairable")
 			return err
 		}
 		if repaired {
-			repairedImages.Add(1)
-			err := clearCached(path, extension)
+			c.metrics.Corrupted("repaired")
+			sizes, err := clearCached(path, extension, c.derivatives)
+			// whatever a CDN has may have come from the broken one
+			c.purge.Image(hash, extension, append([]string{"full"}, sizes...), "repaired")
+			c.events.Fire(eventRepairCompleted, id)
 			if err != nil {
 				return err
 			}
 		} else {
 			_ = sl.Log("level", "ERR", "msg", "could not repair corrupted image", "image", path)
-			unrepairableImages.Add(1)
+			c.metrics.Corrupted("unrepairable")
 			// return here so we don't try to rebalance a corrupted image
 			return errors.New("unrepairable image")
 		}
 	}
-	verifiedImages.Add(1)
 	return nil
 }
 
@@ -79,7 +87,7 @@ func repairImage(path string, extension string, hash *hash,
 	c *cluster, sl log.Logger) (bool, error) {
 	nodesToCheck := c.ReadOrder(hash.String())
 	for _, n := range nodesToCheck {
-		if n.UUID == c.Myself.UUID {
+		if n.UUID == c.GetMyself().UUID {
 			// skip ourself, since we know we are corrupt
 			continue
 		}
@@ -91,17 +99,14 @@ func repairImage(path string, extension string, hash *hash,
 	return false, nil
 }
 
-func replaceImageWithCorrected(path string, img []byte, sl log.Logger) (bool, bool, error) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		// can't open for writing!
-		_ = sl.Log("level", "ERR", "msg", "could not open for writing", "image", path, "error", err.Error())
-		_ = f.Close()
-		return false, false, err
-	}
-	_, err = f.Write(img)
-	_ = f.Close()
-	if err != nil {
+// write the good copy alongside the bad one and swap it in, so
+// we never leave a half-written image in place
+func replaceImageWithCorrected(path string, r io.Reader, sl log.Logger) (bool, bool, error) {
+	if _, err := writeAtomic(path, r, 0644); err != nil {
+		if errors.Is(err, errCorruptReplica) {
+			// the copy from that node isn't right either
+			return true, true, nil
+		}
 		_ = sl.Log("level", "ERR", "msg", "could not write", "image", path, "error", err.Error())
 		return false, false, err
 	}
@@ -114,26 +119,43 @@ func checkImageOnNode(n nodeData, hash *hash, extension string, path string,
 	ri := &imageSpecifier{hash, s, extension}
 
 	ctx := context.Background()
-	img, err := n.RetrieveImage(ctx, ri)
+	body, err := n.RetrieveImage(ctx, ri)
 	if err != nil {
 		// doesn't have it
 		_ = sl.Log("level", "INFO", "node", n.Nickname,
 			"msg", "node does not have a copy of the desired image")
 		return true, true, nil
 	}
-	if !doublecheckReplica(img, hash) {
-		// the copy from that node isn't right either
-		return true, true, nil
+	defer func() { _ = body.Close() }()
+	return replaceImageWithCorrected(path, newVerifyingReader(body, hash), sl)
+}
+
+var errCorruptReplica = errors.New("replica does not match its hash")
+
+// verifyingReader passes through everything it reads while
+// taking its SHA-1. Instead of io.EOF, it returns errCorruptReplica
+// if what came through doesn't match the expected hash, so
+// whatever is copying from it gets an error rather than a bad image.
+type verifyingReader struct {
+	r        io.Reader
+	expected *hash
+	digest   interface {
+		io.Writer
+		Sum([]byte) []byte
 	}
-	return replaceImageWithCorrected(path, img, sl)
+}
 
+func newVerifyingReader(r io.Reader, expected *hash) *verifyingReader {
+	return &verifyingReader{r: r, expected: expected, digest: sha1.New()}
 }
 
-func doublecheckReplica(img []byte, hash *hash) bool {
-	hn := sha1.New()
-	_, _ = hn.Write(img)
-	nhash := fmt.Sprintf("%x", hn.Sum(nil))
-	return nhash == hash.String()
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	_, _ = v.digest.Write(p[:n])
+	if err == io.EOF && fmt.Sprintf("%x", v.digest.Sum(nil)) != v.expected.String() {
+		return n, errCorruptReplica
+	}
+	return n, err
 }
 
 // the only File methods that we care about
@@ -146,23 +168,47 @@ type fileIsh interface {
 // cached sizes may have been created off the broken one
 // and the easiest solution is to take off
 // and nuke the site from orbit. It's the only way to be sure.
-func clearCached(path string, extension string) error {
+// Returns the sizes that there were.
+func clearCached(path string, extension string, d *derivativeCache) ([]string, error) {
 	files, err := os.ReadDir(filepath.Dir(path))
 	if err != nil {
 		// can't read the dir?!
-		return err
+		return nil, err
 	}
+	var sizes []string
 	var successfulPurge = true
 	for _, file := range files {
-		r := func(p string) error { return os.Remove(p) }
+		r := func(p string) error {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+			d.Forget(p)
+			return nil
+		}
 		err = clearCachedFile(file, path, extension, r)
 		successfulPurge = successfulPurge && (err == nil)
+		if size, ok := cachedSize(file, extension); ok {
+			sizes = append(sizes, size)
+		}
 	}
 	if !successfulPurge {
 		// one or more cached sizes were not deleted
-		return errors.New("could not clear potentially corrupted scaled image")
+		return sizes, errors.New("could not clear potentially corrupted scaled image")
 	}
-	return nil
+	return sizes, nil
+}
+
+// the size that a file next to the full-size image is, if it
+// is one
+func cachedSize(file fileIsh, extension string) (string, bool) {
+	if file.IsDir() || !strings.HasSuffix(file.Name(), extension) {
+		return "", false
+	}
+	size := strings.TrimSuffix(file.Name(), extension)
+	if size == "full" || size == "" {
+		return "", false
+	}
+	return size, true
 }
 
 type remover func(fullpath string) error
@@ -184,10 +230,52 @@ type imageRebalancer struct {
 	hash      *hash
 	path      string
 	extension string
+
+	// if set, what we already know about who has it
+	held replicaSet
 }
 
 func newImageRebalancer(path, extension string, hash *hash, c *cluster, s siteConfig, sl log.Logger) *imageRebalancer {
-	return &imageRebalancer{c, s, sl, hash, path, extension}
+	return &imageRebalancer{c, s, sl, hash, path, extension, nil}
+}
+
+// replicaSet records which nodes hold which full-size images,
+// keyed by node UUID and then hash+extension, so that rebalancing
+// a lot of images doesn't take a request per image per node.
+type replicaSet map[string]map[string]bool
+
+// whether the node has the image, and whether we asked it at all
+func (rs replicaSet) lookup(uuid string, ri imageSpecifier) (bool, bool) {
+	held, ok := rs[uuid]
+	if !ok {
+		return false, false
+	}
+	return held[ri.Hash.String()+ri.Extension], true
+}
+
+// checkReplicas asks each of the nodes about all of the images
+// in a single batch request. Nodes that couldn't be asked are
+// left out, and will get asked the slow way.
+func checkReplicas(ctx context.Context, nodes []nodeData, ris []imageSpecifier, myUUID string) replicaSet {
+	rs := make(replicaSet)
+	for i := range nodes {
+		n := &nodes[i]
+		if n.UUID == myUUID || n.UUID == "" {
+			continue
+		}
+		infos, err := n.RetrieveImageInfoBatch(ctx, ris)
+		if err != nil {
+			continue
+		}
+		held := make(map[string]bool)
+		for _, info := range infos {
+			if info.Local {
+				held[info.Hash+info.Extension] = true
+			}
+		}
+		rs[n.UUID] = held
+	}
+	return rs
 }
 
 // check that the image is stored in at least Replication nodes
@@ -200,37 +288,49 @@ func (r imageRebalancer) Rebalance() error {
 		return errors.New("nil cluster")
 	}
 	nodesToCheck := r.c.ReadOrder(r.hash.String())
-	satisfied, deleteLocal, foundReplicas := r.checkNodesForRebalance(nodesToCheck)
+	satisfied, deleteLocal, foundReplicas, stashed := r.checkNodesForRebalance(nodesToCheck)
 	if !satisfied {
 		_ = r.sl.Log("level", "WARN", "msg", "could not replicate",
 			"image", r.path, "replication", r.s.Replication)
-		rebalanceFailures.Add(1)
+		r.s.Metrics.Rebalanced(false)
 	} else {
 		_ = r.sl.Log("level", "INFO", "image", r.path,
 			"msg", "full replica set",
 			"foundReplicas", foundReplicas,
 			"desired_replicas", r.s.Replication)
-		rebalanceSuccesses.Add(1)
+		r.s.Metrics.Rebalanced(true)
+		if stashed > 0 {
+			replicaAdded(context.Background(), r.c, r.s, r.spec())
+		}
 	}
-	if satisfied && deleteLocal {
-		cleanUpExcessReplica(r.path, r.sl)
-		rebalanceCleanups.Add(1)
+	if satisfied && deleteLocal && len(r.s.Hints.ForHash(r.hash.String())) == 0 {
+		// (if we're holding it for someone, the handoff will
+		// take care of cleaning up once they have it)
+		cleanUpExcessReplica(r.path, r.s.Derivatives, r.sl)
+		_ = r.s.Index.Remove(r.hash)
+		r.s.Metrics.ReplicaCleanedUp()
 	}
 	return nil
 }
 
-func (r imageRebalancer) checkNodesForRebalance(nodesToCheck []nodeData) (bool, bool, int) {
+// also returns how many of the replicas it found were copies it
+// just made
+func (r imageRebalancer) checkNodesForRebalance(nodesToCheck []nodeData) (bool, bool, int, int) {
 	var satisfied = false
 	var foundReplicas = 0
+	var stashed = 0
 	var deleteLocal = true
 	// TODO: parallelize this
 	for _, n := range nodesToCheck {
-		if n.UUID == r.c.Myself.UUID {
+		if n.UUID == r.c.GetMyself().UUID {
 			// don't need to delete it
 			deleteLocal = false
 			foundReplicas++
-		} else {
-			foundReplicas = foundReplicas + r.retrieveReplica(&n, satisfied)
+		} else if held, ok := r.held.lookup(n.UUID, r.spec()); (ok && held) || (!ok && r.hasReplica(&n)) {
+			foundReplicas++
+		} else if r.stashReplica(&n, satisfied) > 0 {
+			foundReplicas++
+			stashed++
 		}
 		if foundReplicas >= r.s.Replication {
 			satisfied = true
@@ -239,10 +339,10 @@ func (r imageRebalancer) checkNodesForRebalance(nodesToCheck []nodeData) (bool,
 			// nothing more to do. other nodes that have excess
 			// copies are responsible for deletion. Our job
 			// is just to make sure the first N nodes have a copy
-			return satisfied, deleteLocal, foundReplicas
+			return satisfied, deleteLocal, foundReplicas, stashed
 		}
 	}
-	return satisfied, deleteLocal, foundReplicas
+	return satisfied, deleteLocal, foundReplicas, stashed
 }
 
 type stashableNode interface {
@@ -250,20 +350,22 @@ type stashableNode interface {
 	RetrieveImageInfo(context.Context, *imageSpecifier) (*imageInfoResponse, error)
 }
 
-func (r imageRebalancer) retrieveReplica(n stashableNode, satisfied bool) int {
+func (r imageRebalancer) spec() imageSpecifier {
+	return imageSpecifier{r.hash, resize.MakeSizeSpec("full"), r.extension}
+}
 
-	s := resize.MakeSizeSpec("full")
-	ri := &imageSpecifier{r.hash, s, r.extension}
+// node should have it. does it?
+func (r imageRebalancer) hasReplica(n stashableNode) bool {
+	ri := r.spec()
+	imgInfo, err := n.RetrieveImageInfo(context.Background(), &ri)
+	return err == nil && imgInfo != nil && imgInfo.Local
+}
 
-	ctx := context.Background()
-	imgInfo, err := n.RetrieveImageInfo(ctx, ri)
-	if err == nil && imgInfo != nil && imgInfo.Local {
-		// node should have it. node has it. cool.
-		return 1
-	}
-	// that node should have a copy, but doesn't so stash it
+// that node should have a copy, but doesn't so stash it
+func (r imageRebalancer) stashReplica(n stashableNode, satisfied bool) int {
+	ri := r.spec()
 	if !satisfied {
-		if n.Stash(ctx, *ri, "", r.s.Backend) {
+		if n.Stash(context.Background(), ri, "", r.s.Backend) {
 			_ = r.sl.Log("level", "INFO", "msg", "replicated", "image", r.path)
 			return 1
 		}
@@ -278,8 +380,15 @@ func (r imageRebalancer) retrieveReplica(n stashableNode, satisfied bool) int {
 
 // our node is not at the front of the list, so
 // we have an excess copy. clean that up and make room!
-func cleanUpExcessReplica(path string, sl log.Logger) {
-	err := os.RemoveAll(filepath.Dir(path))
+func cleanUpExcessReplica(path string, d *derivativeCache, sl log.Logger) {
+	dir := filepath.Dir(path)
+	files, _ := os.ReadDir(dir)
+	err := os.RemoveAll(dir)
+	if err == nil {
+		for _, f := range files {
+			d.Forget(filepath.Join(dir, f.Name()))
+		}
+	}
 	if err != nil {
 		_ = sl.Log("level", "ERR", "msg", "could not clear out excess replica", "image", path,
 			"error", err.Error())
@@ -308,10 +417,10 @@ func visitPreChecks(path string, f fileIsh, err error, c *cluster, sl log.Logger
 }
 
 func visit(path string, f os.FileInfo, err error, c *cluster,
-	s siteConfig, sl log.Logger) error {
+	s siteConfig, sl log.Logger, batch *verifiedBatch) error {
 	defer func() {
 		if r := recover(); r != nil {
-			_ = sl.Log("level", "ERR", "msg", "Error in verifier.visit()", "node", c.Myself.Nickname, "image", path,
+			_ = sl.Log("level", "ERR", "msg", "Error in verifier.visit()", "node", c.GetMyself().Nickname, "image", path,
 				"error", r)
 		}
 	}()
@@ -339,22 +448,27 @@ func visit(path string, f os.FileInfo, err error, c *cluster,
 		_ = sl.Log("level", "ERR", "msg", "error opening", "image", path, "error", err.Error())
 		return err
 	}
-	_, err = io.Copy(h, imgfile)
+	read, err := io.Copy(h, imgfile)
 	if err != nil {
 		_ = sl.Log("level", "ERR", "msg", "error copying", "image", path, "error", err.Error())
+		s.Metrics.Verified("failed", read)
 		return err
 	}
 	ahash := fmt.Sprintf("%x", h.Sum(nil))
 	err = verifyImage(path, extension, hash, ahash, c, sl)
 	if err != nil {
+		s.Metrics.Verified("failed", read)
 		return err
 	}
-	r := newImageRebalancer(path, extension, hash, c, s, sl)
-	err = r.Rebalance()
-	if err != nil {
-		return err
+	if hash.String() != ahash {
+		// repaired, and the cached sizes went with it
+		_ = s.Index.ClearSizes(hash)
+		s.Metrics.Verified("repaired", read)
+	} else {
+		s.Metrics.Verified("ok", read)
 	}
-	c.verified(imageRecord{*hash, extension})
+	_ = s.Index.Verified(hash)
+	batch.Add(movedImage{imageSpecifier{hash, resize.MakeSizeSpec("full"), extension}, path})
 	// slow things down a little to keep server load down
 	var baseTime = s.VerifierSleep
 	jitter := rand.Intn(5)
@@ -363,13 +477,62 @@ func visit(path string, f os.FileInfo, err error, c *cluster,
 }
 
 // makes a closure that has access to the cluster and config
-func makeVisitor(fn func(string, os.FileInfo, error, *cluster, siteConfig, log.Logger) error,
-	c *cluster, s siteConfig, sl log.Logger) func(path string, f os.FileInfo, err error) error {
+func makeVisitor(fn func(string, os.FileInfo, error, *cluster, siteConfig, log.Logger, *verifiedBatch) error,
+	c *cluster, s siteConfig, sl log.Logger, batch *verifiedBatch) func(path string, f os.FileInfo, err error) error {
 	return func(path string, f os.FileInfo, err error) error {
-		return fn(path, f, err, c, s, sl)
+		return fn(path, f, err, c, s, sl, batch)
+	}
+}
+
+// how many verified images to ask each node about at once. the
+// verifier sleeps between images, so this is also how far behind
+// rebalancing can get
+const verifierBatchSize = 20
+
+// verifiedBatch holds images that have been verified until there
+// are enough of them to check for replicas in one request per
+// node, and then rebalances them.
+type verifiedBatch struct {
+	c      *cluster
+	s      siteConfig
+	sl     log.Logger
+	images []movedImage
+}
+
+func newVerifiedBatch(c *cluster, s siteConfig, sl log.Logger) *verifiedBatch {
+	return &verifiedBatch{c: c, s: s, sl: sl}
+}
+
+func (b *verifiedBatch) Add(m movedImage) {
+	b.images = append(b.images, m)
+	if len(b.images) >= verifierBatchSize {
+		b.Flush()
 	}
 }
 
+// Flush rebalances whatever is waiting. nodes that don't answer
+// the batch request (older ones, say) get asked image by image
+func (b *verifiedBatch) Flush() {
+	if len(b.images) == 0 {
+		return
+	}
+	ris := make([]imageSpecifier, len(b.images))
+	for i, m := range b.images {
+		ris[i] = m.ri
+	}
+	held := checkReplicas(context.Background(), b.c.GetNeighbors(), ris, b.c.GetMyself().UUID)
+	for _, m := range b.images {
+		r := newImageRebalancer(m.path, m.ri.Extension, m.ri.Hash, b.c, b.s, b.sl)
+		r.held = held
+		if err := r.Rebalance(); err != nil {
+			_ = b.sl.Log("level", "ERR", "msg", "error rebalancing", "image", m.path, "error", err.Error())
+			continue
+		}
+		b.c.verified(imageRecord{*m.ri.Hash, m.ri.Extension})
+	}
+	b.images = nil
+}
+
 func verify(c *cluster, s siteConfig, sl log.Logger) {
 	_ = sl.Log("level", "INFO", "msg", "starting verifier")
 
@@ -381,13 +544,16 @@ func verify(c *cluster, s siteConfig, sl log.Logger) {
 		time.Sleep(time.Duration(baseTime+jitter) * time.Second)
 		_ = sl.Log("level", "INFO", "msg", "verifier starting at the top")
 
-		root := s.UploadDirectory
-		err := randwalk.Walk(root, makeVisitor(visit, c, s, sl))
-		if err != nil {
-			_ = sl.Log("level", "WARN", "msg", "randwalk.Walk() returned error",
-				"error", err.Error())
+		batch := newVerifiedBatch(c, s, sl)
+		for _, root := range s.imageRoots() {
+			err := randwalk.Walk(root, makeVisitor(visit, c, s, sl, batch))
+			if err != nil {
+				_ = sl.Log("level", "WARN", "msg", "randwalk.Walk() returned error",
+					"root", root, "error", err.Error())
+			}
 		}
-		verifierPass.Add(1)
+		batch.Flush()
+		s.Metrics.VerifierPass()
 		// offset should only be applied on the first pass through
 	}
 }
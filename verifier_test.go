@@ -2,8 +2,15 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/thraxil/resize"
 )
 
 func Test_hashStringFromPath(t *testing.T) {
@@ -75,7 +82,7 @@ func (s *sdummy) RetrieveImageInfo(context.Context, *imageSpecifier) (*imageInfo
 	return nil, nil
 }
 
-func Test_RetrieveReplica(t *testing.T) {
+func Test_StashReplica(t *testing.T) {
 	sl := newDummyLogger()
 	n := &sdummy{}
 	hash, err := hashFromString("fb682e05b9be61797601e60165825c0b089f755e", "")
@@ -86,11 +93,14 @@ func Test_RetrieveReplica(t *testing.T) {
 	_, c := makeNewClusterData(cn)
 	s := siteConfig{}
 	r := newImageRebalancer("foo", ".jpg", hash, c, s, sl)
-	result := r.retrieveReplica(n, true)
+	if r.hasReplica(n) {
+		t.Error("node doesn't have it")
+	}
+	result := r.stashReplica(n, true)
 	if result != 0 {
 		t.Error("satisfied == true should mean no retrieval")
 	}
-	result = r.retrieveReplica(n, false)
+	result = r.stashReplica(n, false)
 	if result != 0 {
 		t.Error("not satisfied but couldn't stash failed")
 	}
@@ -121,3 +131,66 @@ func Test_visitPreChecks(t *testing.T) {
 	}
 
 }
+
+func Test_cachedSize(t *testing.T) {
+	cases := []struct {
+		f    fdummy
+		size string
+		ok   bool
+	}{
+		{fdummy{NameValue: "100s.jpg"}, "100s", true},
+		{fdummy{NameValue: "full.jpg"}, "", false},
+		{fdummy{NameValue: "100s.jpg-123.tmp"}, "", false},
+		{fdummy{DirValue: true, NameValue: "100s.jpg"}, "", false},
+	}
+	for _, c := range cases {
+		size, ok := cachedSize(c.f, ".jpg")
+		if size != c.size || ok != c.ok {
+			t.Errorf("%v: expected %q %v, got %q %v", c.f, c.size, c.ok, size, ok)
+		}
+	}
+}
+
+func Test_verifiedBatch(t *testing.T) {
+	var batches, single int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/retrieve_info/batch/" {
+			atomic.AddInt32(&single, 1)
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&batches, 1)
+		var reqs []imageInfoRequest
+		_ = json.NewDecoder(r.Body).Decode(&reqs)
+		resps := make([]imageInfoResponse, len(reqs))
+		for i, req := range reqs {
+			resps[i] = imageInfoResponse{Hash: req.Hash, Extension: req.Extension, Local: true}
+		}
+		_ = json.NewEncoder(w).Encode(resps)
+	}))
+	defer server.Close()
+
+	_, c := makeNewClusterData([]nodeData{})
+	c.AddNeighbor(nodeData{Nickname: "neighbor", UUID: "neighbor-uuid", BaseURL: server.URL, Writeable: true})
+	c.Sync()
+	s := siteConfig{Replication: 2, MaxReplication: 2}
+	b := newVerifiedBatch(c, s, log.NewNopLogger())
+	for _, h := range []string{
+		"fb682e05b9be61797601e60165825c0b089f755e",
+		"0051ec03fb813e8731224ee06feee7c828ceae22",
+		"c1986af3c26609b8b7d8933f99c51c1a89e9ea6b",
+	} {
+		ah, _ := hashFromString(h, "")
+		b.Add(movedImage{imageSpecifier{ah, resize.MakeSizeSpec("full"), ".jpg"}, "/nonexistent/" + h})
+	}
+	if atomic.LoadInt32(&batches) != 0 {
+		t.Error("shouldn't ask until the batch is full or flushed")
+	}
+	b.Flush()
+	if atomic.LoadInt32(&batches) != 1 || atomic.LoadInt32(&single) != 0 {
+		t.Errorf("expected one batch request and no single ones, got %d and %d", batches, single)
+	}
+	if len(c.GetRecentlyVerified()) != 3 {
+		t.Errorf("all three should be recorded as verified, got %v", c.GetRecentlyVerified())
+	}
+}
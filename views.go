@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,6 +29,9 @@ type sitecontext struct {
 	StashView        *StashView
 	RetrieveInfoView *RetrieveInfoView
 	RetrieveView     *RetrieveView
+	Drainer          *drainer
+	AntiEntropy      *antiEntropy
+	Placement        *placementReport
 }
 
 type page struct {
@@ -41,14 +46,42 @@ type imageData struct {
 	FullURL   string   `json:"full_url"`
 	Satisfied bool     `json:"satisfied"`
 	Nodes     []string `json:"nodes"`
+	Replicas  int      `json:"replicas"`
 }
 
-func setCacheHeaders(w http.ResponseWriter, extension string) http.ResponseWriter {
-	w.Header().Set("Content-Type", extmimes[extension])
-	w.Header().Set("Expires", time.Now().Add(time.Hour*24*365).Format(time.RFC1123))
+// images are addressed by their hash, so they never change and
+// can be cached for as long as anyone likes
+func setCacheHeaders(w http.ResponseWriter, ri *imageSpecifier, cfg *siteConfig) http.ResponseWriter {
+	w.Header().Set("Content-Type", extmimes[ri.Extension])
+	if cfg.CacheControl != "" {
+		w.Header().Set("Cache-Control", cfg.CacheControl)
+	}
+	if cfg.SurrogateKeys {
+		// so a CDN can purge every size of the image at once
+		w.Header().Set("Surrogate-Key", ri.Hash.String())
+	}
 	return w
 }
 
+// errors and redirects might not be the final word (the image
+// could turn up, or the redirect could change), so those are
+// only cached briefly
+func setShortCacheHeaders(w http.ResponseWriter, cfg *siteConfig) {
+	if cfg.ShortCacheControl != "" {
+		w.Header().Set("Cache-Control", cfg.ShortCacheControl)
+	}
+}
+
+func imageError(w http.ResponseWriter, msg string, code int, cfg *siteConfig) {
+	setShortCacheHeaders(w, cfg)
+	http.Error(w, msg, code)
+}
+
+func imageRedirect(w http.ResponseWriter, r *http.Request, url string, cfg *siteConfig) {
+	setShortCacheHeaders(w, cfg)
+	http.Redirect(w, r, url, http.StatusMovedPermanently)
+}
+
 func parsePathServeImage(w http.ResponseWriter, r *http.Request,
 	ctx sitecontext) (*imageSpecifier, bool) {
 	hash := r.PathValue("hash")
@@ -57,17 +90,17 @@ func parsePathServeImage(w http.ResponseWriter, r *http.Request,
 
 	ahash, err := hashFromString(hash, "")
 	if err != nil {
-		http.Error(w, "invalid hash", http.StatusNotFound)
+		imageError(w, "invalid hash", http.StatusNotFound, ctx.Cfg)
 		return nil, true
 	}
 	if size == "" {
-		http.Error(w, "missing size", http.StatusNotFound)
+		imageError(w, "missing size", http.StatusNotFound, ctx.Cfg)
 		return nil, true
 	}
 	s := resize.MakeSizeSpec(size)
 	if s.String() != size {
 		// force normalization of size spec
-		http.Redirect(w, r, "/image/"+ahash.String()+"/"+s.String()+"/"+filename, http.StatusMovedPermanently)
+		imageRedirect(w, r, "/image/"+ahash.String()+"/"+s.String()+"/"+filename, ctx.Cfg)
 		return nil, true
 	}
 	if filename == "" {
@@ -77,7 +110,7 @@ func parsePathServeImage(w http.ResponseWriter, r *http.Request,
 
 	if extension == ".jpeg" {
 		fixedFilename := strings.Replace(filename, ".jpeg", ".jpg", 1)
-		http.Redirect(w, r, "/image/"+ahash.String()+"/"+s.String()+"/"+fixedFilename, http.StatusMovedPermanently)
+		imageRedirect(w, r, "/image/"+ahash.String()+"/"+s.String()+"/"+fixedFilename, ctx.Cfg)
 		return nil, true
 	}
 	ri := &imageSpecifier{ahash, s, extension}
@@ -94,21 +127,95 @@ func serveImageHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext)
 		return
 	}
 
+	if r.Method == http.MethodHead {
+		head, err := ctx.ImageView.HeadImage(r.Context(), ri, true)
+		if err != nil {
+			imageError(w, err.Error(), http.StatusNotFound, ctx.Cfg)
+			return
+		}
+		w = setCacheHeaders(w, ri, ctx.Cfg)
+		serveImageHead(w, r, head)
+		return
+	}
+
 	imgData, etag, err := ctx.ImageView.GetImage(r.Context(), ri)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound) // Use 404 for not found errors
+		imageError(w, err.Error(), http.StatusNotFound, ctx.Cfg) // Use 404 for not found errors
 		return
 	}
+	defer func() { _ = imgData.Close() }()
 
-	if r.Header.Get("If-None-Match") == etag {
-		w.WriteHeader(http.StatusNotModified)
+	w = setCacheHeaders(w, ri, ctx.Cfg)
+	serveImage(w, r, imgData, etag)
+	ctx.Cfg.Metrics.Served()
+}
+
+// serveImage sends the image, taking care of ranges and
+// conditional requests
+func serveImage(w http.ResponseWriter, r *http.Request, contents io.ReadCloser, etag string) {
+	w.Header().Set("Etag", `"`+etag+`"`)
+	rs, seekable := contents.(io.ReadSeeker)
+	if !seekable {
+		// it's streaming through from another node, so we can't
+		// jump around in it
+		w.Header().Set("Accept-Ranges", "none")
+	}
+	if notModified(w, r, etag) {
+		return
+	}
+	if seekable {
+		http.ServeContent(w, r, "", modTime(contents), rs)
 		return
 	}
+	_, _ = io.Copy(w, contents)
+}
+
+// http.ServeContent only understands quoted etags, so this checks
+// If-None-Match first and sends the 304 itself
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	if etag == "" || !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// stands in for an image we aren't going to send, so that
+// http.ServeContent can do all the header work for a HEAD
+type headOnly struct{}
 
-	w = setCacheHeaders(w, ri.Extension)
-	w.Header().Set("Etag", etag)
-	_, _ = w.Write(imgData)
-	servedLocally.Add(1) // Assuming if GetImage succeeds, it was served eventually
+func (headOnly) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("HEAD request has no body")
+}
+
+func serveImageHead(w http.ResponseWriter, r *http.Request, head imageHead) {
+	if head.Etag != "" {
+		w.Header().Set("Etag", `"`+head.Etag+`"`)
+	}
+	if notModified(w, r, head.Etag) {
+		return
+	}
+	if head.Length >= 0 {
+		http.ServeContent(w, r, "", head.Modified, io.NewSectionReader(headOnly{}, 0, head.Length))
+		return
+	}
+	// we'd have to resize it to know any more
+	w.WriteHeader(http.StatusOK)
+}
+
+// whether an If-None-Match header matches. unquoted etags are
+// what we used to send, so those still count.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || strings.Trim(t, `"`) == etag {
+			return true
+		}
+	}
+	return false
 }
 
 type debugNodeInfo struct {
@@ -126,18 +233,25 @@ type debugPage struct {
 	Nodes     []debugNodeInfo
 }
 
-func debugImageHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
-	hash := r.PathValue("hash")
-	filename := r.PathValue("filename")
-	ahash, err := hashFromString(hash, "")
+// which nodes should have the image, and which of them do
+// whether the node has the image, asking the way a node that
+// predates the batch endpoint understands if we have to
+func imageHeldBy(ctx context.Context, n *nodeData, ri *imageSpecifier) (bool, error) {
+	if held, err := n.RetrieveImageInfoBatch(ctx, []imageSpecifier{*ri}); err == nil {
+		return held[0].Local, nil
+	}
+	info, err := n.RetrieveImageInfo(ctx, ri)
 	if err != nil {
-		http.Error(w, "invalid hash", http.StatusNotFound)
-		return
+		return false, err
 	}
+	return info.Local, nil
+}
 
+func imagePlacement(rctx context.Context, ctx sitecontext, ri *imageSpecifier) []debugNodeInfo {
 	allNodes := ctx.cluster.NeighborsInclusive()
-	writeOrder := ctx.cluster.WriteOrder(hash)
+	writeOrder := ctx.cluster.WriteOrder(ri.Hash.String())
 	replication := ctx.Cfg.Replication
+	myUUID := ctx.cluster.GetMyself().UUID
 
 	shouldHaveMap := make(map[string]bool)
 	for i, n := range writeOrder {
@@ -147,9 +261,6 @@ func debugImageHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext)
 	}
 
 	var infos []debugNodeInfo
-	// using "full" size to check existence of the original image
-	ri := &imageSpecifier{ahash, resize.MakeSizeSpec("full"), filepath.Ext(filename)}
-
 	for i := range allNodes {
 		n := &allNodes[i]
 		shouldHave := shouldHaveMap[n.UUID]
@@ -158,14 +269,14 @@ func debugImageHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext)
 
 		// check if node has it
 		// use a short timeout
-		checkCtx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
-		info, err := n.RetrieveImageInfo(checkCtx, ri)
+		checkCtx, cancel := context.WithTimeout(rctx, 2*time.Second)
+		local, err := imageHeldBy(checkCtx, n, ri)
 		cancel()
 
 		if err != nil {
 			status = "error: " + err.Error()
 		} else {
-			if info.Local {
+			if local {
 				hasIt = true
 				status = "ok"
 			} else {
@@ -178,7 +289,7 @@ func debugImageHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext)
 			ShouldHave: shouldHave,
 			HasIt:      hasIt,
 			Status:     status,
-			IsMyself:   n.UUID == ctx.cluster.GetMyself().UUID,
+			IsMyself:   n.UUID == myUUID,
 		})
 	}
 
@@ -188,6 +299,21 @@ func debugImageHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext)
 		}
 		return infos[i].Node.Nickname < infos[j].Node.Nickname
 	})
+	return infos
+}
+
+func debugImageHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+	hash := r.PathValue("hash")
+	filename := r.PathValue("filename")
+	ahash, err := hashFromString(hash, "")
+	if err != nil {
+		http.Error(w, "invalid hash", http.StatusNotFound)
+		return
+	}
+
+	// using "full" size to check existence of the original image
+	ri := &imageSpecifier{ahash, resize.MakeSizeSpec("full"), filepath.Ext(filename)}
+	infos := imagePlacement(r.Context(), ctx, ri)
 
 	thumbnail := "/image/" + ahash.String() + "/100s/" + filename
 
@@ -220,7 +346,7 @@ const debugTemplate = `
   <li><a href="/">Upload</a></li>
   <li><a href="/status/">Status</a></li>
   <li><a href="/dashboard/">Dashboard</a></li>
-  <li><a href="/debug/vars">expvar</a></li>
+  <li><a href="/metrics">metrics</a></li>
   <li><a href="/join/">Add Node</a></li>
   <li><a href="/logs/">Logs</a></li>
   <li class="active">Image Debug</li>
@@ -322,16 +448,18 @@ func postAddHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
 type statusPage struct {
 	Title     string
 	Config    siteConfig
-	Cluster   Cluster
+	Myself    nodeData
 	Neighbors []nodeData
+	Disks     []diskStatus
 }
 
 func statusHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
 	p := statusPage{
 		Title:     "Status",
 		Config:    *ctx.Cfg,
-		Cluster:   ctx.cluster,
+		Myself:    ctx.cluster.GetMyself(),
 		Neighbors: ctx.cluster.GetNeighbors(),
+		Disks:     ctx.Cfg.diskStatuses(),
 	}
 	t, _ := template.New("status").Parse(statusTemplate)
 	_ = t.Execute(w, p)
@@ -387,7 +515,7 @@ func stashHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
 		return
 	}
 
-	response, err := ctx.StashView.StashImage(r.Context(), imageFile, fileHeader, sizeHints)
+	response, err := ctx.StashView.StashImage(r.Context(), imageFile, fileHeader, sizeHints, r.FormValue("hint_for"))
 	if err != nil {
 		if strings.Contains(err.Error(), "non-writeable node") {
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -404,6 +532,34 @@ func stashHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
 	_, _ = fmt.Fprint(w, response)
 }
 
+func putStashHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+	defer func() { _ = r.Body.Close() }()
+	response, err := ctx.StashView.StashRaw(r.Context(), r.PathValue("hash"), r.PathValue("ext"),
+		r.Header.Get(expectedDigestHeader), r.Body,
+		r.URL.Query().Get("size_hints"), r.URL.Query().Get("hint_for"))
+	if err != nil {
+		if errors.Is(err, errDigestMismatch) {
+			// the sender should try another copy, or another node
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		} else if strings.Contains(err.Error(), "non-writeable node") {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if strings.Contains(err.Error(), "unsupported image type") {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if strings.Contains(err.Error(), "bad request") {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if strings.Contains(err.Error(), "bad hash") {
+			// not a 404, which the sender would take to mean
+			// that we don't take raw stashes at all
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	_, _ = fmt.Fprint(w, response)
+}
+
 func retrieveInfoHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
 	hash := r.PathValue("hash")
 	size := r.PathValue("size") // Note: size is used for writeable check in GetImageInfo, not directly here
@@ -423,12 +579,45 @@ func retrieveInfoHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext
 	_, _ = w.Write(responseBytes)
 }
 
+func retrieveInfoBatchHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+	var reqs []imageInfoRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	responseBytes, err := ctx.RetrieveInfoView.GetImageInfoBatch(reqs)
+	if err != nil {
+		if strings.Contains(err.Error(), "bad hash") || strings.Contains(err.Error(), "batch too large") {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(responseBytes)
+}
+
 func retrieveHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
 	hash := r.PathValue("hash")
 	size := r.PathValue("size")
 	ext := r.PathValue("ext")
 	ifNoneMatch := r.Header.Get("If-None-Match")
 
+	if r.Method == http.MethodHead {
+		// only say what we know ourselves. whoever is asking
+		// is already going around the cluster
+		head, err := ctx.RetrieveView.HeadImage(r.Context(), hash, size, ext)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", extmimes["."+ext])
+		serveImageHead(w, r, head)
+		return
+	}
+
 	imgData, etag, err := ctx.RetrieveView.RetrieveImage(r.Context(), hash, size, ext, ifNoneMatch)
 	if err != nil {
 		// Specific error handling for different scenarios can be added here
@@ -437,23 +626,24 @@ func retrieveHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
 		return
 	}
 
-	if ifNoneMatch != "" && ifNoneMatch == etag {
-		w.WriteHeader(http.StatusNotModified)
-		return
-	}
+	defer func() { _ = imgData.Close() }()
 
 	w.Header().Set("Content-Type", extmimes["."+ext])
-	w.Header().Set("Etag", etag)
-	_, _ = w.Write(imgData)
+	serveImage(w, r, imgData, etag)
 }
 
 func getAnnounceHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+	myself := ctx.cluster.GetMyself()
 	ar := announceResponse{
-		Nickname:  ctx.cluster.GetMyself().Nickname,
-		UUID:      ctx.cluster.GetMyself().UUID,
-		Location:  ctx.cluster.GetMyself().Location,
-		Writeable: ctx.cluster.GetMyself().Writeable,
-		BaseURL:   ctx.cluster.GetMyself().BaseURL,
+		Nickname:  myself.Nickname,
+		UUID:      myself.UUID,
+		Location:  myself.Location,
+		Writeable: myself.Writeable,
+		Draining:  myself.Draining,
+		Full:      myself.Full,
+		BytesUsed: myself.BytesUsed,
+		BytesFree: myself.BytesFree,
+		BaseURL:   myself.BaseURL,
 		Neighbors: ctx.cluster.GetNeighbors(),
 	}
 	b, err := json.Marshal(ar)
@@ -480,6 +670,9 @@ func postAnnounceHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext
 		if r.FormValue("writeable") != "" {
 			neighbor.Writeable = r.FormValue("writeable") == "true"
 		}
+		neighbor.Draining = r.FormValue("draining") == "true"
+		neighbor.Full = r.FormValue("full") == "true"
+		neighbor.BytesUsed, neighbor.BytesFree = capacityFromForm(r)
 		neighbor.LastSeen = time.Now()
 		ctx.cluster.UpdateNeighbor(*neighbor)
 		_ = ctx.SL.Log("level", "INFO", "msg", "updated existing neighbor")
@@ -501,11 +694,22 @@ func postAnnounceHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext
 		} else {
 			nd.Writeable = false
 		}
+		nd.Draining = r.FormValue("draining") == "true"
+		nd.Full = r.FormValue("full") == "true"
+		nd.BytesUsed, nd.BytesFree = capacityFromForm(r)
 		nd.LastSeen = time.Now()
 		ctx.cluster.AddNeighbor(nd)
 	}
 	getAnnounceHandler(w, r, ctx)
 }
+
+// missing or garbled values just mean we don't know
+func capacityFromForm(r *http.Request) (uint64, uint64) {
+	used, _ := strconv.ParseUint(r.FormValue("bytes_used"), 10, 64)
+	free, _ := strconv.ParseUint(r.FormValue("bytes_free"), 10, 64)
+	return used, free
+}
+
 func getJoinHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
 	// show form
 	_, _ = w.Write([]byte(joinTemplate))
@@ -557,6 +761,65 @@ func postJoinHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
 	_, _ = fmt.Fprintf(w, "Added node %s [%s]", n.Nickname, n.UUID)
 }
 
+func getDrainHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+	b, err := json.Marshal(ctx.Drainer.Progress())
+	if err != nil {
+		_ = ctx.SL.Log("level", "ERR", "error", err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+func postDrainHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+	if ctx.Cfg.KeyRequired() && !ctx.Cfg.ValidKey(r.FormValue("key")) {
+		http.Error(w, "invalid key", http.StatusForbidden)
+		return
+	}
+	if err := ctx.Drainer.Start(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	getDrainHandler(w, r, ctx)
+}
+
+func merkleHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+	node, err := ctx.AntiEntropy.Node(r.PathValue("uuid"), r.PathValue("prefix"))
+	if errors.Is(err, errUnknownPeer) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := json.Marshal(node)
+	if err != nil {
+		_ = ctx.SL.Log("level", "ERR", "error", err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+func inventoryHandler(w http.ResponseWriter, r *http.Request, ctx sitecontext) {
+	var v interface{}
+	if prefix := r.PathValue("prefix"); prefix == "" {
+		v = ctx.AntiEntropy.InventoryDigests()
+	} else {
+		entries, err := ctx.AntiEntropy.InventoryShard(prefix)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		v = entries
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		_ = ctx.SL.Log("level", "ERR", "error", err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
 type logsPage struct {
 	Logs []LogEntry
 }
@@ -584,7 +847,7 @@ const joinTemplate = `
   <li><a href="/">Upload</a></li>
   <li><a href="/status/">Status</a></li>
   <li><a href="/dashboard/">Dashboard</a></li>
-  <li><a href="/debug/vars">expvar</a></li>
+  <li><a href="/metrics">metrics</a></li>
   <li><a href="/join/">Add Node</a></li>
   <li><a href="/logs/">Logs</a></li>
 </ol>
@@ -611,7 +874,7 @@ const addTemplate = `
   <li><a href="/">Upload</a></li>
   <li><a href="/status/">Status</a></li>
   <li><a href="/dashboard/">Dashboard</a></li>
-  <li><a href="/debug/vars">expvar</a></li>
+  <li><a href="/metrics">metrics</a></li>
   <li><a href="/join/">Add Node</a></li>
   <li><a href="/logs/">Logs</a></li>
 </ol>
@@ -642,14 +905,14 @@ const statusTemplate = `
   <li><a href="/">Upload</a></li>
   <li><a href="/status/">Status</a></li>
   <li><a href="/dashboard/">Dashboard</a></li>
-  <li><a href="/debug/vars">expvar</a></li>
+  <li><a href="/metrics">metrics</a></li>
   <li><a href="/join/">Add Node</a></li>
   <li><a href="/logs/">Logs</a></li>
 </ol>
 
 <body>
 <div class="container">
-<h1>Reticulum Node: {{ .Cluster.Myself.Nickname }}</h1>
+<h1>Reticulum Node: {{ .Myself.Nickname }}</h1>
 
 <h2>Config</h2>
 
@@ -665,13 +928,37 @@ const statusTemplate = `
 <h2>This Node</h2>
 
 <table class="table">
-	<tr><th>Nickname</th><td>{{ .Cluster.Myself.Nickname }}</td></tr>
-	<tr><th>UUID</th><td>{{ .Cluster.Myself.UUID }}</td></tr>
-	<tr><th>Location</th><td>{{ .Cluster.Myself.Location }}</td></tr>
+	<tr><th>Nickname</th><td>{{ .Myself.Nickname }}</td></tr>
+	<tr><th>UUID</th><td>{{ .Myself.UUID }}</td></tr>
+	<tr><th>Location</th><td>{{ .Myself.Location }}</td></tr>
 
-	<tr><th>Writeable</th><td>{{if .Cluster.Myself.Writeable}}<span class="text-success">yes</span>{{else}}<span class="text-danger">read-only</span>{{end}}</td></tr>
+	<tr><th>Writeable</th><td>{{if .Myself.Writeable}}<span class="text-success">yes</span>{{else}}<span class="text-danger">read-only</span>{{end}}</td></tr>
+	<tr><th>Draining</th><td>{{if .Myself.Draining}}<span class="text-warning">draining</span>{{else}}no{{end}}</td></tr>
+	<tr><th>Capacity</th><td>{{ .Myself.CapacityFormatted }}{{if .Myself.Full}} <span class="text-danger">full</span>{{end}}</td></tr>
+	<tr><th>Water marks</th><td>stop at {{ .Config.HighWaterMark }}%, resume at {{ .Config.LowWaterMark }}%</td></tr>
 
-	<tr><th>Base URL</th><td>{{ .Cluster.Myself.BaseURL }}</td></tr>
+	<tr><th>Base URL</th><td>{{ .Myself.BaseURL }}</td></tr>
+</table>
+
+<h2>Disks</h2>
+
+<table class="table table-condensed">
+	<tr>
+		<th>Root</th>
+		<th>Status</th>
+		<th>Used</th>
+		<th>Free</th>
+		<th>Total</th>
+	</tr>
+{{ range .Disks }}
+	<tr>
+		<td>{{ .Root }}</td>
+		<td>{{if .Failed}}<span class="text-danger">failed</span>{{else if .Error}}<span class="text-warning">{{ .Error }}</span>{{else}}<span class="text-success">ok</span>{{end}}</td>
+		<td>{{ .UsedFormatted }} ({{ printf "%.1f" .UsedPercent }}%)</td>
+		<td>{{ .FreeFormatted }}</td>
+		<td>{{ .TotalFormatted }}</td>
+	</tr>
+{{ end }}
 </table>
 
 <h2>Neighbors</h2>
@@ -683,6 +970,7 @@ const statusTemplate = `
 		<th>BaseURL</th>
 		<th>Location</th>
 		<th>Writeable</th>
+		<th>Capacity</th>
 		<th>LastSeen</th>
 		<th>LastFailed</th>
 	</tr>
@@ -696,11 +984,12 @@ const statusTemplate = `
         <div class="btn-group btn-group-sm" role="group">
         <a class="btn btn-default" href="http://{{.BaseURL}}/status/">S</a>
         <a class="btn btn-default" href="http://{{.BaseURL}}/dashboard/">D</a>
-        <a class="btn btn-default" href="http://{{.BaseURL}}/debug/vars">E</a>
+        <a class="btn btn-default" href="http://{{.BaseURL}}/metrics">M</a>
         </div>
     </td>
 		<td>{{ .Location }}</td>
-		<td>{{if .Writeable}}<span class="text-success">yes</span>{{else}}<span class="text-danger">read-only</span>{{end}}</td>
+		<td>{{if .Writeable}}<span class="text-success">yes</span>{{else}}<span class="text-danger">read-only</span>{{end}}{{if .Draining}} <span class="text-warning">draining</span>{{end}}{{if .Full}} <span class="text-danger">full</span>{{end}}</td>
+		<td>{{ .CapacityFormatted }}</td>
 		<td>{{ if .LastSeen.IsZero}}-{{else}}{{ .LastSeenFormatted }}{{end}}</td>
 		<td>{{ if .LastFailed.IsZero }}-{{else}}{{.LastFailedFormatted}}{{end}}</td>
 	</tr>
@@ -726,7 +1015,7 @@ const dashboardTemplate = `
   <li><a href="/">Upload</a></li>
   <li><a href="/status/">Status</a></li>
   <li><a href="/dashboard/">Dashboard</a></li>
-  <li><a href="/debug/vars">expvar</a></li>
+  <li><a href="/metrics">metrics</a></li>
   <li><a href="/join/">Add Node</a></li>
   <li><a href="/logs/">Logs</a></li>
 </ol>
@@ -736,25 +1025,77 @@ const dashboardTemplate = `
 
 <h2>Recently Verified</h2>
 
+<div id="verified">
 {{ range .RecentlyVerified }}
 <a href="/image/{{.Hash.String}}/full/image{{.Extension}}"><img src="/image/{{ .Hash.String }}/100s/image{{.Extension}}" width="100" height="100"></a>
 {{ end }}
+</div>
 
 <h2>Recently Uploaded</h2>
 
+<div id="uploaded">
 {{ range .RecentlyUploaded }}
 <a href="/image/{{.Hash.String}}/full/image{{.Extension}}"><img src="/image/{{ .Hash.String }}/100s/image{{.Extension}}" width="100" height="100"></a>
 {{ end }}
+</div>
 
 <h2>Recently Stashed</h2>
 
+<div id="stashed">
 {{ range .RecentlyStashed }}
 <a href="/image/{{.Hash.String}}/full/image{{.Extension}}"><img src="/image/{{ .Hash.String }}/100s/image{{.Extension}}" width="100" height="100"></a>
 {{ end }}
+</div>
 
+<h2>Activity</h2>
+
+<ul id="activity" class="list-unstyled"></ul>
 
 </div>
 
+<script>
+(function () {
+  var keep = 20;
+  function trim(el) {
+    while (el.children.length > keep) {
+      el.removeChild(el.lastElementChild);
+    }
+  }
+  function thumbnail(e) {
+    var a = document.createElement("a");
+    a.href = "/image/" + e.hash + "/full/image" + e.extension;
+    var img = document.createElement("img");
+    img.src = "/image/" + e.hash + "/100s/image" + e.extension;
+    img.width = 100;
+    img.height = 100;
+    a.appendChild(img);
+    return a;
+  }
+  function log(e) {
+    var li = document.createElement("li");
+    var what = e.node || (e.hash + (e.size ? " " + e.size : ""));
+    li.textContent = new Date(e.time).toLocaleTimeString() + " " + e.type + " " + what;
+    var el = document.getElementById("activity");
+    el.insertBefore(li, el.firstChild);
+    trim(el);
+  }
+  var source = new EventSource("/dashboard/events");
+  ["verified", "uploaded", "stashed"].forEach(function (type) {
+    source.addEventListener(type, function (msg) {
+      var e = JSON.parse(msg.data);
+      var el = document.getElementById(type);
+      el.insertBefore(thumbnail(e), el.firstChild);
+      trim(el);
+    });
+  });
+  ["resized", "neighbor.joined", "neighbor.left", "neighbor.changed", "neighbor.failed"].forEach(function (type) {
+    source.addEventListener(type, function (msg) {
+      log(JSON.parse(msg.data));
+    });
+  });
+})();
+</script>
+
 </body>
 </html>
 `
@@ -778,7 +1119,7 @@ const logsTemplate = `
   <li><a href="/">Upload</a></li>
   <li><a href="/status/">Status</a></li>
   <li><a href="/dashboard/">Dashboard</a></li>
-  <li><a href="/debug/vars">expvar</a></li>
+  <li><a href="/metrics">metrics</a></li>
   <li><a href="/join/">Add Node</a></li>
   <li class="active">Logs</li>
 </ol>
@@ -12,8 +12,10 @@ import (
 	"net/textproto"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/thraxil/resize"
@@ -33,6 +35,8 @@ func makeTestContextWithUploadDir(uploadDir string) sitecontext {
 	stashView := NewStashView(c, b, &cfg, ch, sl)
 	retrieveInfoView := NewRetrieveInfoView(c, &cfg, sl)
 	retrieveView := NewRetrieveView(imageView, sl)
+	drainer := newDrainer(c, cfg, sl)
+	antiEntropy := newAntiEntropy(c, cfg, sl)
 
 	go func() {
 		for req := range ch.ResizeQueue {
@@ -52,6 +56,8 @@ func makeTestContextWithUploadDir(uploadDir string) sitecontext {
 		StashView:        stashView,
 		RetrieveInfoView: retrieveInfoView,
 		RetrieveView:     retrieveView,
+		Drainer:          drainer,
+		AntiEntropy:      antiEntropy,
 	}
 }
 
@@ -65,13 +71,28 @@ func Test_statusHandler(t *testing.T) {
 		t.Fatalf("could not create request: %v", err)
 	}
 	ctx := makeTestContext()
+	// changes to this node come in while the page is rendering
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			ctx.cluster.(*cluster).SetCapacity(uint64(i), 100, false)
+		}
+		ctx.cluster.(*cluster).SetDraining(true)
+	}()
 	rec := httptest.NewRecorder()
 	statusHandler(rec, req, ctx)
+	<-done
 
 	res := rec.Result()
 	if res.StatusCode != http.StatusOK {
 		t.Errorf("expected status OK; got %v", res.Status)
 	}
+	rec = httptest.NewRecorder()
+	statusHandler(rec, req, ctx)
+	if !strings.Contains(rec.Body.String(), "draining") {
+		t.Error("expected the node to show as draining")
+	}
 }
 
 func Test_dashboardHandler(t *testing.T) {
@@ -448,6 +469,8 @@ func Test_PostAddHandler(t *testing.T) {
 	// Create a new test context
 	ctx := makeTestContextWithUploadDir("test/uploads2/")
 	ctx.Cfg.UploadKeys = []string{"test-key"}
+	events, _ := testEventNotifier(t, webhookConfig{URL: "http://localhost:0/"})
+	ctx.Cfg.Events = events
 
 	// Create a new response recorder
 	rec := httptest.NewRecorder()
@@ -475,6 +498,15 @@ func Test_PostAddHandler(t *testing.T) {
 	if data.Extension != "png" {
 		t.Errorf("unexpected extension: %s", data.Extension)
 	}
+	if data.Replicas != len(data.Nodes) {
+		t.Errorf("replicas should match nodes: %d %v", data.Replicas, data.Nodes)
+	}
+
+	// accepted, and then satisfied, since our copy is all it needs
+	due := events.outbox.Due("http://localhost:0/", time.Now())
+	if len(due) != 2 || due[0].Event.Type != eventUploadAccepted || due[1].Event.Type != eventReplicationSatisfied {
+		t.Errorf("expected two events, got %v", due)
+	}
 }
 
 func Test_PostAddHandler_invalidKey(t *testing.T) {
@@ -863,6 +895,9 @@ func Test_PostAnnounceHandler_NewNeighbor(t *testing.T) {
 	form.Add("base_url", "neighbor.example.com")
 	form.Add("location", "neighbor-location")
 	form.Add("writeable", "true")
+	form.Add("full", "true")
+	form.Add("bytes_used", "950")
+	form.Add("bytes_free", "50")
 
 	req, err := http.NewRequest("POST", "localhost:8080/announce/", strings.NewReader(form.Encode()))
 	if err != nil {
@@ -910,6 +945,9 @@ func Test_PostAnnounceHandler_NewNeighbor(t *testing.T) {
 	if !neighbor.Writeable {
 		t.Errorf("wrong writeable")
 	}
+	if !neighbor.Full || neighbor.BytesUsed != 950 || neighbor.BytesFree != 50 {
+		t.Errorf("capacity wasn't recorded: full=%v used=%d free=%d", neighbor.Full, neighbor.BytesUsed, neighbor.BytesFree)
+	}
 }
 
 func Test_PostAnnounceHandler_UpdateNeighbor(t *testing.T) {
@@ -932,6 +970,9 @@ func Test_PostAnnounceHandler_UpdateNeighbor(t *testing.T) {
 	form.Add("base_url", "new.example.com")
 	form.Add("location", "new-location")
 	form.Add("writeable", "true")
+	form.Add("full", "true")
+	form.Add("bytes_used", "950")
+	form.Add("bytes_free", "50")
 
 	req, err := http.NewRequest("POST", "localhost:8080/announce/", strings.NewReader(form.Encode()))
 	if err != nil {
@@ -972,4 +1013,307 @@ func Test_PostAnnounceHandler_UpdateNeighbor(t *testing.T) {
 	if !neighbor.Writeable {
 		t.Errorf("wrong writeable")
 	}
+	if !neighbor.Full || neighbor.BytesUsed != 950 || neighbor.BytesFree != 50 {
+		t.Errorf("capacity wasn't updated: full=%v used=%d free=%d", neighbor.Full, neighbor.BytesUsed, neighbor.BytesFree)
+	}
+}
+
+func Test_retrieveInfoBatchHandler(t *testing.T) {
+	ctx := makeTestContextWithUploadDir("test/uploads1/")
+
+	cases := []struct {
+		body   string
+		status int
+		local  []bool
+	}{
+		{`[{"hash": "0051ec03fb813e8731224ee06feee7c828ceae22", "extension": ".webp"},
+		   {"hash": "0051ec03fb813e8731224ee06feee7c828ceae22", "extension": ".jpg"},
+		   {"hash": "fb682e05b9be61797601e60165825c0b089f755e", "extension": ".jpg"}]`,
+			http.StatusOK, []bool{true, false, false}},
+		{`[]`, http.StatusOK, []bool{}},
+		{`[{"hash": "invalidahash", "extension": ".jpg"}]`, http.StatusBadRequest, nil},
+		{`not json`, http.StatusBadRequest, nil},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/retrieve_info/batch/", strings.NewReader(c.body))
+		rec := httptest.NewRecorder()
+		retrieveInfoBatchHandler(rec, req, ctx)
+
+		res := rec.Result()
+		if res.StatusCode != c.status {
+			t.Errorf("for %s expected status %v; got %v", c.body, c.status, res.Status)
+			continue
+		}
+		if c.status != http.StatusOK {
+			continue
+		}
+		var infos []imageInfoResponse
+		if err := json.NewDecoder(res.Body).Decode(&infos); err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != len(c.local) {
+			t.Fatalf("expected %d responses, got %d", len(c.local), len(infos))
+		}
+		for i, info := range infos {
+			if info.Local != c.local[i] {
+				t.Errorf("for %s%s expected local=%v", info.Hash, info.Extension, c.local[i])
+			}
+		}
+	}
+}
+
+func Test_putStashHandler(t *testing.T) {
+	uploadDir := t.TempDir() + "/"
+	ctx := makeTestContextWithUploadDir(uploadDir)
+
+	image, err := os.ReadFile("test/gopher.png")
+	if err != nil {
+		t.Fatalf("could not read test image: %v", err)
+	}
+	hash := fmt.Sprintf("%x", sha1.Sum(image))
+
+	cases := []struct {
+		name     string
+		hash     string
+		ext      string
+		expected string
+		body     []byte
+		status   int
+	}{
+		{"corrupted", hash, "png", hash, image[:len(image)-1], http.StatusUnprocessableEntity},
+		{"no digest", hash, "png", "", image, http.StatusBadRequest},
+		{"digest for something else", hash, "png", "fb682e05b9be61797601e60165825c0b089f755e", image, http.StatusBadRequest},
+		{"unsupported type", hash, "txt", hash, image, http.StatusBadRequest},
+		{"bad hash", "invalidahash", "png", "invalidahash", image, http.StatusBadRequest},
+		// last, so we know none of the others wrote it
+		{"good", hash, "png", hash, image, http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("PUT", "/stash/"+c.hash+"/"+c.ext, bytes.NewReader(c.body))
+		req.SetPathValue("hash", c.hash)
+		req.SetPathValue("ext", c.ext)
+		if c.expected != "" {
+			req.Header.Set(expectedDigestHeader, c.expected)
+		}
+		rec := httptest.NewRecorder()
+		putStashHandler(rec, req, ctx)
+
+		res := rec.Result()
+		if res.StatusCode != c.status {
+			t.Errorf("%s: expected status %v; got %v", c.name, c.status, res.Status)
+		}
+		ahash, _ := hashFromString(hash, "")
+		ri := imageSpecifier{ahash, resize.MakeSizeSpec("full"), ".png"}
+		_, err := os.Stat(ri.fullSizePath(uploadDir))
+		if c.status == http.StatusOK && err != nil {
+			t.Errorf("%s: expected the image to be stored: %v", c.name, err)
+		}
+		if c.status != http.StatusOK && err == nil {
+			t.Errorf("%s: the image shouldn't have been stored", c.name)
+		}
+	}
+	var leftovers []string
+	_ = filepath.Walk(uploadDir, func(path string, f os.FileInfo, err error) error {
+		if err == nil && strings.HasSuffix(path, ".tmp") {
+			leftovers = append(leftovers, path)
+		}
+		return nil
+	})
+	if len(leftovers) > 0 {
+		t.Errorf("temp files left behind: %v", leftovers)
+	}
+}
+
+func Test_serveImageHandlerRangesAndHead(t *testing.T) {
+	ctx := makeTestContextWithUploadDir(t.TempDir() + "/")
+	ctx.cluster.(*cluster).Myself.Writeable = true
+	ahash, _ := hashFromString("c1986af3c26609b8b7d8933f99c51c1a89e9ea6b", "")
+	full := imageSpecifier{ahash, resize.MakeSizeSpec("full"), ".png"}
+	if err := ctx.Cfg.Backend.WriteFull(full, io.NopCloser(strings.NewReader("0123456789"))); err != nil {
+		t.Fatal(err)
+	}
+	request := func(method, size string, header map[string]string) *http.Response {
+		req := httptest.NewRequest(method, "/image/"+ahash.String()+"/"+size+"/image.png", nil)
+		req.SetPathValue("hash", ahash.String())
+		req.SetPathValue("size", size)
+		req.SetPathValue("filename", "image.png")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		serveImageHandler(rec, req, ctx)
+		return rec.Result()
+	}
+
+	res := request("GET", "full", map[string]string{"Range": "bytes=2-5"})
+	if res.StatusCode != http.StatusPartialContent {
+		t.Errorf("expected 206, got %v", res.Status)
+	}
+	if body, _ := io.ReadAll(res.Body); string(body) != "2345" {
+		t.Errorf("wrong range: %q", string(body))
+	}
+
+	res = request("HEAD", "full", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %v", res.Status)
+	}
+	if res.ContentLength != 10 || res.Header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("missing headers: %v", res.Header)
+	}
+	if res.Header.Get("Last-Modified") == "" {
+		t.Error("expected a Last-Modified header")
+	}
+	etag := res.Header.Get("Etag")
+	if etag != `"`+ahash.String()+`"` {
+		t.Errorf("unexpected etag %s", etag)
+	}
+	if body, _ := io.ReadAll(res.Body); len(body) != 0 {
+		t.Error("HEAD shouldn't send a body")
+	}
+
+	res = request("GET", "full", map[string]string{"If-None-Match": etag})
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("expected 304, got %v", res.Status)
+	}
+	// what we used to send, which http.ServeContent wouldn't match
+	res = request("GET", "full", map[string]string{"If-None-Match": ahash.String()})
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("expected 304 for an unquoted etag, got %v", res.Status)
+	}
+	res = request("HEAD", "full", map[string]string{"If-None-Match": ahash.String()})
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("expected 304 for an unquoted etag on a HEAD, got %v", res.Status)
+	}
+	res = request("GET", "full", map[string]string{"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)})
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("expected 304, got %v", res.Status)
+	}
+
+	// a HEAD for a size we haven't made yet shouldn't make it
+	res = request("HEAD", "100s", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %v", res.Status)
+	}
+	sized := imageSpecifier{ahash, resize.MakeSizeSpec("100s"), ".png"}
+	if _, err := os.Stat(sized.sizedPath(ctx.Cfg.UploadDirectory)); !os.IsNotExist(err) {
+		t.Error("HEAD shouldn't resize")
+	}
+
+	// and one for an image nobody has is a 404
+	other, _ := hashFromString("0051ec03fb813e8731224ee06feee7c828ceae22", "")
+	req := httptest.NewRequest("HEAD", "/retrieve/"+other.String()+"/full/png/", nil)
+	req.SetPathValue("hash", other.String())
+	req.SetPathValue("size", "full")
+	req.SetPathValue("ext", "png")
+	rec := httptest.NewRecorder()
+	retrieveHandler(rec, req, ctx)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func Test_serveImageStreaming(t *testing.T) {
+	contents := struct {
+		io.Reader
+		io.Closer
+	}{strings.NewReader("streamed"), io.NopCloser(nil)}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	serveImage(rec, req, contents, "abc")
+	if rec.Body.String() != "streamed" || rec.Header().Get("Accept-Ranges") != "none" {
+		t.Errorf("unexpected response: %q %v", rec.Body.String(), rec.Header())
+	}
+
+	req.Header.Set("If-None-Match", `W/"xyz", "abc"`)
+	rec = httptest.NewRecorder()
+	serveImage(rec, req, contents, "abc")
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("expected 304, got %d", rec.Code)
+	}
+}
+
+func Test_serveImageUnquotedEtag(t *testing.T) {
+	// a seekable image goes through http.ServeContent, which
+	// doesn't match unquoted etags on its own
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", "abc")
+	rec := httptest.NewRecorder()
+	serveImage(rec, req, bytesReadCloser([]byte("seekable")), "abc")
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("expected 304, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	req.Header.Set("If-None-Match", "xyz")
+	rec = httptest.NewRecorder()
+	serveImage(rec, req, bytesReadCloser([]byte("seekable")), "abc")
+	if rec.Code != http.StatusOK || rec.Body.String() != "seekable" {
+		t.Errorf("expected the image, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func Test_etagMatches(t *testing.T) {
+	cases := []struct {
+		header   string
+		expected bool
+	}{
+		{"", false},
+		{`"abc"`, true},
+		{"abc", true},
+		{`W/"abc"`, true},
+		{`"xyz", "abc"`, true},
+		{"*", true},
+		{`"xyz"`, false},
+	}
+	for _, c := range cases {
+		if got := etagMatches(c.header, "abc"); got != c.expected {
+			t.Errorf("etagMatches(%q) = %v, expected %v", c.header, got, c.expected)
+		}
+	}
+}
+
+func Test_serveImageHandlerCacheHeaders(t *testing.T) {
+	ctx := makeTestContextWithUploadDir(t.TempDir() + "/")
+	defaults := configData{}.MyConfig()
+	ctx.Cfg.CacheControl = defaults.CacheControl
+	ctx.Cfg.ShortCacheControl = "public, max-age=5"
+	ctx.Cfg.SurrogateKeys = true
+	ahash, _ := hashFromString("c1986af3c26609b8b7d8933f99c51c1a89e9ea6b", "")
+	full := imageSpecifier{ahash, resize.MakeSizeSpec("full"), ".png"}
+	if err := ctx.Cfg.Backend.WriteFull(full, io.NopCloser(strings.NewReader("0123456789"))); err != nil {
+		t.Fatal(err)
+	}
+	request := func(hash, size, filename string) *http.Response {
+		req := httptest.NewRequest("GET", "/image/"+hash+"/"+size+"/"+filename, nil)
+		req.SetPathValue("hash", hash)
+		req.SetPathValue("size", size)
+		req.SetPathValue("filename", filename)
+		rec := httptest.NewRecorder()
+		serveImageHandler(rec, req, ctx)
+		return rec.Result()
+	}
+
+	res := request(ahash.String(), "full", "image.png")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %v", res.Status)
+	}
+	if cc := res.Header.Get("Cache-Control"); cc != "public, max-age=31536000, immutable" {
+		t.Errorf("unexpected Cache-Control: %s", cc)
+	}
+	if sk := res.Header.Get("Surrogate-Key"); sk != ahash.String() {
+		t.Errorf("unexpected Surrogate-Key: %s", sk)
+	}
+
+	for _, res := range []*http.Response{
+		request(ahash.String(), "full", "image.jpeg"),
+		request("0051ec03fb813e8731224ee06feee7c828ceae22", "full", "image.png"),
+		request("invalidhash", "full", "image.png"),
+	} {
+		if cc := res.Header.Get("Cache-Control"); cc != "public, max-age=5" {
+			t.Errorf("%v should get the short Cache-Control, got %q", res.Status, cc)
+		}
+		if res.Header.Get("Surrogate-Key") != "" {
+			t.Errorf("%v shouldn't be tagged", res.Status)
+		}
+	}
 }
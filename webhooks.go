@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// the things that happen to an image that an application might
+// want to hear about
+const (
+	eventUploadAccepted       = "upload.accepted"
+	eventReplicationSatisfied = "replication.satisfied"
+	eventReplicationFailed    = "replication.failed"
+	eventCorruptionDetected   = "corruption.detected"
+	eventRepairCompleted      = "repair.completed"
+)
+
+// what gets POSTed to a webhook
+type imageEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Hash      string    `json:"hash"`
+	Extension string    `json:"extension"`
+	Nodes     []string  `json:"nodes"`
+	Replicas  int       `json:"replicas"`
+
+	// how many copies of an image the cluster keeps, and the
+	// fewest that an upload has to make to succeed. An upload
+	// that can't make MinReplication copies sends
+	// replication.failed. replication.satisfied is sent once
+	// Replicas reaches Replication, either by the upload itself
+	// or later, by whichever of the rebalancer, hinted handoff,
+	// anti-entropy or read repair makes the last copy.
+	Replication    int `json:"replication"`
+	MinReplication int `json:"min_replication"`
+}
+
+// a webhook, as configured. Secret is used to sign every
+// payload, and Events limits which events it gets (all of them
+// if empty).
+type webhookConfig struct {
+	URL    string
+	Secret string
+	Events []string
+}
+
+func (w webhookConfig) wants(typ string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// a delivery is one event that still has to get to one webhook
+type delivery struct {
+	URL         string     `json:"url"`
+	Event       imageEvent `json:"event"`
+	Attempts    int        `json:"attempts"`
+	NextAttempt time.Time  `json:"next_attempt"`
+}
+
+func (d delivery) key() string {
+	return d.Event.ID + " " + d.URL
+}
+
+const defaultWebhookOutboxSize = 10000
+
+// webhookOutbox keeps the deliveries that haven't been made yet,
+// saved to a file so that they survive a restart. Changes are
+// only made in memory; Save writes the whole thing out, and is
+// left to the eventNotifier to call in the background. It holds
+// at most size deliveries.
+type webhookOutbox struct {
+	path string
+	size int
+
+	mu         sync.Mutex
+	deliveries map[string]delivery
+	dirty      bool
+	// so that an older copy can't overwrite a newer one
+	saveMu sync.Mutex
+}
+
+func openWebhookOutbox(path string, size int) (*webhookOutbox, error) {
+	o := &webhookOutbox{path: path, size: size, deliveries: make(map[string]delivery)}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []delivery
+	if err := json.Unmarshal(b, &deliveries); err != nil {
+		return nil, err
+	}
+	for _, d := range deliveries {
+		o.deliveries[d.key()] = d
+	}
+	return o, nil
+}
+
+// Save writes the outbox out, if anything has changed since the
+// last time
+func (o *webhookOutbox) Save() error {
+	o.saveMu.Lock()
+	defer o.saveMu.Unlock()
+	o.mu.Lock()
+	if !o.dirty {
+		o.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(o.sorted(func(delivery) bool { return true }))
+	o.dirty = false
+	o.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(o.path, b, 0644)
+	}
+	if err != nil {
+		// try again next time
+		o.mu.Lock()
+		o.dirty = true
+		o.mu.Unlock()
+	}
+	return err
+}
+
+// oldest first
+func (o *webhookOutbox) sorted(keep func(delivery) bool) []delivery {
+	deliveries := make([]delivery, 0, len(o.deliveries))
+	for _, d := range o.deliveries {
+		if keep(d) {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		if !deliveries[i].Event.Time.Equal(deliveries[j].Event.Time) {
+			return deliveries[i].Event.Time.Before(deliveries[j].Event.Time)
+		}
+		return deliveries[i].key() < deliveries[j].key()
+	})
+	return deliveries
+}
+
+// Add queues up new deliveries, as long as there's room for all
+// of them
+func (o *webhookOutbox) Add(deliveries ...delivery) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.size > 0 && len(o.deliveries)+len(deliveries) > o.size {
+		return false
+	}
+	for _, d := range deliveries {
+		o.deliveries[d.key()] = d
+	}
+	o.dirty = true
+	return true
+}
+
+// Put updates a delivery that's still waiting
+func (o *webhookOutbox) Put(d delivery) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.deliveries[d.key()]; ok {
+		o.deliveries[d.key()] = d
+		o.dirty = true
+	}
+}
+
+func (o *webhookOutbox) Remove(d delivery) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.deliveries, d.key())
+	o.dirty = true
+}
+
+// Due returns the deliveries to a webhook that should be tried now,
+// oldest first. It stops at the first one that's waiting to be
+// retried, so that nothing newer overtakes it.
+func (o *webhookOutbox) Due(url string, now time.Time) []delivery {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	pending := o.sorted(func(d delivery) bool { return d.URL == url })
+	for i, d := range pending {
+		if d.NextAttempt.After(now) {
+			return pending[:i]
+		}
+	}
+	return pending
+}
+
+// Retain drops every delivery that keep doesn't want
+func (o *webhookOutbox) Retain(keep func(delivery) bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for k, d := range o.deliveries {
+		if !keep(d) {
+			delete(o.deliveries, k)
+			o.dirty = true
+		}
+	}
+}
+
+func (o *webhookOutbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.deliveries)
+}
+
+const (
+	// give up on a delivery after this many tries. with the
+	// default backoff, that's nearly six hours of trying
+	maxWebhookAttempts = 12
+	maxWebhookBackoff  = 4 * time.Hour
+)
+
+// eventNotifier sends image events to the configured webhooks.
+// Events go into the outbox first, and are then delivered in
+// the background, signed with each webhook's secret, and retried
+// with exponential backoff until they get through (or we give
+// up on them). Each webhook gets its events in order, so while one
+// is being retried the newer ones for that webhook wait behind it,
+// but a slow or failing webhook doesn't hold up the others.
+//
+// All the methods are safe to call on a nil *eventNotifier,
+// which doesn't tell anyone anything.
+type eventNotifier struct {
+	hooks   map[string]webhookConfig
+	outbox  *webhookOutbox
+	client  *http.Client
+	sl      log.Logger
+	metrics *metrics
+	// one for each webhook
+	wake map[string]chan struct{}
+
+	// the cluster's settings, for the payload
+	replication    int
+	minReplication int
+
+	// for testing
+	backoff time.Duration
+	now     func() time.Time
+}
+
+func newEventNotifier(hooks []webhookConfig, outbox *webhookOutbox, sl log.Logger) *eventNotifier {
+	en := &eventNotifier{
+		hooks:   make(map[string]webhookConfig),
+		outbox:  outbox,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		sl:      sl,
+		wake:    make(map[string]chan struct{}),
+		backoff: 10 * time.Second,
+		now:     time.Now,
+	}
+	for _, h := range hooks {
+		en.hooks[h.URL] = h
+		en.wake[h.URL] = make(chan struct{}, 1)
+	}
+	// anything left over for webhooks that have been taken out
+	// of the config since would never go anywhere
+	outbox.Retain(func(d delivery) bool {
+		_, ok := en.hooks[d.URL]
+		return ok
+	})
+	return en
+}
+
+// what the events about an image say about it
+func eventData(ri imageSpecifier, nodes ...string) imageData {
+	return imageData{
+		Hash:      ri.Hash.String(),
+		Extension: strings.TrimPrefix(ri.Extension, "."),
+		Nodes:     nodes,
+	}
+}
+
+// replicaAdded is called after something in the background has
+// made another copy of an image. If that was the copy that brought
+// it up to Replication, it's just become fully replicated. Finding
+// out means asking around, so we only bother if anyone's listening.
+func replicaAdded(ctx context.Context, c Cluster, s siteConfig, ri imageSpecifier) {
+	if s.Events == nil {
+		return
+	}
+	myself := c.GetMyself()
+	var nodes []string
+	for _, n := range c.ReadOrder(ri.Hash.String()) {
+		if n.UUID == myself.UUID {
+			if s.Backend == nil || !s.Backend.Exists(ri) {
+				continue
+			}
+		} else {
+			info, err := n.RetrieveImageInfo(ctx, &ri)
+			if err != nil || info == nil || !info.Local {
+				continue
+			}
+		}
+		nodes = append(nodes, n.Nickname)
+		if len(nodes) > s.Replication {
+			// it already was before this copy
+			return
+		}
+	}
+	if len(nodes) == s.Replication {
+		id := eventData(ri, nodes...)
+		id.Replicas = len(nodes)
+		s.Events.Fire(eventReplicationSatisfied, id)
+	}
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Fire queues up the event for every webhook that wants it
+func (en *eventNotifier) Fire(typ string, id imageData) {
+	if en == nil {
+		return
+	}
+	e := imageEvent{
+		ID:        newEventID(),
+		Type:      typ,
+		Time:      en.now(),
+		Hash:      id.Hash,
+		Extension: id.Extension,
+		Nodes:     id.Nodes,
+		Replicas:  id.Replicas,
+
+		Replication:    en.replication,
+		MinReplication: en.minReplication,
+	}
+	var deliveries []delivery
+	for _, h := range en.hooks {
+		if h.wants(typ) {
+			deliveries = append(deliveries, delivery{URL: h.URL, Event: e, NextAttempt: e.Time})
+		}
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+	if !en.outbox.Add(deliveries...) {
+		en.metrics.Webhook("dropped", len(deliveries))
+		_ = en.sl.Log("level", "WARN", "msg", "webhook outbox is full, dropping event",
+			"event", typ, "hash", id.Hash)
+		return
+	}
+	for _, d := range deliveries {
+		select {
+		case en.wake[d.URL] <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run this as a goroutine
+func (en *eventNotifier) Run() {
+	for url := range en.hooks {
+		go en.runHook(url)
+	}
+	// save every so often, so that Fire never has to wait on
+	// the disk
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		en.save()
+	}
+}
+
+// delivers to one webhook, so that a slow one doesn't hold up
+// the rest
+func (en *eventNotifier) runHook(url string) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		en.deliverDueTo(url)
+		select {
+		case <-en.wake[url]:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (en *eventNotifier) save() {
+	if err := en.outbox.Save(); err != nil {
+		_ = en.sl.Log("level", "ERR", "msg", "could not save webhook outbox", "error", err.Error())
+	}
+}
+
+// try everything that's due for one webhook, oldest first. if one
+// fails, the rest wait until it gets through or we give up on it.
+func (en *eventNotifier) deliverDueTo(url string) {
+	for _, d := range en.outbox.Due(url, en.now()) {
+		if !en.attempt(d) {
+			return
+		}
+	}
+}
+
+// attempt returns false if the delivery is going to be retried
+func (en *eventNotifier) attempt(d delivery) bool {
+	hook, ok := en.hooks[d.URL]
+	if !ok {
+		// it's been taken out of the config since
+		en.outbox.Remove(d)
+		return true
+	}
+	err := en.deliver(hook, d.Event)
+	if err == nil {
+		en.metrics.Webhook("sent", 1)
+		en.outbox.Remove(d)
+		return true
+	}
+	d.Attempts++
+	if d.Attempts >= maxWebhookAttempts {
+		en.metrics.Webhook("failed", 1)
+		_ = en.sl.Log("level", "ERR", "msg", "giving up on webhook", "url", d.URL,
+			"event", d.Event.Type, "hash", d.Event.Hash, "error", err.Error())
+		en.outbox.Remove(d)
+		return true
+	}
+	wait := en.backoff << uint(d.Attempts-1)
+	if wait > maxWebhookBackoff || wait <= 0 {
+		wait = maxWebhookBackoff
+	}
+	d.NextAttempt = en.now().Add(wait)
+	_ = en.sl.Log("level", "WARN", "msg", "webhook failed, will retry", "url", d.URL,
+		"event", d.Event.Type, "attempts", d.Attempts, "error", err.Error())
+	en.outbox.Put(d)
+	return false
+}
+
+// signPayload is what goes in the X-Reticulum-Signature header,
+// so the receiver can check that the body came from us
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (en *eventNotifier) deliver(hook webhookConfig, e imageEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Reticulum-Event", e.Type)
+	req.Header.Set("X-Reticulum-Delivery", e.ID)
+	if hook.Secret != "" {
+		req.Header.Set("X-Reticulum-Signature", signPayload(hook.Secret, body))
+	}
+	resp, err := en.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
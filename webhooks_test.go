@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thraxil/resize"
+)
+
+// a stand-in for an application's webhook endpoint, which fails
+// the first few requests it gets
+type webhookStub struct {
+	mu       sync.Mutex
+	failures int
+	attempts int
+	got      []imageEvent
+	bodies   [][]byte
+	sigs     []string
+}
+
+func (ws *webhookStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.attempts++
+	if ws.attempts <= ws.failures {
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var e imageEvent
+	if err := json.Unmarshal(body, &e); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("X-Reticulum-Event") != e.Type {
+		http.Error(w, "wrong event header", http.StatusBadRequest)
+		return
+	}
+	ws.got = append(ws.got, e)
+	ws.bodies = append(ws.bodies, body)
+	ws.sigs = append(ws.sigs, r.Header.Get("X-Reticulum-Signature"))
+}
+
+func testEventNotifier(t *testing.T, hooks ...webhookConfig) (*eventNotifier, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	outbox, err := openWebhookOutbox(path, defaultWebhookOutboxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	en := newEventNotifier(hooks, outbox, log.NewNopLogger())
+	en.metrics = newMetrics(prometheus.NewRegistry())
+	return en, path
+}
+
+// what Run does, all at once and then waits for it to finish
+func (en *eventNotifier) deliverDue() {
+	var wg sync.WaitGroup
+	for url := range en.hooks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			en.deliverDueTo(url)
+		}()
+	}
+	wg.Wait()
+	en.save()
+}
+
+func Test_eventNotifierDelivers(t *testing.T) {
+	stub := &webhookStub{}
+	ts := httptest.NewServer(stub)
+	defer ts.Close()
+	en, _ := testEventNotifier(t, webhookConfig{URL: ts.URL, Secret: "sekrit"})
+
+	en.Fire(eventReplicationSatisfied, imageData{
+		Hash:      "fb682e05b9be61797601e60165825c0b089f755e",
+		Extension: "jpg",
+		Nodes:     []string{"one", "two"},
+		Replicas:  2,
+	})
+	en.deliverDue()
+
+	if len(stub.got) != 1 {
+		t.Fatalf("expected one event, got %d", len(stub.got))
+	}
+	e := stub.got[0]
+	if e.Type != eventReplicationSatisfied || e.Hash != "fb682e05b9be61797601e60165825c0b089f755e" ||
+		e.Extension != "jpg" || e.Replicas != 2 || len(e.Nodes) != 2 || e.ID == "" {
+		t.Errorf("wrong event: %v", e)
+	}
+	if expected := signPayload("sekrit", stub.bodies[0]); stub.sigs[0] != expected {
+		t.Errorf("bad signature: got %q, expected %q", stub.sigs[0], expected)
+	}
+	if testutil.ToFloat64(en.metrics.webhookDeliveries.WithLabelValues("sent")) != 1 {
+		t.Error("delivery wasn't counted")
+	}
+	if en.outbox.Len() != 0 {
+		t.Error("outbox should be empty once delivered")
+	}
+}
+
+func Test_eventNotifierRetries(t *testing.T) {
+	stub := &webhookStub{failures: 1}
+	ts := httptest.NewServer(stub)
+	defer ts.Close()
+	en, path := testEventNotifier(t, webhookConfig{URL: ts.URL, Secret: "sekrit"})
+	now := time.Now()
+	en.now = func() time.Time { return now }
+
+	en.Fire(eventUploadAccepted, imageData{Hash: "fb682e05b9be61797601e60165825c0b089f755e", Extension: "jpg"})
+	en.deliverDue()
+	if len(stub.got) != 0 || stub.attempts != 1 {
+		t.Fatalf("first attempt should have failed")
+	}
+
+	// it's still waiting after a restart
+	outbox, err := openWebhookOutbox(path, defaultWebhookOutboxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outbox.Len() != 1 {
+		t.Fatalf("expected the delivery to be saved, got %d", outbox.Len())
+	}
+	en.outbox = outbox
+
+	// not yet
+	en.deliverDue()
+	if stub.attempts != 1 {
+		t.Error("should have backed off")
+	}
+	now = now.Add(en.backoff)
+	en.deliverDue()
+	if len(stub.got) != 1 || stub.got[0].Type != eventUploadAccepted {
+		t.Errorf("expected the event to get through, got %v", stub.got)
+	}
+	if outbox.Len() != 0 {
+		t.Error("outbox should be empty once delivered")
+	}
+}
+
+func Test_eventNotifierGivesUp(t *testing.T) {
+	stub := &webhookStub{failures: maxWebhookAttempts}
+	ts := httptest.NewServer(stub)
+	defer ts.Close()
+	en, _ := testEventNotifier(t, webhookConfig{URL: ts.URL})
+	now := time.Now()
+	en.now = func() time.Time { return now }
+
+	en.Fire(eventRepairCompleted, imageData{Hash: "fb682e05b9be61797601e60165825c0b089f755e"})
+	for i := 0; i < maxWebhookAttempts; i++ {
+		en.deliverDue()
+		now = now.Add(maxWebhookBackoff)
+	}
+	if stub.attempts != maxWebhookAttempts {
+		t.Errorf("expected %d attempts, got %d", maxWebhookAttempts, stub.attempts)
+	}
+	if testutil.ToFloat64(en.metrics.webhookDeliveries.WithLabelValues("failed")) != 1 || en.outbox.Len() != 0 {
+		t.Error("should have given up")
+	}
+}
+
+func Test_eventNotifierFilters(t *testing.T) {
+	en, _ := testEventNotifier(t,
+		webhookConfig{URL: "http://localhost:0/all"},
+		webhookConfig{URL: "http://localhost:0/failures", Events: []string{eventReplicationFailed}},
+	)
+	en.Fire(eventReplicationSatisfied, imageData{Hash: "fb682e05b9be61797601e60165825c0b089f755e"})
+	if en.outbox.Len() != 1 {
+		t.Errorf("only one webhook wants that, got %d deliveries", en.outbox.Len())
+	}
+	en.Fire(eventReplicationFailed, imageData{Hash: "fb682e05b9be61797601e60165825c0b089f755e"})
+	if en.outbox.Len() != 3 {
+		t.Errorf("both webhooks want that, got %d deliveries", en.outbox.Len())
+	}
+
+	var nilNotifier *eventNotifier
+	nilNotifier.Fire(eventUploadAccepted, imageData{})
+}
+
+func Test_eventNotifierQueuesInMemory(t *testing.T) {
+	en, path := testEventNotifier(t, webhookConfig{URL: "http://localhost:0/all"})
+	en.outbox.size = 2
+	for i := 0; i < 3; i++ {
+		en.Fire(eventUploadAccepted, imageData{Hash: "fb682e05b9be61797601e60165825c0b089f755e"})
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("firing an event shouldn't write the outbox")
+	}
+	if en.outbox.Len() != 2 || testutil.ToFloat64(en.metrics.webhookDeliveries.WithLabelValues("dropped")) != 1 {
+		t.Errorf("the outbox should be capped, got %d deliveries", en.outbox.Len())
+	}
+	en.save()
+	outbox, err := openWebhookOutbox(path, defaultWebhookOutboxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outbox.Len() != 2 {
+		t.Errorf("expected two saved deliveries, got %d", outbox.Len())
+	}
+
+	// once a webhook is gone from the config, so are its deliveries
+	en = newEventNotifier([]webhookConfig{{URL: "http://localhost:0/other"}}, outbox, log.NewNopLogger())
+	if en.outbox.Len() != 0 {
+		t.Errorf("expected the old deliveries to be dropped, got %d", en.outbox.Len())
+	}
+}
+
+func Test_eventNotifierParallel(t *testing.T) {
+	// the slow one only answers once the other has had its event,
+	// so this only works if they're delivered at the same time
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+			http.Error(w, "waited too long", http.StatusServiceUnavailable)
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(release)
+	}))
+	defer fast.Close()
+	en, _ := testEventNotifier(t, webhookConfig{URL: slow.URL}, webhookConfig{URL: fast.URL})
+
+	en.Fire(eventUploadAccepted, imageData{Hash: "fb682e05b9be61797601e60165825c0b089f755e"})
+	en.deliverDue()
+	if en.outbox.Len() != 0 {
+		t.Errorf("both should have been delivered, %d left", en.outbox.Len())
+	}
+}
+
+func Test_eventNotifierKeepsOrderWhileRetrying(t *testing.T) {
+	stub := &webhookStub{failures: 1}
+	ts := httptest.NewServer(stub)
+	defer ts.Close()
+	en, _ := testEventNotifier(t, webhookConfig{URL: ts.URL})
+	now := time.Now()
+	en.now = func() time.Time { return now }
+
+	en.Fire(eventUploadAccepted, imageData{Hash: "fb682e05b9be61797601e60165825c0b089f755e", Extension: "jpg"})
+	en.deliverDue()
+	if stub.attempts != 1 {
+		t.Fatalf("expected one attempt, got %d", stub.attempts)
+	}
+
+	// the newer event is due, but it has to wait behind the failed one
+	now = now.Add(time.Millisecond)
+	en.Fire(eventReplicationSatisfied, imageData{Hash: "fb682e05b9be61797601e60165825c0b089f755e", Extension: "jpg"})
+	en.deliverDue()
+	if stub.attempts != 1 || len(stub.got) != 0 {
+		t.Fatalf("newer event overtook the failed one: %v", stub.got)
+	}
+
+	now = now.Add(en.backoff)
+	en.deliverDue()
+	if len(stub.got) != 2 {
+		t.Fatalf("expected both events, got %v", stub.got)
+	}
+	if stub.got[0].Type != eventUploadAccepted || stub.got[1].Type != eventReplicationSatisfied {
+		t.Errorf("events out of order: %v", stub.got)
+	}
+}
+
+func Test_replicaAdded(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"local": true}`))
+	}))
+	defer server.Close()
+	_, c := makeNewClusterData([]nodeData{})
+	c.AddNeighbor(nodeData{Nickname: "peer", UUID: "peer-uuid", BaseURL: server.URL, Writeable: true})
+
+	b := newDiskBackend(t.TempDir() + "/")
+	h, _ := hashFromString("fb682e05b9be61797601e60165825c0b089f755e", "")
+	ri := imageSpecifier{h, resize.MakeSizeSpec("full"), ".jpg"}
+	_ = b.WriteFull(ri, io.NopCloser(strings.NewReader("hello")))
+
+	events, _ := testEventNotifier(t, webhookConfig{URL: "http://localhost:0/"})
+	s := siteConfig{Backend: b, Events: events}
+
+	// it already had enough before the copy that was just made
+	s.Replication = 1
+	replicaAdded(context.Background(), c, s, ri)
+	// still not enough
+	s.Replication = 3
+	replicaAdded(context.Background(), c, s, ri)
+	if events.outbox.Len() != 0 {
+		t.Fatalf("shouldn't have said it was satisfied")
+	}
+
+	s.Replication = 2
+	replicaAdded(context.Background(), c, s, ri)
+	due := events.outbox.Due("http://localhost:0/", time.Now())
+	if len(due) != 1 || due[0].Event.Type != eventReplicationSatisfied {
+		t.Fatalf("expected replication.satisfied, got %v", due)
+	}
+	if e := due[0].Event; e.Replicas != 2 || len(e.Nodes) != 2 || e.Extension != "jpg" {
+		t.Errorf("unexpected event %v", e)
+	}
+}
@@ -116,50 +116,21 @@ func resizeWorker(requests chan resizeRequest, sl log.Logger, s *siteConfig) {
 		}
 
 		outputPath := resizedPath(req.Path, req.Size)
-		// Write to a temporary file first
-		tmpFile, err := os.CreateTemp(filepath.Dir(outputPath), "resize-*.tmp")
-		if err != nil {
-			_ = sl.Log("level", "ERR", "msg", "could not create temp file", "path", outputPath, "error", err.Error())
-			req.Response <- resizeResponse{nil, nil, false}
-			continue
-		}
-		tmpName := tmpFile.Name()
-
-		if _, err := tmpFile.Write(newImage); err != nil {
-			_ = tmpFile.Close()
-			_ = os.Remove(tmpName)
-			_ = sl.Log("level", "ERR", "msg", "could not write to temp file", "path", tmpName, "error", err.Error())
-			req.Response <- resizeResponse{nil, nil, false}
-			continue
-		}
-		if err := tmpFile.Sync(); err != nil {
-			_ = tmpFile.Close()
-			_ = os.Remove(tmpName)
-			_ = sl.Log("level", "ERR", "msg", "could not sync temp file", "path", tmpName, "error", err.Error())
-			req.Response <- resizeResponse{nil, nil, false}
-			continue
-		}
-		if err := tmpFile.Close(); err != nil {
-			_ = os.Remove(tmpName)
-			_ = sl.Log("level", "ERR", "msg", "could not close temp file", "path", tmpName, "error", err.Error())
+		if err := writeFileAtomic(outputPath, newImage, 0644); err != nil {
+			_ = sl.Log("level", "ERR", "msg", "could not write resized image", "path", outputPath, "error", err.Error())
 			req.Response <- resizeResponse{nil, nil, false}
 			continue
 		}
 
-		if err := os.Chmod(tmpName, 0644); err != nil {
-			_ = os.Remove(tmpName)
-			_ = sl.Log("level", "ERR", "msg", "could not chmod temp file", "path", tmpName, "error", err.Error())
-			req.Response <- resizeResponse{nil, nil, false}
-			continue
-		}
-
-		if err := os.Rename(tmpName, outputPath); err != nil {
-			_ = os.Remove(tmpName)
-			_ = sl.Log("level", "ERR", "msg", "could not rename temp file to output path", "tmp", tmpName, "output", outputPath, "error", err.Error())
-			req.Response <- resizeResponse{nil, nil, false}
-			continue
+		s.Derivatives.Touch(outputPath, int64(len(newImage)))
+		if h, err := hashFromPath(req.Path); err == nil {
+			if err := s.Index.AddSize(h, req.Size); err != nil {
+				_ = sl.Log("level", "WARN", "msg", "could not update index", "path", outputPath, "error", err.Error())
+			}
+			s.Activity.Publish(activityEvent{Type: "resized", Hash: h.String(), Extension: req.Extension, Size: req.Size})
 		}
 
+		s.Metrics.Resize(req.Size, req.Extension, time.Since(t0))
 		_ = sl.Log("level", "INFO", "msg", "successfully resized image with bimg")
 		req.Response <- resizeResponse{nil, newImage, true}
 		t1 := time.Now()
@@ -10,6 +10,8 @@ import (
 
 	"github.com/go-kit/log"
 	"github.com/h2non/bimg"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func createTestImage(path string) error {
@@ -70,8 +72,10 @@ func TestResizeWorker(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	m := newMetrics(prometheus.NewRegistry())
 	siteConfig := &siteConfig{
 		Writeable: true,
+		Metrics:   m,
 	}
 
 	requests := make(chan resizeRequest)
@@ -109,4 +113,7 @@ func TestResizeWorker(t *testing.T) {
 	if size.Width != 50 {
 		t.Errorf("Expected width 50, got %d", size.Width)
 	}
+	if testutil.CollectAndCount(m.resizeDuration) != 1 {
+		t.Error("expected the resize to be timed")
+	}
 }